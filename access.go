@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//parseNetworks parses a list of CIDRs, plain IP addresses stand for a single host
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+//containsIP reports whether one of the networks contains ip
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//clientIP returns the address of the client that sent a request. Behind trusted proxies it is the
+//last address in X-Forwarded-For that is not a trusted proxy. Connections over a UNIX domain socket
+//come from a local proxy and are trusted as well.
+func clientIP(config Config, r *http.Request) net.IP {
+	proxies, _ := parseNetworks(config.TrustedProxies)
+	trusted := func(ip net.IP) bool {
+		return ip == nil || containsIP(proxies, ip)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !trusted(ip) {
+		return ip
+	}
+
+	//the proxies append the address they received the request from
+	var forwarded []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			//nothing before a malformed entry can be trusted
+			return nil
+		}
+		if !trusted(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+//checkAccess applies the allowedips and basic auth settings to a delivery and reports whether it may
+//be processed, otherwise it answered the request already
+func checkAccess(config Config, w http.ResponseWriter, r *http.Request) bool {
+	if len(config.AllowedIPs) > 0 {
+		allowed, _ := parseNetworks(config.AllowedIPs)
+		ip := clientIP(config, r)
+		if ip == nil || !containsIP(allowed, ip) {
+			warnf("rejected request from %s (%s): not in allowedips\n", ip, r.RemoteAddr)
+			writeJSONError(w, http.StatusForbidden, "address not allowed")
+			return false
+		}
+	}
+
+	if config.BasicAuthUser != "" {
+		user, password, ok := r.BasicAuth()
+		validUser := subtle.ConstantTimeCompare([]byte(user), []byte(config.BasicAuthUser)) == 1
+		validPassword := subtle.ConstantTimeCompare([]byte(password), []byte(config.BasicAuthPassword)) == 1
+		if !ok || !validUser || !validPassword {
+			warnf("rejected request from %s: invalid basic auth credentials\n", clientIP(config, r))
+			w.Header().Set("WWW-Authenticate", `Basic realm="go-gitea-webhook"`)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,489 @@
+package webhook
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DeliveryInfo describes a webhook delivery received by the daemon
+type DeliveryInfo struct {
+	ID         string    `json:"id"`
+	PayloadSHA string    `json:"payload_sha"`
+	Event      string    `json:"event"`
+	Repository string    `json:"repository"`
+	Ref        string    `json:"ref"`
+	Received   time.Time `json:"received"`
+	Skipped    string    `json:"skipped,omitempty"`
+	Replayed   bool      `json:"replayed,omitempty"`
+	Queued     int       `json:"queued"`
+	Executed   int       `json:"executed"`
+	Failed     int       `json:"failed"`
+	//Matched lists the repositories of the config jobs were queued for
+	Matched []string        `json:"matched,omitempty"`
+	Results []CommandRecord `json:"results,omitempty"`
+	//finished is the number of queued jobs that are done
+	finished int
+}
+
+//runtimeState holds the state of the daemon that can be inspected and changed at runtime
+type runtimeState struct {
+	mutex        sync.Mutex
+	started      time.Time
+	reloaded     time.Time
+	paused       bool
+	lastDelivery *DeliveryInfo
+	history      []*historyEntry
+	//disabled holds the repositories disabled from the admin API and since when
+	disabled map[string]time.Time
+}
+
+var state = &runtimeState{started: time.Now()}
+
+//isPaused reports whether command execution is paused
+func (s *runtimeState) isPaused() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.paused
+}
+
+//setPaused pauses or resumes command execution
+func (s *runtimeState) setPaused(paused bool) {
+	s.mutex.Lock()
+	s.paused = paused
+	s.mutex.Unlock()
+}
+
+//isDisabled reports whether any of the names, of a repository of the config or of a Gitea
+//repository, was disabled from the admin API
+func (s *runtimeState) isDisabled(names ...string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, name := range names {
+		if _, ok := s.disabled[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+//setDisabled disables or enables the deploys of a repository
+func (s *runtimeState) setDisabled(name string, disabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !disabled {
+		delete(s.disabled, name)
+		return
+	}
+	if s.disabled == nil {
+		s.disabled = make(map[string]time.Time)
+	}
+	if _, ok := s.disabled[name]; !ok {
+		s.disabled[name] = time.Now()
+	}
+}
+
+//recordDelivery stores info as the last received delivery and adds it to the history
+func (s *runtimeState) recordDelivery(info *DeliveryInfo, payload []byte, request *recordedRequest, size int) {
+	s.mutex.Lock()
+	snapshot := *info
+	s.mutex.Unlock()
+	database.recordDelivery(snapshot)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastDelivery = info
+	if size <= 0 {
+		s.history = nil
+		return
+	}
+	s.history = append(s.history, &historyEntry{info: info, payload: payload, request: request})
+	if len(s.history) > size {
+		s.history = append([]*historyEntry(nil), s.history[len(s.history)-size:]...)
+	}
+}
+
+//recordResults adds the results of a job to the delivery it was queued for
+func (s *runtimeState) recordResults(info *DeliveryInfo, repository string, results []Result) {
+	if info == nil {
+		return
+	}
+	database.recordResults(*info, repository, results)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info.finished++
+	for _, result := range results {
+		info.Executed++
+		if result.Err != nil {
+			info.Failed++
+		}
+		info.Results = append(info.Results, newCommandRecord(repository, result))
+	}
+}
+
+//RedactConfig returns a copy of the config with all secrets replaced
+func RedactConfig(c Config) Config {
+	const redacted = "REDACTED"
+
+	if c.AdminToken != "" {
+		c.AdminToken = redacted
+	}
+	if c.GiteaToken != "" {
+		c.GiteaToken = redacted
+	}
+	if c.BasicAuthPassword != "" {
+		c.BasicAuthPassword = redacted
+	}
+
+	listeners := make([]ConfigListener, len(c.Listeners))
+	for i, l := range c.Listeners {
+		if l.BasicAuthPassword != "" {
+			l.BasicAuthPassword = redacted
+		}
+		listeners[i] = l
+	}
+	if c.Listeners != nil {
+		c.Listeners = listeners
+	}
+
+	repositories := make([]ConfigRepository, len(c.Repositories))
+	for i, repo := range c.Repositories {
+		if repo.Secret != "" {
+			repo.Secret = redacted
+		}
+		if repo.TriggerToken != "" {
+			repo.TriggerToken = redacted
+		}
+		if repo.Env != nil {
+			env := make(map[string]string, len(repo.Env))
+			for name := range repo.Env {
+				env[name] = redacted
+			}
+			repo.Env = env
+		}
+		forward := make([]ForwardTarget, len(repo.Forward))
+		for j, target := range repo.Forward {
+			if target.Secret != "" {
+				target.Secret = redacted
+			}
+			forward[j] = target
+		}
+		repo.Forward = forward
+		publish := make([]ConfigPublish, len(repo.Publish))
+		for j, target := range repo.Publish {
+			if u, err := url.Parse(target.URL); err == nil && u.User != nil {
+				u.User = url.User(redacted)
+				target.URL = u.String()
+			}
+			publish[j] = target
+		}
+		repo.Publish = publish
+		repo.Notify = redactNotifications(repo.Notify)
+		repositories[i] = repo
+	}
+	c.Repositories = repositories
+
+	schedules := make([]ConfigSchedule, len(c.Schedules))
+	for i, schedule := range c.Schedules {
+		schedule.Notify = redactNotifications(schedule.Notify)
+		schedules[i] = schedule
+	}
+	if c.Schedules != nil {
+		c.Schedules = schedules
+	}
+
+	tenants := make([]ConfigTenant, len(c.Tenants))
+	for i, tenant := range c.Tenants {
+		if tenant.Secret != "" {
+			tenant.Secret = redacted
+		}
+		if tenant.TriggerToken != "" {
+			tenant.TriggerToken = redacted
+		}
+		tenants[i] = tenant
+	}
+	if c.Tenants != nil {
+		c.Tenants = tenants
+	}
+
+	if c.Tracing != nil {
+		tracing := *c.Tracing
+		//the headers usually carry the API key of the tracing service
+		tracing.Headers = make(map[string]string, len(c.Tracing.Headers))
+		for name := range c.Tracing.Headers {
+			tracing.Headers[name] = redacted
+		}
+		c.Tracing = &tracing
+	}
+
+	if c.Database != nil {
+		db := *c.Database
+		if u, err := url.Parse(db.DSN); err == nil && u.User != nil {
+			u.User = url.User(redacted)
+			db.DSN = u.String()
+		}
+		//the key=value connection strings of PostgreSQL
+		db.DSN = dsnPassword.ReplaceAllString(db.DSN, "${1}"+redacted)
+		c.Database = &db
+	}
+
+	return foldTenants(c)
+}
+
+//dsnPassword matches the password of a key=value connection string
+var dsnPassword = regexp.MustCompile(`(password=)('[^']*'|\S*)`)
+
+//redactNotifications returns the notification targets without their secrets
+func redactNotifications(targets []ConfigNotification) []ConfigNotification {
+	const redacted = "REDACTED"
+
+	notify := make([]ConfigNotification, len(targets))
+	for j, target := range targets {
+		//incoming webhook URLs of Slack contain their secret
+		if target.Type == "slack" && target.URL != "" {
+			target.URL = redacted
+		}
+		if target.Token != "" {
+			target.Token = redacted
+		}
+		if target.Password != "" {
+			target.Password = redacted
+		}
+		notify[j] = target
+	}
+	return notify
+}
+
+//writeJSON writes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//writeJSONError writes an error message as the JSON response body
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+//adminRoute is an endpoint of the admin API
+type adminRoute struct {
+	method  string
+	handler func(w http.ResponseWriter, r *http.Request)
+}
+
+//adminRoutes maps the paths below /admin/ to their handlers
+var adminRoutes = map[string]adminRoute{
+	"status":          {http.MethodGet, adminStatus},
+	"config":          {http.MethodGet, adminConfig},
+	"repos":           {http.MethodGet, adminRepos},
+	"pause":           {http.MethodPost, adminPause},
+	"resume":          {http.MethodPost, adminResume},
+	"reload":          {http.MethodPost, adminReload},
+	"deliveries/last": {http.MethodGet, adminLastDelivery},
+	"deliveries":      {http.MethodGet, adminDeliveries},
+
+	"deliveries/{id}/replay": {http.MethodPost, adminReplay},
+	"deliveries/{id}/stream": {http.MethodGet, adminStream},
+	"repos/{name}/disable":   {http.MethodPost, adminDisableRepo},
+	"repos/{name}/enable":    {http.MethodPost, adminEnableRepo},
+}
+
+//findAdminRoute returns the route of a path, where a {id} segment of a route matches any segment
+//and a {name} segment one or more, for repository names like org/app
+func findAdminRoute(path string) (adminRoute, bool) {
+	if route, ok := adminRoutes[path]; ok {
+		return route, true
+	}
+
+	segments := strings.Split(path, "/")
+	for pattern, route := range adminRoutes {
+		if matchRoute(strings.Split(pattern, "/"), segments) {
+			return route, true
+		}
+	}
+	return adminRoute{}, false
+}
+
+//matchRoute reports whether the segments of a path match the segments of a route
+func matchRoute(pattern []string, segments []string) bool {
+	for i, segment := range pattern {
+		if segment == "{name}" {
+			rest := pattern[i+1:]
+			return len(segments)-i > len(rest) && matchRoute(rest, segments[len(segments)-len(rest):])
+		}
+		if i >= len(segments) || segment != "{id}" && segment != segments[i] {
+			return false
+		}
+	}
+	return len(pattern) == len(segments)
+}
+
+//pathID returns the segment of the path of an admin request matching {id} in its route
+func pathID(r *http.Request, position int) string {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+	if position < len(segments) {
+		return segments[position]
+	}
+	return ""
+}
+
+//pathName returns the segments of the path of an admin request matching {name} in its route, which is
+//preceded by position segments and followed by after segments
+func pathName(r *http.Request, position int, after int) string {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+	if position+after >= len(segments) {
+		return ""
+	}
+	return strings.Join(segments[position:len(segments)-after], "/")
+}
+
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	//the admin token is sent as a bearer token, or as the password of basic auth for browsers. Browsers
+	//send cached basic auth credentials along with requests other sites make them send, so only GET
+	//requests may use it.
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		if r.Method != http.MethodGet {
+			warnf("rejected admin %s request from %s: basic auth is only accepted for GET\n", r.Method, clientIP(currentConfig(), r))
+			writeJSONError(w, http.StatusForbidden, "a bearer token is required for "+r.Method)
+			return
+		}
+		token = password
+	}
+	adminToken := currentConfig().AdminToken
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		warnf("unauthorized admin request from %s\n", clientIP(currentConfig(), r))
+		w.Header().Set("WWW-Authenticate", `Basic realm="go-gitea-webhook admin"`)
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	route, ok := findAdminRoute(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != route.method {
+		w.Header().Set("Allow", route.method)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	route.handler(w, r)
+}
+
+func adminStatus(w http.ResponseWriter, r *http.Request) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	disabled := make(map[string]time.Time, len(state.disabled))
+	for name, since := range state.disabled {
+		disabled[name] = since
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"started":      state.started,
+		"reloaded":     state.reloaded,
+		"paused":       state.paused,
+		"disabled":     disabled,
+		"configfile":   configFile,
+		"repositories": len(currentConfig().Repositories),
+		"lastdelivery": state.lastDelivery,
+	})
+}
+
+func adminRepos(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, expandTenants(RedactConfig(currentConfig())).Repositories)
+}
+
+func adminConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, RedactConfig(currentConfig()))
+}
+
+func adminDisableRepo(w http.ResponseWriter, r *http.Request) {
+	setRepoDisabled(w, r, true)
+}
+
+func adminEnableRepo(w http.ResponseWriter, r *http.Request) {
+	setRepoDisabled(w, r, false)
+}
+
+//setRepoDisabled disables or enables the repository of an admin request, the name of a repository
+//(or schedule) of the config or of a Gitea repository one of them matches
+func setRepoDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	name := pathName(r, 1, 1)
+	//a repository removed from the config since it was disabled can still be enabled
+	if !configuresRepo(currentConfig(), name) && (disabled || !state.isDisabled(name)) {
+		writeJSONError(w, http.StatusNotFound, "no repository matches "+name)
+		return
+	}
+
+	state.setDisabled(name, disabled)
+	if disabled {
+		log.Printf("deploys of %s disabled\n", name)
+	} else {
+		log.Printf("deploys of %s enabled\n", name)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"repository": name, "disabled": disabled})
+}
+
+//configuresRepo reports whether a name is the name of a repository or schedule of the config, or
+//the name of a Gitea repository one of the repositories matches
+func configuresRepo(config Config, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, repo := range config.Repositories {
+		if repo.Name == name {
+			return true
+		}
+		if match, err := regexp.MatchString(repo.Name, name); err == nil && match {
+			return true
+		}
+	}
+	for _, schedule := range config.Schedules {
+		if schedule.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func adminPause(w http.ResponseWriter, r *http.Request) {
+	state.setPaused(true)
+	log.Println("command execution paused")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func adminResume(w http.ResponseWriter, r *http.Request) {
+	state.setPaused(false)
+	log.Println("command execution resumed")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	reloadConfig()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func adminLastDelivery(w http.ResponseWriter, r *http.Request) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.lastDelivery == nil {
+		writeJSONError(w, http.StatusNotFound, "no deliveries received yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, state.lastDelivery)
+}
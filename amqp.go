@@ -0,0 +1,280 @@
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+//the frame types, classes and methods of AMQP 0-9-1 needed to publish a message
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xCE
+
+	amqpConnection = 10
+	amqpChannel    = 20
+	amqpBasic      = 60
+
+	amqpMethodStart   = 10
+	amqpMethodStartOk = 11
+	amqpMethodTune    = 30
+	amqpMethodTuneOk  = 31
+	amqpMethodOpen    = 40
+	amqpMethodOpenOk  = 41
+	amqpMethodClose   = 50
+	amqpMethodCloseOk = 51
+
+	amqpChannelOpen     = 10
+	amqpChannelOpenOk   = 11
+	amqpChannelClose    = 40
+	amqpBasicPublish    = 40
+	amqpDefaultFrameMax = 131072
+)
+
+//amqpFrame is a frame read from the server
+type amqpFrame struct {
+	frameType byte
+	channel   uint16
+	payload   []byte
+}
+
+//amqpWriter encodes the arguments of methods
+type amqpWriter struct {
+	bytes.Buffer
+}
+
+//short writes an unsigned 16 bit integer
+func (w *amqpWriter) short(v uint16) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+//long writes an unsigned 32 bit integer
+func (w *amqpWriter) long(v uint32) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+//longlong writes an unsigned 64 bit integer
+func (w *amqpWriter) longlong(v uint64) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+//shortstr writes a string of at most 255 bytes
+func (w *amqpWriter) shortstr(s string) {
+	w.WriteByte(byte(len(s)))
+	w.WriteString(s)
+}
+
+//longstr writes a string with a 32 bit length
+func (w *amqpWriter) longstr(s string) {
+	w.long(uint32(len(s)))
+	w.WriteString(s)
+}
+
+//amqpConn is a connection that publishes messages on channel 1
+type amqpConn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	frameMax uint32
+}
+
+//writeFrame sends a frame
+func (c *amqpConn) writeFrame(frameType byte, channel uint16, payload []byte) error {
+	var frame amqpWriter
+	frame.WriteByte(frameType)
+	frame.short(channel)
+	frame.long(uint32(len(payload)))
+	frame.Write(payload)
+	frame.WriteByte(amqpFrameEnd)
+	_, err := c.conn.Write(frame.Bytes())
+	return err
+}
+
+//writeMethod sends a method frame
+func (c *amqpConn) writeMethod(channel uint16, class, method uint16, args []byte) error {
+	var payload amqpWriter
+	payload.short(class)
+	payload.short(method)
+	payload.Write(args)
+	return c.writeFrame(amqpFrameMethod, channel, payload.Bytes())
+}
+
+//readFrame reads the next frame that is not a heartbeat
+func (c *amqpConn) readFrame() (amqpFrame, error) {
+	for {
+		header := make([]byte, 7)
+		_, err := io.ReadFull(c.reader, header)
+		if err != nil {
+			return amqpFrame{}, err
+		}
+		frame := amqpFrame{frameType: header[0], channel: binary.BigEndian.Uint16(header[1:3])}
+		frame.payload = make([]byte, binary.BigEndian.Uint32(header[3:7])+1)
+		_, err = io.ReadFull(c.reader, frame.payload)
+		if err != nil {
+			return amqpFrame{}, err
+		}
+		if frame.payload[len(frame.payload)-1] != amqpFrameEnd {
+			return amqpFrame{}, fmt.Errorf("amqp: malformed frame")
+		}
+		frame.payload = frame.payload[:len(frame.payload)-1]
+		if frame.frameType != amqpFrameHeartbeat {
+			return frame, nil
+		}
+	}
+}
+
+//expectMethod reads a method frame and returns its arguments, a close of the connection or the
+//channel by the server is returned as an error with its reply text
+func (c *amqpConn) expectMethod(class, method uint16) ([]byte, error) {
+	frame, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if frame.frameType != amqpFrameMethod || len(frame.payload) < 4 {
+		return nil, fmt.Errorf("amqp: unexpected frame of type %d", frame.frameType)
+	}
+	gotClass := binary.BigEndian.Uint16(frame.payload[0:2])
+	gotMethod := binary.BigEndian.Uint16(frame.payload[2:4])
+	args := frame.payload[4:]
+	if gotClass == class && gotMethod == method {
+		return args, nil
+	}
+	if gotClass == amqpConnection && gotMethod == amqpMethodClose || gotClass == amqpChannel && gotMethod == amqpChannelClose {
+		//reply-code short, reply-text shortstr
+		if len(args) >= 3 && len(args) >= 3+int(args[2]) {
+			return nil, fmt.Errorf("amqp: %d %s", binary.BigEndian.Uint16(args[0:2]), args[3:3+int(args[2])])
+		}
+		return nil, fmt.Errorf("amqp: closed by the server")
+	}
+	return nil, fmt.Errorf("amqp: unexpected method %d.%d", gotClass, gotMethod)
+}
+
+//publishAMQP publishes a persistent message to an exchange of an AMQP 0-9-1 broker like RabbitMQ,
+//the path of the URL is the virtual host
+func publishAMQP(conn net.Conn, u *url.URL, exchange string, routingKey string, message []byte) error {
+	c := &amqpConn{conn: conn, reader: bufio.NewReader(conn)}
+	_, err := conn.Write([]byte("AMQP\x00\x00\x09\x01"))
+	if err != nil {
+		return err
+	}
+
+	_, err = c.expectMethod(amqpConnection, amqpMethodStart)
+	if err != nil {
+		return err
+	}
+	user, password := "guest", "guest"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	var startOk amqpWriter
+	startOk.long(0) //client-properties
+	startOk.shortstr("PLAIN")
+	startOk.longstr("\x00" + user + "\x00" + password)
+	startOk.shortstr("en_US")
+	err = c.writeMethod(0, amqpConnection, amqpMethodStartOk, startOk.Bytes())
+	if err != nil {
+		return err
+	}
+
+	//brokers close the connection without a reply on failed authentication
+	tune, err := c.expectMethod(amqpConnection, amqpMethodTune)
+	if err != nil {
+		return fmt.Errorf("amqp: login as %s failed: %s", user, err)
+	}
+	if len(tune) < 8 {
+		return fmt.Errorf("amqp: malformed tune")
+	}
+	c.frameMax = binary.BigEndian.Uint32(tune[2:6])
+	if c.frameMax == 0 || c.frameMax > amqpDefaultFrameMax {
+		c.frameMax = amqpDefaultFrameMax
+	}
+	var tuneOk amqpWriter
+	tuneOk.short(binary.BigEndian.Uint16(tune[0:2]))
+	tuneOk.long(c.frameMax)
+	tuneOk.short(0) //no heartbeats for a connection this short
+	err = c.writeMethod(0, amqpConnection, amqpMethodTuneOk, tuneOk.Bytes())
+	if err != nil {
+		return err
+	}
+
+	vhost := strings.TrimPrefix(u.Path, "/")
+	if vhost == "" {
+		vhost = "/"
+	}
+	var open amqpWriter
+	open.shortstr(vhost)
+	open.shortstr("")
+	open.WriteByte(0)
+	err = c.writeMethod(0, amqpConnection, amqpMethodOpen, open.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = c.expectMethod(amqpConnection, amqpMethodOpenOk)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeMethod(1, amqpChannel, amqpChannelOpen, []byte{0})
+	if err != nil {
+		return err
+	}
+	_, err = c.expectMethod(amqpChannel, amqpChannelOpenOk)
+	if err != nil {
+		return err
+	}
+
+	var publish amqpWriter
+	publish.short(0)
+	publish.shortstr(exchange)
+	publish.shortstr(routingKey)
+	publish.WriteByte(0) //not mandatory, not immediate
+	err = c.writeMethod(1, amqpBasic, amqpBasicPublish, publish.Bytes())
+	if err != nil {
+		return err
+	}
+
+	//content-type and delivery-mode properties
+	var header amqpWriter
+	header.short(amqpBasic)
+	header.short(0)
+	header.longlong(uint64(len(message)))
+	header.short(1<<15 | 1<<12)
+	header.shortstr("application/json")
+	header.WriteByte(2) //persistent
+	err = c.writeFrame(amqpFrameHeader, 1, header.Bytes())
+	if err != nil {
+		return err
+	}
+	for chunk := int(c.frameMax) - 8; len(message) > 0; {
+		n := chunk
+		if n > len(message) {
+			n = len(message)
+		}
+		err = c.writeFrame(amqpFrameBody, 1, message[:n])
+		if err != nil {
+			return err
+		}
+		message = message[n:]
+	}
+
+	//the broker closes the channel before answering the close if the exchange does not exist
+	var closing amqpWriter
+	closing.short(200)
+	closing.shortstr("bye")
+	closing.short(0)
+	closing.short(0)
+	err = c.writeMethod(0, amqpConnection, amqpMethodClose, closing.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = c.expectMethod(amqpConnection, amqpMethodCloseOk)
+	return err
+}
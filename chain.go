@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//triggerRepos queues the jobs of the repositories the repository of a successful job triggers, for
+//deployments spanning several repositories. The jobs run for a push to the dependent repository on
+//the ref of the delivery.
+func (j *job) triggerRepos() {
+	d := j.delivery
+	for _, fullName := range j.repo.TriggersRepos {
+		chain := append(append([]string{}, d.Chain...), d.Repo.FullName)
+		if cycle := chainCycle(chain, fullName); cycle != "" {
+			d.warnf("not triggering %s from %s, it would loop: %s\n", fullName, j.repo.Name, cycle)
+			continue
+		}
+		if isDryRun(j.repo) {
+			d.logf("dry run: would trigger %s after %s\n", fullName, d.Repo.FullName)
+			continue
+		}
+		runChained(j.config, j.repo.tenant, d, chain, fullName)
+	}
+}
+
+//chainCycle returns the loop a repository closes in a chain of triggered repositories, if any
+func chainCycle(chain []string, fullName string) string {
+	for i, name := range chain {
+		if name == fullName {
+			return strings.Join(chain[i:], " -> ") + " -> " + fullName
+		}
+	}
+	return ""
+}
+
+//runChained queues the jobs of the repositories of the config (or of the tenant) matching a triggered
+//repository, they show up in the history as a delivery of their own
+func runChained(config Config, tenant string, upstream *Delivery, chain []string, fullName string) {
+	d := newTriggerDelivery(fullName, triggerRequest{Ref: upstream.Ref})
+	d.ID = "chain-" + strings.TrimPrefix(d.ID, "trigger-")
+	d.Provider = "chain"
+	d.Chain = chain
+	d.trace = upstream.trace
+	d.Env = []string{"GITEA_TRIGGERED_BY=" + upstream.Repo.FullName, "GITEA_TRIGGERED_BY_DELIVERY=" + upstream.ID}
+	info := &DeliveryInfo{
+		ID:         d.ID,
+		Event:      d.Event,
+		Repository: fullName,
+		Ref:        d.Ref,
+		Received:   time.Now(),
+	}
+	defer func() {
+		state.recordDelivery(info, nil, nil, config.HistorySize)
+	}()
+
+	if state.isPaused() {
+		d.logf("command execution is paused, skipping %s\n", fullName)
+		info.Skipped = "paused"
+		return
+	}
+
+	//chained jobs are not sent to a path, every repository of the config may match them except for
+	//the ones of other tenants
+	chainConfig := config
+	chainConfig.Repositories = nil
+	for _, repo := range config.Repositories {
+		if repo.tenant != tenant {
+			continue
+		}
+		repo.Path = ""
+		repo.RepoFromPath = false
+		chainConfig.Repositories = append(chainConfig.Repositories, repo)
+	}
+	matches, matched, skipped := NewMatcher(chainConfig).Match(d, "/")
+	if skipped != "" {
+		info.Skipped = skipped
+	}
+	if !matched {
+		d.warnf("no repository matched %s triggered by %s\n", fullName, upstream.Repo.FullName)
+		info.Skipped = "no repository matched"
+		return
+	}
+
+	env := append(os.Environ(), "GITEA_ENVIRONMENT="+resolveEnvironment(config, d.Ref))
+	env = append(env, d.environment()...)
+	for _, match := range matches {
+		jobEnv := env
+		if match.Delivery != d {
+			jobEnv = append(append([]string{}, env...), match.Delivery.matchEnvironment()...)
+		}
+		j := &job{config: config, repo: match.Repository, delivery: match.Delivery, action: match.Action, commands: match.Commands, env: jobEnv, info: info}
+		if !deploys.admit(j) {
+			info.Skipped = "already running"
+			continue
+		}
+		if !queue.enqueue(j) {
+			info.Skipped = "queue full"
+			continue
+		}
+		d.logf("queued %s triggered by %s\n", match.Repository.Name, upstream.Repo.FullName)
+		info.Queued++
+		info.Matched = append(info.Matched, match.Repository.Name)
+	}
+}
+
+//checkChains reports the cycles of the repositories of a config that trigger each other, a
+//repository triggers the repositories whose name matches one of its triggersrepos
+func checkChains(problem func(format string, v ...interface{}), repos []ConfigRepository) {
+	edges := make([][]int, len(repos))
+	for i, repo := range repos {
+		for _, fullName := range repo.TriggersRepos {
+			for k, target := range repos {
+				if match, err := regexp.MatchString(target.Name, fullName); err == nil && match {
+					edges[i] = append(edges[i], k)
+				}
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	marks := make([]int, len(repos))
+	var path []int
+	var visit func(i int)
+	visit = func(i int) {
+		marks[i] = visiting
+		path = append(path, i)
+		for _, k := range edges[i] {
+			switch marks[k] {
+			case unvisited:
+				visit(k)
+			case visiting:
+				var names []string
+				for n := len(path) - 1; n >= 0; n-- {
+					names = append([]string{repos[path[n]].Name}, names...)
+					if path[n] == k {
+						break
+					}
+				}
+				names = append(names, repos[k].Name)
+				problem("triggersrepos of repositories form a cycle: %s", strings.Join(names, " -> "))
+			}
+		}
+		path = path[:len(path)-1]
+		marks[i] = done
+	}
+	for i := range repos {
+		if marks[i] == unvisited {
+			visit(i)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"fmt"
+)
+
+//defaultJobClass is the class of the jobs of repositories and schedules without a class
+const defaultJobClass = "default"
+
+//ConfigJobClass is a kind of job, like deploy, build or notify, with its own priority in the queue
+//and limit of running jobs
+type ConfigJobClass struct {
+	Name string
+	//Priority orders the queued jobs, jobs of a higher priority run first and jobs of the same
+	//priority in the order they were queued
+	Priority int
+	//Concurrency is the number of jobs of the class that run at once, at most the workers; 0 does
+	//not limit them
+	Concurrency int
+}
+
+//jobClass returns the class of the jobs of a repository, the default class has priority 0 and no
+//limit unless the config has one named default
+func (config Config) jobClass(repo ConfigRepository) ConfigJobClass {
+	name := repo.Class
+	if name == "" {
+		name = defaultJobClass
+	}
+	for _, class := range config.JobClasses {
+		if class.Name == name {
+			return class
+		}
+	}
+	return ConfigJobClass{Name: name}
+}
+
+//checkJobClasses reports the problems of the job classes of a config and the classes of its
+//repositories and schedules
+func checkJobClasses(problem func(format string, v ...interface{}), config Config) {
+	names := make(map[string]bool)
+	for i, class := range config.JobClasses {
+		name := class.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+			problem("jobclass %s has no name", name)
+		} else if names[name] {
+			problem("jobclass %s is configured more than once", name)
+		}
+		names[name] = true
+		if class.Concurrency < 0 {
+			problem("concurrency of jobclass %s is negative", name)
+		}
+	}
+
+	names[defaultJobClass] = true
+	for _, repo := range config.Repositories {
+		if repo.Class != "" && !names[repo.Class] {
+			problem("repository %s has the unknown class %s", repo.Name, repo.Class)
+		}
+	}
+	for _, schedule := range config.Schedules {
+		if schedule.Class != "" && !names[schedule.Class] {
+			problem("schedule %s has the unknown class %s", schedule.Name, schedule.Class)
+		}
+	}
+}
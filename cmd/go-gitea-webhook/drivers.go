@@ -0,0 +1,7 @@
+package main
+
+import (
+	//the drivers of the database setting
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
@@ -0,0 +1,147 @@
+//go-gitea-webhook runs commands for the webhook deliveries of Gitea
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+
+	webhook "github.com/mrexodia/go-gitea-webhook"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "send" {
+		send(os.Args[2:])
+		return
+	}
+
+	dumpConfig := flag.Bool("dump-config", false, "print the effective config with secrets redacted and exit")
+	dumpFormat := flag.String("dump-format", "json", "format of -dump-config, json or yaml")
+	checkConfig := flag.Bool("check-config", false, "validate the config file and exit")
+	register := flag.Bool("register", false, "create or update the webhooks of the repositories in Gitea and exit")
+	verify := flag.Bool("verify", false, "check that the webhooks of the repositories exist in Gitea and match the config and exit")
+	flag.BoolVar(&webhook.DryRun, "dry-run", false, "log the commands that would run instead of running them")
+	service := flag.String("service", "", "install or uninstall the Windows service running with the config file and exit")
+	flag.Parse()
+
+	//if we have a "real" argument we take this as conf path to the config file
+	configFile := "config.json"
+	if flag.NArg() > 0 {
+		configFile = flag.Arg(0)
+	}
+
+	if *service != "" {
+		err := manageService(*service, configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *checkConfig {
+		_, err := webhook.ReadConfig(configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: ok\n", configFile)
+		return
+	}
+
+	if *dumpConfig {
+		config, err := webhook.ReadConfig(configFile)
+		if err == nil {
+			err = webhook.WriteConfig(os.Stdout, webhook.RedactConfig(config), *dumpFormat)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *register || *verify {
+		config, err := webhook.ReadConfig(configFile)
+		if err == nil && *register {
+			err = webhook.RegisterHooks(config, os.Stdout)
+		} else if err == nil {
+			err = webhook.VerifyHooks(config, os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	server, err := webhook.NewFromFile(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config file %s: %s\n", configFile, err)
+		os.Exit(1)
+	}
+	//the service manager of Windows controls the daemon through its own protocol
+	isService, err := runService(server)
+	if !isService && err == nil {
+		err = server.Run()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+//send posts a test delivery to a running daemon, see webhook.Send
+func send(args []string) {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: go-gitea-webhook send [flags] <webhook URL>")
+		flags.PrintDefaults()
+	}
+	var options webhook.SendOptions
+	flags.StringVar(&options.Event, "event", "push", "event of the delivery: push, create, delete, issues, issue_comment, pull_request or release")
+	flags.StringVar(&options.Repo, "repo", "", "owner/name of the repository")
+	flags.StringVar(&options.Ref, "ref", "refs/heads/main", "ref of the delivery, the head branch of pull requests and the tag of releases")
+	flags.StringVar(&options.Action, "action", "", "action of issue, comment, pull request and release deliveries")
+	flags.StringVar(&options.Body, "body", "", "body of the comment, issue, pull request or release")
+	flags.StringVar(&options.Sender, "sender", "", "user name of the sender, the owner by default")
+	flags.StringVar(&options.GiteaURL, "gitea-url", "", "base of the URLs in the payload")
+	flags.StringVar(&options.Secret, "secret", "", "secret to sign the delivery with")
+	configFile := flags.String("config", "", "take the secret from the repository of this config file handling the delivery")
+	printPayload := flags.Bool("print", false, "print the payload instead of sending it")
+	flags.Parse(args)
+
+	if *printPayload {
+		payload, err := webhook.SamplePayload(options)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(payload))
+		return
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	hookURL := flags.Arg(0)
+
+	if *configFile != "" && options.Secret == "" {
+		config, err := webhook.ReadConfig(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *configFile, err)
+			os.Exit(1)
+		}
+		urlPath := "/"
+		if parsed, err := url.Parse(hookURL); err == nil && parsed.Path != "" {
+			urlPath = parsed.Path
+		}
+		options.Secret = webhook.DeliverySecret(config, options.Repo, urlPath)
+	}
+
+	if err := webhook.Send(hookURL, options, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+
+	webhook "github.com/mrexodia/go-gitea-webhook"
+)
+
+//runService reports false, services other than the ones of Windows run the daemon like a console
+func runService(server *webhook.Server) (bool, error) {
+	return false, nil
+}
+
+//manageService fails, use a systemd unit instead
+func manageService(action string, configFile string) error {
+	return errors.New("-service is only supported on Windows, see the systemd units in the README")
+}
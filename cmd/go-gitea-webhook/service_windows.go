@@ -0,0 +1,107 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	webhook "github.com/mrexodia/go-gitea-webhook"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+//serviceName is the name the daemon is registered with in the service manager
+const serviceName = "go-gitea-webhook"
+
+//runService runs the server as a Windows service when the service manager started the daemon,
+//it reports false when the daemon was started from a console
+func runService(server *webhook.Server) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+	return true, svc.Run(serviceName, &service{server: server})
+}
+
+//service reports the state of the server to the service manager and stops it on request
+type service struct {
+	server *webhook.Server
+}
+
+//Execute runs the server until it fails or the service manager stops it
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.server.Run()
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return true, 1
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				//the queued jobs and the shutdown commands may take a while
+				status <- svc.Status{State: svc.StopPending}
+				s.server.Stop()
+			}
+		}
+	}
+}
+
+//manageService installs the service running the daemon with a config file, or uninstalls it
+func manageService(action string, configFile string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	switch action {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		//services start in the system directory
+		configFile, err = filepath.Abs(configFile)
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "Gitea webhook",
+			Description: "Runs commands for the webhook deliveries of Gitea",
+			StartType:   mgr.StartAutomatic,
+		}, configFile)
+		if err != nil {
+			return err
+		}
+		s.Close()
+		fmt.Printf("installed service %s with config file %s\n", serviceName, configFile)
+		return nil
+	case "uninstall":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		err = s.Delete()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("uninstalled service %s\n", serviceName)
+		return nil
+	}
+	return fmt.Errorf("unknown service action %s, expected install or uninstall", action)
+}
@@ -0,0 +1,503 @@
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ConfigCommand represents a command of a repository from the config file,
+//it is either a plain string with the path of the command or an object
+type ConfigCommand struct {
+	Command  string
+	Timeout  int64
+	SudoUser string
+	//Payload appends the raw payload to the arguments of a templated command
+	Payload bool
+	//Limits override the limits of the repository and the config for this command
+	Limits ConfigLimits
+
+	//args are the exact arguments of commands run by the built-in actions
+	args []string
+}
+
+//UnmarshalJSON accepts both the plain string and the object form of a command
+func (c *ConfigCommand) UnmarshalJSON(data []byte) error {
+	var command string
+	if err := json.Unmarshal(data, &command); err == nil {
+		*c = ConfigCommand{Command: command}
+		return nil
+	}
+
+	type configCommand ConfigCommand
+	return json.Unmarshal(data, (*configCommand)(c))
+}
+
+//commandTimeout returns the timeout of a command, the most specific setting wins
+func commandTimeout(config Config, repo ConfigRepository, cmd ConfigCommand) time.Duration {
+	timeout := config.CommandTimeout
+	if repo.Timeout > 0 {
+		timeout = repo.Timeout
+	}
+	if cmd.Timeout > 0 {
+		timeout = cmd.Timeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+//commandSudoUser returns the user a command runs as with sudo, or an empty string to run it directly
+func commandSudoUser(repo ConfigRepository, cmd ConfigCommand) string {
+	if cmd.SudoUser != "" {
+		return cmd.SudoUser
+	}
+	return repo.SudoUser
+}
+
+//newCommand prepares the execution of a command, prefixing it with sudo when required, which keeps
+//the GITEA_ variables and the ones in preserve
+func newCommand(config Config, sudoUser string, args []string, env []string, preserve []string) (*exec.Cmd, error) {
+	if sudoUser == "" {
+		command := exec.Command(args[0], args[1:]...)
+		command.Env = env
+		return command, nil
+	}
+
+	if !sudoAllowed(config, args[0]) {
+		return nil, fmt.Errorf("%s is not in sudocommands, refusing to run it as %s", args[0], sudoUser)
+	}
+
+	//sudo resets the environment, so explicitly keep the variables we set
+	var keep []string
+	for _, variable := range env {
+		if strings.HasPrefix(variable, "GITEA_") {
+			keep = append(keep, variable[:strings.Index(variable, "=")])
+		}
+	}
+	for _, variable := range preserve {
+		keep = append(keep, variable[:strings.Index(variable, "=")])
+	}
+
+	sudoArgs := []string{"-n", "-u", sudoUser}
+	if len(keep) > 0 {
+		sudoArgs = append(sudoArgs, "--preserve-env="+strings.Join(keep, ","))
+	}
+	sudoArgs = append(sudoArgs, "--")
+	sudoArgs = append(sudoArgs, args...)
+
+	command := exec.Command("sudo", sudoArgs...)
+	command.Env = env
+	return command, nil
+}
+
+//exit codes reported for commands that did not exit on their own, following the conventions of the shell and timeout(1)
+const (
+	exitCodeTimeout    = 124
+	exitCodeStartError = 127
+	exitCodeCancelled  = 137
+)
+
+//Result is the outcome of running a command
+type Result struct {
+	Command  string
+	ExitCode int
+	Started  time.Time
+	Duration time.Duration
+	Output   []byte
+	Err      error
+	//StartFailed is set when the command could not be started at all
+	StartFailed bool
+	//LogFile is the file of the run log the output was written to
+	LogFile string
+	//Attempts is the number of times the command ran, including retries
+	Attempts int
+}
+
+//startFailed returns the result of a command that could not be started
+func startFailed(d *Delivery, cmd string, err error) Result {
+	d.errorf("%s", err)
+	return Result{Command: cmd, ExitCode: exitCodeStartError, Started: time.Now(), Err: err, StartFailed: true}
+}
+
+//runCommand executes a command of a repository within its timeout and logs the result,
+//the command is killed early when ctx is cancelled
+//and its output is also written to a file of the run log if there is one
+func runCommand(ctx context.Context, config Config, repo ConfigRepository, cmd ConfigCommand, d *Delivery, data []byte, env []string, runLog *runLog) (result Result) {
+	fullName := d.Repo.FullName
+
+	//commands that are traced themselves continue the trace of the job with TRACEPARENT
+	span := startSpan(config, spanFromContext(ctx), "command "+cmd.Command, spanKindInternal)
+	if span != nil {
+		env = append(env[:len(env):len(env)], "TRACEPARENT="+span.spanContext().traceParent())
+	}
+	defer func() {
+		span.set("process.command", cmd.Command)
+		span.set("process.exit_code", result.ExitCode)
+		span.fail(result.Err)
+		span.end()
+	}()
+
+	args, err := commandArgs(cmd, d, data)
+	if err != nil {
+		return startFailed(d, cmd.Command, fmt.Errorf("invalid command template %s: %s", cmd.Command, err))
+	}
+	//the commands of a tenant are confined to its commanddir and all commands to the execution
+	//policy, the built-in actions are not
+	tenant := config.tenant(repo)
+	if len(cmd.args) == 0 {
+		args[0], err = tenantCommand(tenant, args[0])
+		if err == nil {
+			args[0], err = allowedProgram(config, repo, args[0])
+		}
+		if err != nil {
+			return startFailed(d, cmd.Command, err)
+		}
+		if isShell(args[0]) {
+			d.warnf("running the shell %s for %s with allowshell, payload data in its arguments is run as a script\n", args[0], repo.Name)
+		}
+	}
+	repoEnv, err := repo.environment()
+	if err != nil {
+		return startFailed(d, cmd.Command, fmt.Errorf("failed to read the envfiles of %s: %s", repo.Name, err))
+	}
+	env = env[:len(env):len(env)]
+	for _, variable := range repoEnv {
+		//an envfile changed since the config check cannot fake the variables of the delivery
+		if !strings.HasPrefix(variable, "GITEA_") {
+			env = append(env, variable)
+		}
+	}
+
+	sudoUser := commandSudoUser(repo, cmd)
+	command, err := newCommand(config, sudoUser, args, env, repoEnv)
+	if err != nil {
+		return startFailed(d, cmd.Command, err)
+	}
+	command.Dir, err = repo.workDir(d)
+	if err != nil {
+		return startFailed(d, cmd.Command, fmt.Errorf("invalid workdir template %s: %s", repo.WorkDir, err))
+	}
+	if isDryRun(repo) {
+		return dryRunCommand(repo, cmd, d, command)
+	}
+	if sudoUser != "" {
+		d.logf("sudo: running %s as %s for %s\n", cmd.Command, sudoUser, fullName)
+	}
+
+	//stdout and stderr go to the same file, interleaved as they arrive
+	var logFile *os.File
+	if runLog != nil {
+		logFile, err = runLog.create()
+		if err != nil {
+			return startFailed(d, cmd.Command, fmt.Errorf("failed to create run log for %s: %s", cmd.Command, err))
+		}
+		defer logFile.Close()
+	}
+
+	//the output is read from pipes instead of letting exec copy it, so Wait returns once the
+	//command exits even if children that are still running hold on to its stdout
+	limits := commandLimits(config, repo, cmd)
+	combined := &combinedOutput{size: maxResultOutput}
+	stdout, err := captureOutput(&command.Stdout, logFile, streams.writer(d, repo.Name, cmd.Command, "stdout"), combined, limits.OutputSize)
+	if err != nil {
+		return startFailed(d, cmd.Command, err)
+	}
+	stderr, err := captureOutput(&command.Stderr, logFile, streams.writer(d, repo.Name, cmd.Command, "stderr"), combined, limits.OutputSize)
+	if err != nil {
+		stdout.close()
+		return startFailed(d, cmd.Command, err)
+	}
+
+	//run the command in its own process group so its children can be cleaned up with it
+	group := newProcessGroup(command)
+
+	if repo.RunAs != "" {
+		if sudoUser != "" {
+			stdout.close()
+			stderr.close()
+			return startFailed(d, cmd.Command, fmt.Errorf("%s has both runas and sudouser set", cmd.Command))
+		}
+		err = setRunAs(command, repo.RunAs)
+		if err != nil {
+			stdout.close()
+			stderr.close()
+			return startFailed(d, cmd.Command, fmt.Errorf("invalid runas %s: %s", repo.RunAs, err))
+		}
+	}
+	resources, err := newResourceLimits(limits, command)
+	if err != nil {
+		stdout.close()
+		stderr.close()
+		return startFailed(d, cmd.Command, fmt.Errorf("failed to limit the resources of %s: %s", cmd.Command, err))
+	}
+	defer resources.release()
+
+	result = Result{Command: cmd.Command, Started: time.Now()}
+	err = command.Start()
+	stdout.started()
+	stderr.started()
+	if err != nil {
+		stdout.close()
+		stderr.close()
+		return startFailed(d, cmd.Command, fmt.Errorf("failed to start %s: %s", cmd.Command, err))
+	}
+	group.started()
+	resources.started(d)
+	streams.publish(d.ID, streamEvent{Type: "start", Repository: repo.Name, Command: cmd.Command})
+
+	//never leave children of the command behind, whether it exited, timed out or we panicked
+	defer func() {
+		group.kill()
+		stdout.close()
+		stderr.close()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- command.Wait()
+	}()
+
+	timeout := commandTimeout(config, repo, cmd)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	select {
+	case err = <-done:
+		//kill the children first so the output pipes get closed
+		group.kill()
+		result.ExitCode = command.ProcessState.ExitCode()
+		if err != nil {
+			if sudoUser != "" {
+				err = sudoError(err, stderr.bytes())
+			}
+			if reason := resources.exceeded(); reason != "" {
+				err = errors.New(reason)
+			}
+			result.Err = fmt.Errorf("%s failed: %s", cmd.Command, err)
+			d.errorf("%s", result.Err)
+		} else {
+			d.logf("Executed: %s", cmd.Command)
+		}
+	case <-ctx.Done():
+		group.kill()
+		<-done
+		if ctx.Err() == context.DeadlineExceeded {
+			result.ExitCode = exitCodeTimeout
+			result.Err = fmt.Errorf("%s timed out after %s", cmd.Command, timeout)
+		} else {
+			result.ExitCode = exitCodeCancelled
+			result.Err = fmt.Errorf("%s was cancelled", cmd.Command)
+		}
+		d.errorf("%s", result.Err)
+	}
+	result.Duration = time.Since(result.Started)
+	//wait for both copies, before the output is reported, the file is closed and the exit is streamed
+	stdout.bytes()
+	stderr.bytes()
+	result.Output = combined.bytes()
+	if tenant != nil && tenant.LogFile != "" {
+		tenantLogs.write(tenant, fullName, result)
+	} else {
+		writeCommandOutput(config, fullName, cmd.Command, result.Output)
+	}
+	exitCode := result.ExitCode
+	streams.publish(d.ID, streamEvent{Type: "exit", Repository: repo.Name, Command: cmd.Command, ExitCode: &exitCode, Duration: result.Duration.Seconds()})
+	if logFile != nil {
+		result.LogFile = logFile.Name()
+		d.logf("output of %s written to %s\n", cmd.Command, result.LogFile)
+	}
+
+	return result
+}
+
+//DryRun logs the commands that would run instead of running them, it is set by the -dry-run flag
+var DryRun bool
+
+//isDryRun reports whether the commands of a repository are only logged instead of executed
+func isDryRun(repo ConfigRepository) bool {
+	return DryRun || repo.DryRun
+}
+
+//workDir returns the working directory of the commands of the repository for a delivery, it may be
+//a template like the commands, for example with the capture groups of the name of the repository
+func (repo ConfigRepository) workDir(d *Delivery) (string, error) {
+	if !isTemplate(repo.WorkDir) {
+		return repo.WorkDir, nil
+	}
+	return expandTemplate(repo.WorkDir, d)
+}
+
+//dryRunCommand logs what would be executed for a command and reports it as succeeded
+func dryRunCommand(repo ConfigRepository, cmd ConfigCommand, d *Delivery, command *exec.Cmd) Result {
+	var env []string
+	for _, variable := range command.Env {
+		if strings.HasPrefix(variable, "GITEA_") {
+			env = append(env, variable)
+		}
+	}
+	dir := command.Dir
+	if dir == "" {
+		dir = "."
+	}
+
+	d.logf("dry run: would run %q in %s as %s with %q\n", command.Args, dir, runAsDescription(repo), env)
+	return Result{Command: cmd.Command, Started: time.Now()}
+}
+
+//runAsDescription describes the user the commands of a repository run as
+func runAsDescription(repo ConfigRepository) string {
+	if repo.RunAs != "" {
+		return repo.RunAs
+	}
+	return "the daemon user"
+}
+
+//outputCapture collects the output a command writes to a pipe
+type outputCapture struct {
+	reader *os.File
+	writer *os.File
+	buffer bytes.Buffer
+	done   chan struct{}
+}
+
+//captureOutput connects a new pipe to the given stdout or stderr of a command,
+//the output is also copied to file if it is not nil, to the live stream and to the
+//combined output of both, everything beyond size bytes is discarded if size is set
+func captureOutput(target *io.Writer, file *os.File, live io.Writer, combined io.Writer, size int64) (*outputCapture, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &outputCapture{reader: reader, writer: writer, done: make(chan struct{})}
+	*target = writer
+	out := io.MultiWriter(&c.buffer, live, combined)
+	if file != nil {
+		out = io.MultiWriter(&c.buffer, file, live, combined)
+	}
+	out = limitOutput(out, size)
+	go func() {
+		io.Copy(out, reader)
+		close(c.done)
+	}()
+	return c, nil
+}
+
+//maxResultOutput is the number of bytes of the end of the combined output of a command that is kept
+//in its result for the history, the database, comments and notifications
+const maxResultOutput = 1 << 20
+
+//combinedOutput interleaves stdout and stderr of a command as they arrive, like the run log, and
+//keeps the last size bytes
+type combinedOutput struct {
+	mutex   sync.Mutex
+	buffer  []byte
+	size    int
+	dropped int
+}
+
+func (c *combinedOutput) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.buffer = append(c.buffer, p...)
+	//trimmed in steps, not on every write
+	if len(c.buffer) > 2*c.size {
+		c.dropped += len(c.buffer) - c.size
+		c.buffer = append([]byte{}, c.buffer[len(c.buffer)-c.size:]...)
+	}
+	return len(p), nil
+}
+
+//bytes returns the combined output, noting how much of its beginning was dropped
+func (c *combinedOutput) bytes() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	output, dropped := c.buffer, c.dropped
+	if len(output) > c.size {
+		dropped += len(output) - c.size
+		output = output[len(output)-c.size:]
+	}
+	if dropped == 0 {
+		return output
+	}
+	return append([]byte(fmt.Sprintf("[%d bytes of output dropped]\n", dropped)), output...)
+}
+
+//started closes our copy of the write end once the command has inherited it
+func (c *outputCapture) started() {
+	c.writer.Close()
+}
+
+//bytes waits until all writers closed the pipe and returns the output,
+//children we were not allowed to kill only get a short grace period
+func (c *outputCapture) bytes() []byte {
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		c.reader.Close()
+		<-c.done
+	}
+	return c.buffer.Bytes()
+}
+
+//close releases the pipe
+func (c *outputCapture) close() {
+	c.writer.Close()
+	c.reader.Close()
+}
+
+//sudoAllowed reports whether cmd may be executed with sudo
+func sudoAllowed(config Config, cmd string) bool {
+	for _, allowed := range config.SudoCommands {
+		if filepath.Clean(allowed) == filepath.Clean(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+//sudoError explains a failure of sudo itself, like a missing passwordless sudo rule
+func sudoError(err error, stderr []byte) error {
+	if bytes.HasPrefix(stderr, []byte("sudo:")) {
+		return fmt.Errorf("sudo failed, passwordless sudo is required: %s", bytes.TrimSpace(stderr))
+	}
+	return err
+}
+
+//writeCommandOutput sends the output of a command to the destinations in the commandoutput setting
+func writeCommandOutput(config Config, source string, cmd string, out []byte) {
+	for _, destination := range config.CommandOutput {
+		switch destination {
+		case "log":
+			log.Println("Output: " + string(out))
+		case "stdout":
+			writePrefixedLines(os.Stdout, fmt.Sprintf("[%s] %s: ", source, cmd), out)
+		case "stderr":
+			writePrefixedLines(os.Stderr, fmt.Sprintf("[%s] %s: ", source, cmd), out)
+		default:
+			warnf("unknown commandoutput destination %s\n", destination)
+		}
+	}
+}
+
+//writePrefixedLines writes every line of out with a prefix, so interleaved output can be told apart
+func writePrefixedLines(w io.Writer, prefix string, out []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, len(out)+1)
+	for scanner.Scan() {
+		fmt.Fprintln(w, prefix+scanner.Text())
+	}
+}
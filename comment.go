@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//defaultCommentOutputSize is the number of bytes of the output of every command included in a comment
+//when not configured
+const defaultCommentOutputSize = 4000
+
+//commentIndex returns the pull request the results of a job are commented on. Gitea has no comments
+//on commits, so pushes are commented on the open pull request of the pushed branch. Comments are
+//never posted for comment events, the comment would trigger the job again.
+func (j *job) commentIndex(client *api.Client, owner string, name string) (int64, error) {
+	d := j.delivery
+	if d.Issue != nil || strings.Contains(d.Event, "comment") {
+		return 0, nil
+	}
+	if d.PullRequest != nil {
+		return d.PullRequest.Index, nil
+	}
+	if d.Event != "push" || d.Branch() == "" {
+		return 0, nil
+	}
+
+	pulls, err := client.ListRepoPullRequests(owner, name, api.ListPullRequestsOptions{State: "open"})
+	if err != nil {
+		return 0, err
+	}
+	for _, pull := range pulls {
+		if pull.Head != nil && pull.Head.Ref == d.Branch() && (d.After == "" || pull.Head.Sha == d.After) {
+			return pull.Index, nil
+		}
+	}
+	return 0, nil
+}
+
+//postComment comments the results of the job with the output of the commands on its pull request
+func (j *job) postComment(results []Result) {
+	if !j.repo.CommentOutput || isDryRun(j.repo) || len(results) == 0 {
+		return
+	}
+	if j.config.GiteaURL == "" || j.config.GiteaToken == "" {
+		j.delivery.warnf("commentoutput of %s requires giteaurl and giteatoken\n", j.repo.Name)
+		return
+	}
+
+	owner, name := splitFullName(j.delivery.Repo)
+	client := api.NewClient(j.config.GiteaURL, j.config.GiteaToken)
+	client.SetHTTPClient(&http.Client{Timeout: giteaTimeout})
+	index, err := j.commentIndex(client, owner, name)
+	if err != nil {
+		j.delivery.errorf("failed to find the pull request of %s: %s\n", j.delivery.Ref, err)
+		return
+	}
+	if index == 0 {
+		debugf(j.config, "no pull request to comment the results of %s on\n", j.delivery.Ref)
+		return
+	}
+
+	_, err = client.CreateIssueComment(owner, name, index, api.CreateIssueCommentOption{Body: j.commentBody(results)})
+	if err != nil {
+		j.delivery.errorf("failed to comment the results on #%d of %s: %s\n", index, j.delivery.Repo.FullName, err)
+	}
+}
+
+//commentBody formats the results of the job as Markdown, with the end of the output of every command
+//in a collapsed section
+func (j *job) commentBody(results []Result) string {
+	size := j.repo.CommentOutputSize
+	if size <= 0 {
+		size = defaultCommentOutputSize
+	}
+	state, description := statusDescription(results)
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "**%s** of `%s`", j.delivery.Event, j.delivery.Repo.FullName)
+	if sha := j.delivery.commitSHA(); sha != "" {
+		fmt.Fprintf(&body, " at %s", sha)
+	}
+	fmt.Fprintf(&body, ": %s, %s\n", state, description)
+
+	for _, result := range results {
+		outcome := "succeeded"
+		if result.Err != nil {
+			outcome = fmt.Sprintf("failed with exit code %d", result.ExitCode)
+		}
+		fmt.Fprintf(&body, "\n<details><summary><code>%s</code> %s in %s</summary>\n\n", html.EscapeString(result.Command), outcome, result.Duration.Round(1e6))
+
+		output := result.Output
+		truncated := len(output) > size
+		if truncated {
+			output = output[len(output)-size:]
+		}
+		text := strings.TrimRight(string(output), "\n")
+		if truncated {
+			text = "...\n" + text
+		}
+		if text == "" {
+			text = "(no output)"
+		}
+		//a fence longer than any backtick run of the output keeps it from closing the code block
+		fence := "```"
+		for strings.Contains(text, fence) {
+			fence += "`"
+		}
+		fmt.Fprintf(&body, "%s\n%s\n%s\n\n</details>\n", fence, text, fence)
+	}
+	return body.String()
+}
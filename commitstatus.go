@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//defaultStatusContext is the context of the commit statuses when not configured
+const defaultStatusContext = "go-gitea-webhook"
+
+//giteaTimeout is the time a request to the Gitea API may take
+const giteaTimeout = 10 * time.Second
+
+//commitSHA returns the commit a delivery is about, or an empty string
+func (d *Delivery) commitSHA() string {
+	sha := d.After
+	if d.PullRequest != nil && d.PullRequest.Head != nil {
+		sha = d.PullRequest.Head.Sha
+	}
+	//deleted refs point to the zero commit
+	if strings.Trim(sha, "0") == "" {
+		return ""
+	}
+	return sha
+}
+
+//postCommitStatus reports the state of a job on the commit of its delivery in Gitea
+func (j *job) postCommitStatus(state api.StatusState, description string) {
+	if !j.repo.CommitStatus || isDryRun(j.repo) {
+		return
+	}
+	sha := j.delivery.commitSHA()
+	if sha == "" {
+		return
+	}
+	if j.config.GiteaURL == "" || j.config.GiteaToken == "" {
+		j.delivery.warnf("commitstatus of %s requires giteaurl and giteatoken\n", j.repo.Name)
+		return
+	}
+
+	context := j.repo.StatusContext
+	if context == "" {
+		context = defaultStatusContext
+	}
+	targetURL := ""
+	if j.repo.StatusURL != "" {
+		var err error
+		targetURL, err = expandTemplate(j.repo.StatusURL, j.delivery)
+		if err != nil {
+			j.delivery.warnf("invalid statusurl %s: %s\n", j.repo.StatusURL, err)
+		}
+	}
+
+	owner, name := splitFullName(j.delivery.Repo)
+	client := api.NewClient(j.config.GiteaURL, j.config.GiteaToken)
+	client.SetHTTPClient(&http.Client{Timeout: giteaTimeout})
+	_, err := client.CreateStatus(owner, name, sha, api.CreateStatusOption{
+		State:       state,
+		TargetURL:   targetURL,
+		Description: description,
+		Context:     context,
+	})
+	if err != nil {
+		j.delivery.errorf("failed to post %s commit status for %s: %s\n", state, sha, err)
+	}
+}
+
+//splitFullName returns the owner and the name of a repository
+func splitFullName(repo *api.Repository) (string, string) {
+	if i := strings.Index(repo.FullName, "/"); i >= 0 {
+		return repo.FullName[:i], repo.FullName[i+1:]
+	}
+	if repo.Owner != nil {
+		return repo.Owner.UserName, repo.Name
+	}
+	return "", repo.Name
+}
+
+//statusDescription summarizes the results of a job for its commit status
+func statusDescription(results []Result) (api.StatusState, string) {
+	for _, result := range results {
+		if result.Err != nil {
+			return api.StatusFailure, fmt.Sprintf("%s failed with exit code %d", result.Command, result.ExitCode)
+		}
+	}
+	return api.StatusSuccess, fmt.Sprintf("%d commands succeeded", len(results))
+}
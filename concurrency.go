@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"context"
+	"sync"
+)
+
+//deployLocks keeps the jobs of a repository from running at the same time, according to its concurrency setting:
+//"queue" (default) runs them one after the other, "skip" drops deliveries while a job is queued or running,
+//"cancel" kills the running job and only runs the latest one, "parallel" does not limit them
+type deployLocks struct {
+	mutex   sync.Mutex
+	changed *sync.Cond
+	deploys map[string]*deployState
+}
+
+//deployState tracks the jobs of a repository between being queued and finished
+type deployState struct {
+	//pending counts the jobs that were admitted and did not finish yet
+	pending int
+	//latest is the last admitted job, older waiting ones are dropped with the cancel policy
+	latest  *job
+	running *job
+	cancel  context.CancelFunc
+}
+
+var deploys = newDeployLocks()
+
+func newDeployLocks() *deployLocks {
+	l := &deployLocks{deploys: make(map[string]*deployState)}
+	l.changed = sync.NewCond(&l.mutex)
+	return l
+}
+
+//deployKey identifies the jobs that must not run at the same time
+func deployKey(j *job) string {
+	return j.repo.tenant + "\x00" + j.repo.Name + "\x00" + j.delivery.Repo.FullName
+}
+
+//concurrency returns the concurrency policy of the repository of a job
+func concurrency(j *job) string {
+	if j.repo.Concurrency == "" {
+		return "queue"
+	}
+	return j.repo.Concurrency
+}
+
+//admit is called before a job is queued and reports whether it may be queued
+func (l *deployLocks) admit(j *job) bool {
+	policy := concurrency(j)
+	if policy == "parallel" {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := deployKey(j)
+	deploy := l.deploys[key]
+	if deploy == nil {
+		deploy = &deployState{}
+		l.deploys[key] = deploy
+	}
+
+	if policy == "skip" && deploy.pending > 0 {
+		j.delivery.logf("a job for %s is already queued or running, skipping %s\n", j.delivery.Repo.FullName, j.delivery.Event)
+		return false
+	}
+	if policy == "cancel" && deploy.running != nil {
+		j.delivery.logf("cancelling the running job for %s in favour of the newer %s\n", j.delivery.Repo.FullName, j.delivery.Event)
+		deploy.cancel()
+	}
+
+	deploy.pending++
+	deploy.latest = j
+	//waiting jobs that were superseded can give up now
+	l.changed.Broadcast()
+	return true
+}
+
+//acquire waits until the job may run and returns the context to run it with,
+//it reports false if the job was superseded by a newer one meanwhile
+func (l *deployLocks) acquire(ctx context.Context, j *job) (context.Context, bool) {
+	policy := concurrency(j)
+	if policy == "parallel" {
+		return ctx, true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	deploy := l.deploys[deployKey(j)]
+	for {
+		if policy == "cancel" && deploy.latest != nil && deploy.latest != j {
+			j.delivery.logf("skipping %s for %s, superseded by a newer delivery\n", j.delivery.Event, j.delivery.Repo.FullName)
+			l.finish(j, deploy)
+			return nil, false
+		}
+		if deploy.running == nil {
+			break
+		}
+		l.changed.Wait()
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	deploy.running = j
+	deploy.cancel = cancel
+	return runCtx, true
+}
+
+//release is called when an acquired job finished
+func (l *deployLocks) release(j *job) {
+	if concurrency(j) == "parallel" {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	deploy := l.deploys[deployKey(j)]
+	deploy.running = nil
+	deploy.cancel()
+	deploy.cancel = nil
+	l.finish(j, deploy)
+}
+
+//drop is called for an admitted job that could not be queued
+func (l *deployLocks) drop(j *job) {
+	if concurrency(j) == "parallel" {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.finish(j, l.deploys[deployKey(j)])
+}
+
+//finish forgets an admitted job, the caller holds the mutex
+func (l *deployLocks) finish(j *job, deploy *deployState) {
+	deploy.pending--
+	if deploy.latest == j {
+		deploy.latest = nil
+	}
+	if deploy.pending == 0 {
+		delete(l.deploys, deployKey(j))
+	}
+	l.changed.Broadcast()
+}
@@ -0,0 +1,316 @@
+package webhook
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//ConfigSchedule represents commands that run periodically, like a nightly backup, with the same
+//logging, locking and notifications as the commands of a repository
+type ConfigSchedule struct {
+	Name string
+	//Cron is when the commands run, five fields (minute, hour, day of month, month and day of week)
+	//like "30 2 * * *" or one of @hourly, @daily, @weekly, @monthly and @yearly
+	Cron string
+	//Timezone is the location the cron expression is evaluated in, the local time by default
+	Timezone  string
+	Commands  []ConfigCommand
+	Action    *ConfigAction
+	OnSuccess []ConfigCommand
+	OnFailure []ConfigCommand
+	Policy    string
+	Timeout   int64
+	//Retries is the number of times a failed command is retried, like the retries of a repository
+	Retries      int
+	RetryBackoff int64
+	WorkDir      string
+	RunAs        string
+	SudoUser     string
+	//Concurrency is how a run is handled while the previous one is still running, "skip" by default
+	Concurrency string
+	DryRun      bool
+	Notify      []ConfigNotification
+	//AllowShell lets the commands run a shell, like the allowshell of a repository
+	AllowShell bool
+	//Class is the job class of the runs, like the class of a repository
+	Class string
+}
+
+//repository returns the repository settings the jobs of the schedule run with
+func (s ConfigSchedule) repository() ConfigRepository {
+	concurrency := s.Concurrency
+	if concurrency == "" {
+		concurrency = "skip"
+	}
+	return ConfigRepository{
+		Name:         s.Name,
+		Commands:     s.Commands,
+		Action:       s.Action,
+		OnSuccess:    s.OnSuccess,
+		OnFailure:    s.OnFailure,
+		Policy:       s.Policy,
+		Timeout:      s.Timeout,
+		Retries:      s.Retries,
+		RetryBackoff: s.RetryBackoff,
+		WorkDir:      s.WorkDir,
+		RunAs:        s.RunAs,
+		SudoUser:     s.SudoUser,
+		Concurrency:  concurrency,
+		DryRun:       s.DryRun,
+		Notify:       s.Notify,
+		AllowShell:   s.AllowShell,
+		Class:        s.Class,
+	}
+}
+
+//location returns the location the cron expression of the schedule is evaluated in
+func (s ConfigSchedule) location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(s.Timezone)
+}
+
+//cronExpression holds the minutes, hours, days, months and weekdays of a cron expression as bit sets
+type cronExpression struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	//anyDay and anyWeekday are set when the field is *, otherwise a day matches either of them
+	anyDay     bool
+	anyWeekday bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonths = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+//parseCron parses a cron expression with five fields, which may hold *, lists, ranges and steps like
+//"*/15", "1-5" or "mon,wed,fri"
+func parseCron(spec string) (cronExpression, error) {
+	var expr cronExpression
+
+	if macro, ok := cronMacros[strings.ToLower(strings.TrimSpace(spec))]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return expr, fmt.Errorf("invalid cron expression \"%s\", expected \"<minute> <hour> <day> <month> <weekday>\"", spec)
+	}
+
+	weekdayNames := make(map[string]int)
+	for name, day := range weekdays {
+		weekdayNames[name] = int(day)
+	}
+	var err error
+	for _, field := range []struct {
+		bits     *uint64
+		min, max int
+		names    map[string]int
+	}{
+		{&expr.minutes, 0, 59, nil},
+		{&expr.hours, 0, 23, nil},
+		{&expr.days, 1, 31, nil},
+		{&expr.months, 1, 12, cronMonths},
+		{&expr.weekdays, 0, 7, weekdayNames},
+	} {
+		*field.bits, err = parseCronField(fields[0], field.min, field.max, field.names)
+		if err != nil {
+			return expr, fmt.Errorf("%s in cron expression \"%s\"", err, spec)
+		}
+		fields = fields[1:]
+	}
+
+	//7 is Sunday as well
+	if expr.weekdays&(1<<7) != 0 {
+		expr.weekdays |= 1
+	}
+	expr.anyDay = strings.HasPrefix(strings.Fields(spec)[2], "*")
+	expr.anyWeekday = strings.HasPrefix(strings.Fields(spec)[4], "*")
+	return expr, nil
+}
+
+//parseCronField parses a field of a cron expression into a bit set of the values it matches
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("invalid value \"%s\"", s)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step \"%s\"", part)
+			}
+			part = part[:i]
+		}
+
+		first, last := min, max
+		switch bounds := strings.SplitN(part, "-", 2); {
+		case part == "*":
+		case len(bounds) == 2:
+			var err error
+			if first, err = value(bounds[0]); err == nil {
+				last, err = value(bounds[1])
+			}
+			if err != nil {
+				return 0, err
+			}
+			if last < first {
+				return 0, fmt.Errorf("invalid range \"%s\"", part)
+			}
+		default:
+			var err error
+			first, err = value(part)
+			if err != nil {
+				return 0, err
+			}
+			//a single value with a step runs from the value to the end, like 5/15
+			if step == 1 {
+				last = first
+			}
+		}
+
+		for n := first; n <= last; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+//matches reports whether the expression matches the minute of t
+func (expr cronExpression) matches(t time.Time) bool {
+	has := func(bits uint64, n int) bool {
+		return bits&(1<<uint(n)) != 0
+	}
+	if !has(expr.minutes, t.Minute()) || !has(expr.hours, t.Hour()) || !has(expr.months, int(t.Month())) {
+		return false
+	}
+
+	//like cron, restricting both the day of the month and the day of the week matches either
+	day := has(expr.days, t.Day())
+	weekday := has(expr.weekdays, int(t.Weekday()))
+	switch {
+	case expr.anyDay && expr.anyWeekday:
+		return true
+	case expr.anyDay:
+		return weekday
+	case expr.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+//cronStarted makes sure the schedules are only checked by a single goroutine
+var cronStarted sync.Once
+
+//startCron checks the schedules of the active config at the start of every minute, so changes
+//of a reloaded config apply right away
+func startCron() {
+	cronStarted.Do(func() {
+		go func() {
+			for {
+				next := time.Now().Truncate(time.Minute).Add(time.Minute)
+				time.Sleep(time.Until(next))
+				runDueSchedules(currentConfig(), next)
+			}
+		}()
+	})
+}
+
+//runDueSchedules queues the jobs of the schedules whose cron expression matches the minute t
+func runDueSchedules(config Config, t time.Time) {
+	for _, schedule := range config.Schedules {
+		expr, err := parseCron(schedule.Cron)
+		if err != nil {
+			warnf("skipping schedule %s: %s\n", schedule.Name, err)
+			continue
+		}
+		location, err := schedule.location()
+		if err != nil {
+			warnf("skipping schedule %s: %s\n", schedule.Name, err)
+			continue
+		}
+		if expr.matches(t.In(location)) {
+			runSchedule(config, schedule, t)
+		}
+	}
+}
+
+//runSchedule queues the job of a schedule like the job of a delivery, it shows up in the history
+//as a delivery of the "schedule" event for a repository named like the schedule
+func runSchedule(config Config, schedule ConfigSchedule, t time.Time) {
+	d := &Delivery{
+		ID:    schedule.Name + "-" + t.Format("20060102-1504"),
+		Event: "schedule",
+		Repo:  &api.Repository{Name: schedule.Name, FullName: schedule.Name},
+		Env:   []string{"GITEA_SCHEDULE=" + schedule.Name, "GITEA_SCHEDULED_TIME=" + t.Format(time.RFC3339)},
+	}
+	info := &DeliveryInfo{
+		ID:         d.ID,
+		Event:      d.Event,
+		Repository: schedule.Name,
+		Received:   time.Now(),
+	}
+	defer func() {
+		state.recordDelivery(info, nil, nil, config.HistorySize)
+	}()
+
+	if state.isPaused() {
+		d.logf("command execution is paused, skipping schedule %s\n", schedule.Name)
+		info.Skipped = "paused"
+		return
+	}
+	if state.isDisabled(schedule.Name) {
+		d.logf("schedule %s is disabled, skipping it\n", schedule.Name)
+		info.Skipped = "disabled"
+		return
+	}
+
+	repo := schedule.repository()
+	env := append(os.Environ(), "GITEA_ENVIRONMENT="+resolveEnvironment(config, d.Ref))
+	env = append(env, d.environment()...)
+	j := &job{config: config, repo: repo, delivery: d, action: repo.Action, commands: repo.Commands, env: env, info: info}
+
+	//the previous run may still be going
+	if !deploys.admit(j) {
+		info.Skipped = "already running"
+		return
+	}
+	if !queue.enqueue(j) {
+		info.Skipped = "queue full"
+		return
+	}
+	d.logf("queued schedule %s\n", schedule.Name)
+	info.Queued++
+	info.Matched = append(info.Matched, schedule.Name)
+}
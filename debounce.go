@@ -0,0 +1,69 @@
+package webhook
+
+import (
+	"sync"
+	"time"
+)
+
+//debouncer holds back the jobs of repositories with a debounce window until no delivery
+//arrived for the window, then only the job of the latest delivery runs
+type debouncer struct {
+	mutex   sync.Mutex
+	pending map[string]*debouncedJob
+}
+
+//debouncedJob is the latest job waiting for the window of its repository and event to pass
+type debouncedJob struct {
+	job       *job
+	timer     *time.Timer
+	coalesced int
+}
+
+var debounces = &debouncer{pending: make(map[string]*debouncedJob)}
+
+//hold reports whether the job is debounced, which restarts the window of its repository and event
+func (b *debouncer) hold(j *job) bool {
+	if j.repo.Debounce <= 0 {
+		return false
+	}
+	window := time.Duration(j.repo.Debounce) * time.Second
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	key := j.key()
+	pending, ok := b.pending[key]
+	if !ok {
+		pending = &debouncedJob{}
+		pending.timer = time.AfterFunc(window, func() {
+			b.fire(key)
+		})
+		b.pending[key] = pending
+	} else {
+		pending.timer.Reset(window)
+	}
+	pending.job = j
+	pending.coalesced++
+
+	j.delivery.logf("debouncing %s for %s for %s (%d deliveries coalesced)\n", j.delivery.Event, j.delivery.Repo.FullName, window, pending.coalesced)
+	return true
+}
+
+//fire queues the latest job once its window passed
+func (b *debouncer) fire(key string) {
+	b.mutex.Lock()
+	pending, ok := b.pending[key]
+	delete(b.pending, key)
+	b.mutex.Unlock()
+
+	//the timer was reset after it had already fired
+	if !ok {
+		return
+	}
+
+	j := pending.job
+	j.delivery.logf("debounce window passed, queueing %s for %s (%d deliveries coalesced)\n", j.delivery.Event, j.delivery.Repo.FullName, pending.coalesced)
+	if !schedules.hold(j) {
+		queue.push(j)
+	}
+}
@@ -0,0 +1,48 @@
+package webhook
+
+import (
+	"container/list"
+	"sync"
+)
+
+//defaultDedupSize is the number of delivery IDs remembered when dedupsize is not configured
+const defaultDedupSize = 1000
+
+//deliveryCache remembers the IDs of the latest processed deliveries, so a redelivery by Gitea does
+//not deploy twice
+type deliveryCache struct {
+	mutex sync.Mutex
+	ids   map[string]*list.Element
+	order *list.List
+}
+
+var seenDeliveries = &deliveryCache{ids: make(map[string]*list.Element), order: list.New()}
+
+//reserve records a delivery ID and reports false if it was seen already, the oldest IDs are
+//forgotten beyond size
+func (c *deliveryCache) reserve(id string, size int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.ids[id]; ok {
+		return false
+	}
+	c.ids[id] = c.order.PushBack(id)
+	for c.order.Len() > size {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.ids, oldest.Value.(string))
+	}
+	return true
+}
+
+//release forgets a delivery ID again, for deliveries that were not processed and may be retried
+func (c *deliveryCache) release(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.ids[id]; ok {
+		c.order.Remove(element)
+		delete(c.ids, id)
+	}
+}
@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//dockerCleanupTimeout is the time removing a container that outlived its command may take
+const dockerCleanupTimeout = 30 * time.Second
+
+//dockerRun runs the command of a docker action in a new container, which is removed afterwards.
+//The docker CLI is used so DOCKER_HOST and the contexts of the daemon user apply.
+func dockerRun(ctx context.Context, d *Delivery, action Action) []Result {
+	if action.Image == "" {
+		return []Result{startFailed(d, "docker", fmt.Errorf("docker action of %s has no image", d.Repo.FullName))}
+	}
+
+	var command []string
+	for _, word := range splitTemplate(action.Command) {
+		arg, err := expandTemplate(word, d)
+		if err != nil {
+			return []Result{startFailed(d, "docker", fmt.Errorf("invalid command template %s: %s", action.Command, err))}
+		}
+		command = append(command, arg)
+	}
+
+	id := make([]byte, 6)
+	rand.Read(id)
+	name := "go-gitea-webhook-" + hex.EncodeToString(id)
+
+	args := []string{"docker", "run", "--rm", "--name", name}
+	if action.Pull {
+		args = append(args, "--pull", "always")
+	}
+	for _, volume := range action.Volumes {
+		args = append(args, "--volume", volume)
+	}
+	if action.Network != "" {
+		args = append(args, "--network", action.Network)
+	}
+	if action.WorkDir != "" {
+		args = append(args, "--workdir", action.WorkDir)
+	}
+	//the limits of the docker CLI do not apply to the container
+	limits := commandLimits(action.Config, action.Repository, ConfigCommand{})
+	if limits.Memory > 0 {
+		args = append(args, "--memory", strconv.FormatInt(limits.Memory, 10))
+	}
+	if limits.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(limits.CPUs, 'f', -1, 64))
+	}
+	if limits.Processes > 0 {
+		args = append(args, "--pids-limit", strconv.FormatInt(limits.Processes, 10))
+	}
+	//the variables describing the delivery are passed on with their values from our environment
+	for _, variable := range action.Env {
+		if strings.HasPrefix(variable, "GITEA_") {
+			args = append(args, "--env", strings.SplitN(variable, "=", 2)[0])
+		}
+	}
+	for _, variable := range action.Env {
+		args = append(args, "--env", variable)
+	}
+	args = append(append(args, "--", action.Image), command...)
+
+	display := "docker run " + action.Image
+	if action.Command != "" {
+		display += " " + action.Command
+	}
+	result := action.runCommand(ctx, d, ConfigCommand{Command: display, args: args})
+
+	//killing the docker CLI on a timeout or cancel leaves the container running
+	if result.Err != nil && !result.StartFailed {
+		cleanup, cancel := context.WithTimeout(context.Background(), dockerCleanupTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(cleanup, "docker", "rm", "--force", name).CombinedOutput()
+		if err != nil && !strings.Contains(string(out), "No such container") {
+			d.warnf("failed to remove container %s: %s %s\n", name, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return []Result{result}
+}
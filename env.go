@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//envName matches the names of the variables of env and envfiles
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+//environment returns the variables the repository adds to the environment of its commands, the ones
+//of the envfiles in order and then the ones of env. The files are read every time, so rotated
+//credentials are picked up without a reload.
+func (repo ConfigRepository) environment() ([]string, error) {
+	var env []string
+	for _, file := range repo.EnvFiles {
+		variables, err := readEnvFile(file)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, variables...)
+	}
+
+	names := make([]string, 0, len(repo.Env))
+	for name := range repo.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+repo.Env[name])
+	}
+	return env, nil
+}
+
+//readEnvFile reads the NAME=value lines of an env file like the ones of Docker and systemd, empty
+//lines and comments are skipped and quotes around values are removed
+func readEnvFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var env []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i < 0 || !envName.MatchString(strings.TrimSpace(line[:i])) {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value", path, number)
+		}
+		name, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env = append(env, name+"="+value)
+	}
+	return env, scanner.Err()
+}
+
+//checkEnv reports the problems of the env and envfiles of a repository
+func checkEnv(problem func(format string, v ...interface{}), repo ConfigRepository, name string) {
+	for variable := range repo.Env {
+		if !envName.MatchString(variable) {
+			problem("invalid variable name %s in env of repository %s", variable, name)
+		}
+	}
+	variables, err := repo.environment()
+	if err != nil {
+		problem("envfiles of repository %s: %s", name, err)
+	}
+	for _, variable := range variables {
+		//the variables of the delivery cannot be faked
+		if strings.HasPrefix(variable, "GITEA_") {
+			problem("env of repository %s cannot set %s", name, variable[:strings.Index(variable, "=")])
+		}
+	}
+}
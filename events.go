@@ -0,0 +1,609 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//Delivery is a webhook delivery normalized across the supported event types
+type Delivery struct {
+	ID       string
+	Event    string
+	Action   string
+	Provider string
+	Secret   string
+	Repo     *api.Repository
+	Sender   *api.User
+	Ref      string
+	//Env holds the event specific environment variables for the commands
+	Env []string
+	//Header holds the headers the delivery was received with
+	Header http.Header
+
+	//push
+	Before       string
+	After        string
+	CompareURL   string
+	Commits      []*api.PayloadCommit
+	HeadCommit   *api.PayloadCommit
+	TotalCommits int
+	Pusher       *api.User
+
+	//create and delete
+	RefType string
+
+	//fork
+	Forkee *api.Repository
+
+	//issues, issue_comment, pull_request and pull_request_review
+	Issue       *api.Issue
+	Comment     *api.Comment
+	PullRequest *api.PullRequest
+	Review      *review
+
+	//release
+	Release *api.Release
+
+	//Match and Groups hold the capture groups of the commentpattern of the matched repository
+	Match  []string
+	Groups map[string]string
+	//RepoMatch and RepoGroups hold the capture groups of the name of the matched repository
+	RepoMatch  []string
+	RepoGroups map[string]string
+	//Vars holds the template variables set by the script of the matched repository
+	Vars map[string]string
+	//Chain lists the repositories whose jobs triggered the delivery of a dependent repository
+	Chain []string
+	//trace is the span of the processing of the delivery, the parent of the spans of its jobs
+	trace spanContext
+	//raw is the payload as it was sent, for Raw
+	raw []byte
+
+	//package
+	Package *packageInfo
+}
+
+//review is the review of a pull_request_review event
+type review struct {
+	State   string
+	Content string
+}
+
+//packageInfo is the package of a package event
+type packageInfo struct {
+	ID         int64           `json:"id"`
+	Owner      *api.User       `json:"owner"`
+	Repository *api.Repository `json:"repository"`
+	Creator    *api.User       `json:"creator"`
+	Type       string          `json:"type"`
+	Name       string          `json:"name"`
+	Version    string          `json:"version"`
+	HTMLURL    string          `json:"html_url"`
+}
+
+//pullRequestReviewPayload represents the payload of a pull request review event
+type pullRequestReviewPayload struct {
+	Secret      string           `json:"secret"`
+	Action      string           `json:"action"`
+	Index       int64            `json:"number"`
+	PullRequest *api.PullRequest `json:"pull_request"`
+	Repository  *api.Repository  `json:"repository"`
+	Sender      *api.User        `json:"sender"`
+	Review      *struct {
+		Type    string `json:"type"`
+		Content string `json:"content"`
+	} `json:"review"`
+}
+
+//packagePayload represents the payload of a package event
+type packagePayload struct {
+	Secret     string          `json:"secret"`
+	Action     string          `json:"action"`
+	Repository *api.Repository `json:"repository"`
+	Package    *packageInfo    `json:"package"`
+	Sender     *api.User       `json:"sender"`
+}
+
+//events lists the supported events with the parser of their payload
+var events = map[string]func(config Config, data []byte) (*Delivery, error){
+	"push":                parsePush,
+	"create":              parseCreate,
+	"delete":              parseDelete,
+	"fork":                parseFork,
+	"issues":              parseIssues,
+	"issue_comment":       parseIssueComment,
+	"pull_request":        parsePullRequest,
+	"pull_request_review": parsePullRequestReview,
+	"release":             parseRelease,
+	"repository":          parseRepository,
+	"package":             parsePackage,
+}
+
+//normalizeEvent maps the different names Gitea uses for an event to a single one
+func normalizeEvent(event string) string {
+	switch event {
+	case "pull_request_approved", "pull_request_rejected", "pull_request_comment",
+		"pull_request_review_approved", "pull_request_review_rejected", "pull_request_review_comment":
+		return "pull_request_review"
+	}
+	return event
+}
+
+//isSupportedEvent reports whether deliveries of the event can be parsed
+func isSupportedEvent(event string) bool {
+	_, ok := events[event]
+	return ok
+}
+
+//isMerged reports whether the delivery is about a merged pull request
+func (d *Delivery) isMerged() bool {
+	return d.Action == "merged" || d.PullRequest != nil && d.PullRequest.HasMerged && d.Action == "closed"
+}
+
+//isTag reports whether the delivery is about a tag rather than a branch
+func (d *Delivery) isTag() bool {
+	return d.RefType == "tag" || strings.HasPrefix(d.Ref, "refs/tags/")
+}
+
+//refEvents are the names events and eventcommands accept besides the events of Gitea, with the
+//events of Gitea they stand for: "tag" for pushes, creations and deletions of tags, and the others
+//for creating or deleting only branches or only tags
+var refEvents = map[string][]string{
+	"tag":           {"push", "create", "delete"},
+	"branch_create": {"create"},
+	"branch_delete": {"delete"},
+	"tag_create":    {"create"},
+	"tag_delete":    {"delete"},
+}
+
+//isEventName reports whether events and eventcommands accept the name of an event
+func isEventName(event string) bool {
+	_, ok := refEvents[event]
+	return ok || isSupportedEvent(event)
+}
+
+//refEvents returns the names of refEvents the delivery is of, the most specific first
+func (d *Delivery) refEvents() []string {
+	var events []string
+	switch {
+	case d.Event == "create" && d.isTag():
+		events = append(events, "tag_create")
+	case d.Event == "create":
+		events = append(events, "branch_create")
+	case d.Event == "delete" && d.isTag():
+		events = append(events, "tag_delete")
+	case d.Event == "delete":
+		events = append(events, "branch_delete")
+	}
+	if d.isTag() && (d.Event == "push" || d.Event == "create" || d.Event == "delete") {
+		events = append(events, "tag")
+	}
+	return events
+}
+
+//matchesEvent reports whether the delivery is of one of the events, including refEvents
+func (d *Delivery) matchesEvent(events []string) bool {
+	for _, event := range events {
+		if event == d.Event {
+			return true
+		}
+		for _, refEvent := range d.refEvents() {
+			if event == refEvent {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//environment returns the environment variables describing the delivery to the commands
+func (d *Delivery) environment() []string {
+	env := []string{
+		"GITEA_EVENT=" + d.Event,
+		"GITEA_DELIVERY=" + d.ID,
+		"GITEA_REPO=" + d.Repo.FullName,
+		"GITEA_REPO_NAME=" + d.Repo.Name,
+		"GITEA_REF=" + d.Ref,
+		"GITEA_BRANCH=" + d.Branch(),
+		"GITEA_TAG=" + d.Tag(),
+	}
+	if slug := d.Slug(); slug != "" {
+		env = append(env, "GITEA_REF_SLUG="+slug)
+	}
+	if d.Provider != "" {
+		env = append(env, "GITEA_PROVIDER="+d.Provider)
+	}
+	if d.Repo.Owner != nil {
+		env = append(env, "GITEA_REPO_OWNER="+d.Repo.Owner.UserName)
+	}
+	if d.Repo.CloneURL != "" {
+		env = append(env, "GITEA_CLONE_URL="+d.Repo.CloneURL)
+	}
+	if d.Repo.SSHURL != "" {
+		env = append(env, "GITEA_SSH_URL="+d.Repo.SSHURL)
+	}
+	if d.Action != "" {
+		env = append(env, "GITEA_ACTION="+d.Action)
+	}
+	if d.RefType != "" {
+		env = append(env, "GITEA_REF_TYPE="+d.RefType)
+	}
+	if d.Before != "" {
+		env = append(env, "GITEA_BEFORE="+d.Before)
+	}
+	if d.After != "" {
+		env = append(env, "GITEA_AFTER="+d.After)
+	}
+	if d.CompareURL != "" {
+		env = append(env, "GITEA_COMPARE_URL="+d.CompareURL)
+	}
+	if d.Pusher != nil {
+		env = append(env, "GITEA_PUSHER="+d.Pusher.UserName)
+	}
+	if d.Sender != nil {
+		env = append(env, "GITEA_SENDER="+d.Sender.UserName)
+	}
+	if pr := d.PullRequest; pr != nil {
+		env = append(env, "GITEA_PR_NUMBER="+strconv.FormatInt(pr.Index, 10), "GITEA_PR_TITLE="+pr.Title,
+			"GITEA_PR_URL="+pr.HTMLURL, "GITEA_PR_MERGED="+strconv.FormatBool(d.isMerged()))
+		if pr.Head != nil {
+			env = append(env, "GITEA_PR_HEAD_REF="+pr.Head.Ref, "GITEA_PR_HEAD_SHA="+pr.Head.Sha)
+		}
+		if pr.Base != nil {
+			env = append(env, "GITEA_PR_BASE_REF="+pr.Base.Ref)
+		}
+	}
+	if d.HeadCommit != nil {
+		env = append(env, "GITEA_HEAD_MESSAGE="+d.HeadCommit.Message)
+		if d.HeadCommit.Author != nil {
+			env = append(env, "GITEA_HEAD_AUTHOR="+d.HeadCommit.Author.Name)
+		}
+	}
+	return append(env, d.Env...)
+}
+
+func parsePush(config Config, data []byte) (*Delivery, error) {
+	var hook api.PushPayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil && !config.Strict {
+		//fall back to the fields we need in case the SDK types drifted from the Gitea payload
+		var fallbackErr error
+		hook, fallbackErr = parseMinimalPushPayload(data)
+		if fallbackErr == nil {
+			warnf("degraded payload parse (%s), continuing with repository, ref and after only\n", err)
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//Gitea only delivers a limited number of commits for large pushes
+	commitCount := len(hook.Commits)
+	totalCommits := pushTotalCommits(data, commitCount)
+	if totalCommits != commitCount && hook.Repo != nil {
+		warnf("push to %s lists %d of %d commits, the commit list is truncated\n", hook.Repo.FullName, commitCount, totalCommits)
+	}
+
+	return &Delivery{
+		Secret:       hook.Secret,
+		Repo:         hook.Repo,
+		Sender:       hook.Sender,
+		Ref:          hook.Ref,
+		Before:       hook.Before,
+		After:        hook.After,
+		CompareURL:   hook.CompareURL,
+		Commits:      hook.Commits,
+		HeadCommit:   hook.HeadCommit,
+		TotalCommits: totalCommits,
+		Pusher:       hook.Pusher,
+		Env: []string{
+			"GITEA_COMMIT_COUNT=" + strconv.Itoa(commitCount),
+			"GITEA_TOTAL_COMMITS=" + strconv.Itoa(totalCommits),
+		},
+	}, nil
+}
+
+//fullRef turns the short branch or tag name of create and delete events into a full ref
+func fullRef(ref string, refType string) string {
+	if strings.HasPrefix(ref, "refs/") {
+		return ref
+	}
+	if refType == "tag" {
+		return "refs/tags/" + ref
+	}
+	return "refs/heads/" + ref
+}
+
+func parseCreate(config Config, data []byte) (*Delivery, error) {
+	var hook api.CreatePayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Delivery{
+		Secret:  hook.Secret,
+		Repo:    hook.Repo,
+		Sender:  hook.Sender,
+		Ref:     fullRef(hook.Ref, hook.RefType),
+		RefType: hook.RefType,
+		After:   hook.Sha,
+	}, nil
+}
+
+func parseDelete(config Config, data []byte) (*Delivery, error) {
+	var hook api.DeletePayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Delivery{
+		Secret:  hook.Secret,
+		Repo:    hook.Repo,
+		Sender:  hook.Sender,
+		Ref:     fullRef(hook.Ref, hook.RefType),
+		RefType: hook.RefType,
+	}, nil
+}
+
+func parseFork(config Config, data []byte) (*Delivery, error) {
+	var hook api.ForkPayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Delivery{
+		Secret: hook.Secret,
+		Repo:   hook.Repo,
+		Sender: hook.Sender,
+		Forkee: hook.Forkee,
+	}, nil
+}
+
+func parseIssues(config Config, data []byte) (*Delivery, error) {
+	var hook api.IssuePayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Delivery{
+		Secret: hook.Secret,
+		Action: string(hook.Action),
+		Repo:   hook.Repository,
+		Sender: hook.Sender,
+		Issue:  hook.Issue,
+	}, nil
+}
+
+func parseIssueComment(config Config, data []byte) (*Delivery, error) {
+	var hook api.IssueCommentPayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Delivery{
+		Secret:  hook.Secret,
+		Action:  string(hook.Action),
+		Repo:    hook.Repository,
+		Sender:  hook.Sender,
+		Issue:   hook.Issue,
+		Comment: hook.Comment,
+	}, nil
+}
+
+//pullRequestRef returns the full ref of the head branch of a pull request
+func pullRequestRef(pr *api.PullRequest) string {
+	if pr == nil || pr.Head == nil {
+		return ""
+	}
+	return fullRef(pr.Head.Ref, "branch")
+}
+
+func parsePullRequest(config Config, data []byte) (*Delivery, error) {
+	var hook api.PullRequestPayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+	if hook.PullRequest == nil {
+		return nil, errors.New("payload has no pull request")
+	}
+
+	return &Delivery{
+		Secret:      hook.Secret,
+		Action:      string(hook.Action),
+		Repo:        hook.Repository,
+		Sender:      hook.Sender,
+		Ref:         pullRequestRef(hook.PullRequest),
+		PullRequest: hook.PullRequest,
+	}, nil
+}
+
+func parsePullRequestReview(config Config, data []byte) (*Delivery, error) {
+	var hook pullRequestReviewPayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+	if hook.PullRequest == nil || hook.Review == nil {
+		return nil, errors.New("payload has no pull request review")
+	}
+
+	//the review type looks like "pull_request_review_approved"
+	reviewState := hook.Review.Type[strings.LastIndex(hook.Review.Type, "_")+1:]
+	if reviewState == "comment" {
+		reviewState = "commented"
+	}
+
+	reviewer := ""
+	if hook.Sender != nil {
+		reviewer = hook.Sender.UserName
+	}
+
+	if hook.Repository != nil {
+		log.Printf("pull request #%d of %s %s by %s\n", hook.PullRequest.Index, hook.Repository.FullName, reviewState, reviewer)
+	}
+
+	return &Delivery{
+		Secret:      hook.Secret,
+		Action:      hook.Action,
+		Repo:        hook.Repository,
+		Sender:      hook.Sender,
+		Ref:         pullRequestRef(hook.PullRequest),
+		PullRequest: hook.PullRequest,
+		Review:      &review{State: reviewState, Content: hook.Review.Content},
+		Env: []string{
+			"GITEA_REVIEW_STATE=" + reviewState,
+			"GITEA_REVIEWER=" + reviewer,
+		},
+	}, nil
+}
+
+func parseRelease(config Config, data []byte) (*Delivery, error) {
+	var hook api.ReleasePayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+	if hook.Release == nil {
+		return nil, errors.New("payload has no release")
+	}
+
+	return &Delivery{
+		Secret:  hook.Secret,
+		Action:  string(hook.Action),
+		Repo:    hook.Repository,
+		Sender:  hook.Sender,
+		Ref:     fullRef(hook.Release.TagName, "tag"),
+		RefType: "tag",
+		Release: hook.Release,
+		Env:     releaseEnvironment(hook.Release),
+	}, nil
+}
+
+//releaseEnvironment returns the environment variables describing a release
+func releaseEnvironment(release *api.Release) []string {
+	var assets []string
+	for _, asset := range release.Attachments {
+		if asset != nil {
+			assets = append(assets, asset.DownloadURL)
+		}
+	}
+	return []string{
+		"GITEA_RELEASE_TAG=" + release.TagName,
+		"GITEA_RELEASE_NAME=" + release.Title,
+		"GITEA_RELEASE_TARGET=" + release.Target,
+		"GITEA_RELEASE_PRERELEASE=" + strconv.FormatBool(release.IsPrerelease),
+		"GITEA_RELEASE_DRAFT=" + strconv.FormatBool(release.IsDraft),
+		"GITEA_RELEASE_TARBALL=" + release.TarURL,
+		"GITEA_RELEASE_ASSETS=" + strings.Join(assets, "\n"),
+	}
+}
+
+func parseRepository(config Config, data []byte) (*Delivery, error) {
+	var hook api.RepositoryPayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Delivery{
+		Secret: hook.Secret,
+		Action: string(hook.Action),
+		Repo:   hook.Repository,
+		Sender: hook.Sender,
+	}, nil
+}
+
+func parsePackage(config Config, data []byte) (*Delivery, error) {
+	var hook packagePayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+	if hook.Package == nil {
+		return nil, errors.New("payload has no package")
+	}
+
+	owner := ""
+	if hook.Package.Owner != nil {
+		owner = hook.Package.Owner.UserName
+	}
+
+	//packages are not necessarily linked to a repository, those are matched as owner/name
+	repo := hook.Repository
+	if repo == nil {
+		repo = hook.Package.Repository
+	}
+	if repo == nil {
+		repo = &api.Repository{Name: hook.Package.Name, FullName: owner + "/" + hook.Package.Name}
+	}
+
+	log.Printf("package %s %s/%s %s (%s)\n", hook.Action, owner, hook.Package.Name, hook.Package.Version, hook.Package.Type)
+
+	return &Delivery{
+		Secret:  hook.Secret,
+		Action:  hook.Action,
+		Repo:    repo,
+		Sender:  hook.Sender,
+		Package: hook.Package,
+		Env: []string{
+			"GITEA_PACKAGE_ACTION=" + hook.Action,
+			"GITEA_PACKAGE_OWNER=" + owner,
+			"GITEA_PACKAGE_NAME=" + hook.Package.Name,
+			"GITEA_PACKAGE_VERSION=" + hook.Package.Version,
+			"GITEA_PACKAGE_TYPE=" + hook.Package.Type,
+		},
+	}, nil
+}
+
+//minimalPushPayload holds the few fields of a push payload the daemon depends on
+type minimalPushPayload struct {
+	Secret string `json:"secret"`
+	Ref    string `json:"ref"`
+	After  string `json:"after"`
+	Repo   struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+//parseMinimalPushPayload extracts the essential fields of a push payload that the SDK types failed to decode
+func parseMinimalPushPayload(data []byte) (api.PushPayload, error) {
+	var minimal minimalPushPayload
+	if err := json.Unmarshal(data, &minimal); err != nil {
+		return api.PushPayload{}, err
+	}
+	if minimal.Repo.FullName == "" {
+		return api.PushPayload{}, errors.New("payload has no repository full_name")
+	}
+
+	return api.PushPayload{
+		Secret: minimal.Secret,
+		Ref:    minimal.Ref,
+		After:  minimal.After,
+		Repo:   &api.Repository{FullName: minimal.Repo.FullName},
+	}, nil
+}
+
+//pushTotalCommits returns the number of pushed commits reported by Gitea, which may exceed the delivered commit list
+func pushTotalCommits(data []byte, delivered int) int {
+	var counts struct {
+		TotalCommits *int `json:"total_commits"`
+	}
+	if json.Unmarshal(data, &counts) != nil || counts.TotalCommits == nil {
+		return delivered
+	}
+
+	return *counts.TotalCommits
+}
@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//Executor runs the action of a matched repository, like git-sync or docker
+type Executor interface {
+	//Execute runs the action for a delivery and returns the results of its steps, running the remaining
+	//steps is stopped once ctx is cancelled
+	Execute(ctx context.Context, d *Delivery, action Action) []Result
+}
+
+//ExecutorFunc is a function used as an Executor
+type ExecutorFunc func(ctx context.Context, d *Delivery, action Action) []Result
+
+//Execute calls f
+func (f ExecutorFunc) Execute(ctx context.Context, d *Delivery, action Action) []Result {
+	return f(ctx, d, action)
+}
+
+//Action is the action of a matched repository together with what its executor needs to run it
+type Action struct {
+	*ConfigAction
+	Repository ConfigRepository
+	Config     Config
+	//Env is the environment of the commands of the repository, with the GITEA_ variables of the delivery
+	Env []string
+	//Payload is the body of the delivery
+	Payload []byte
+	//runLog holds the output files of the commands of the job
+	runLog *runLog
+}
+
+//executors are the executors by action type, the built-in ones and those added with RegisterExecutor
+var executors = struct {
+	sync.RWMutex
+	byType map[string]Executor
+}{byType: map[string]Executor{
+	"git-sync": ExecutorFunc(gitSync),
+	"docker":   ExecutorFunc(dockerRun),
+}}
+
+//RegisterExecutor makes an executor available as the type of the action of repositories, it replaces
+//the executor of a built-in type of the same name. Executors have to be registered before the config
+//using them is read, which rejects unknown action types.
+func RegisterExecutor(actionType string, executor Executor) {
+	executors.Lock()
+	executors.byType[actionType] = executor
+	executors.Unlock()
+}
+
+//executorFor returns the executor of an action type
+func executorFor(actionType string) (Executor, bool) {
+	executors.RLock()
+	defer executors.RUnlock()
+	executor, ok := executors.byType[actionType]
+	return executor, ok
+}
+
+//RunCommand runs a program with its arguments like the commands of the repository, with their timeout,
+//sudo user, output handling and run log. It is meant for the steps of custom executors.
+func (a Action) RunCommand(ctx context.Context, d *Delivery, args ...string) Result {
+	if len(args) == 0 {
+		return startFailed(d, a.Type, fmt.Errorf("%s action of %s has no command", a.Type, d.Repo.FullName))
+	}
+	return a.runCommand(ctx, d, ConfigCommand{Command: strings.Join(args, " "), args: args})
+}
+
+//runCommand runs a step of the action like the commands of the repository, with its timeout,
+//sudo user, output handling and run log
+func (a Action) runCommand(ctx context.Context, d *Delivery, cmd ConfigCommand) Result {
+	return runCommand(ctx, a.Config, a.Repository, cmd, d, a.Payload, a.Env, a.runLog)
+}
+
+//runAction executes the action of the repository with the executor of its type
+func (j *job) runAction(ctx context.Context) []Result {
+	executor, ok := executorFor(j.action.Type)
+	if !ok {
+		err := fmt.Errorf("unknown action type %s", j.action.Type)
+		return []Result{startFailed(j.delivery, j.action.Type, err)}
+	}
+	action := Action{ConfigAction: j.action, Repository: j.repo, Config: j.config, Env: j.env, Payload: j.data, runLog: j.runLog}
+	return executor.Execute(ctx, j.delivery, action)
+}
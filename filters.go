@@ -0,0 +1,287 @@
+package webhook
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//headCommit returns the newest commit of a push, or nil
+func (d *Delivery) headCommit() *api.PayloadCommit {
+	if d.HeadCommit != nil {
+		return d.HeadCommit
+	}
+	//Gitea lists the newest commit first
+	if len(d.Commits) > 0 {
+		return d.Commits[0]
+	}
+	return nil
+}
+
+//matchesAny reports whether one of the regular expressions matches one of the values,
+//empty values are ignored
+func matchesAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if value == "" {
+				continue
+			}
+			match, err := regexp.MatchString(pattern, value)
+			if err != nil {
+				warnf("invalid pattern %s: %s\n", pattern, err)
+				continue
+			}
+			if match {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//skipReason returns why the filters of the repository exclude a delivery, or an empty string.
+//Deliveries without a pusher, a head commit or a pull request are not filtered by the respective filters.
+func (repo ConfigRepository) skipReason(d *Delivery) string {
+	if d.Pusher != nil {
+		pusher := []string{d.Pusher.UserName, d.Pusher.Email}
+		if len(repo.PushersAllow) > 0 && !matchesAny(repo.PushersAllow, pusher...) {
+			return "pusher not allowed"
+		}
+		if matchesAny(repo.PushersDeny, pusher...) {
+			return "pusher denied"
+		}
+	}
+
+	if commit := d.headCommit(); commit != nil {
+		if commit.Author != nil {
+			author := []string{commit.Author.UserName, commit.Author.Name, commit.Author.Email}
+			if len(repo.AuthorsAllow) > 0 && !matchesAny(repo.AuthorsAllow, author...) {
+				return "author not allowed"
+			}
+			if matchesAny(repo.AuthorsDeny, author...) {
+				return "author denied"
+			}
+		}
+		if repo.SkipCommitMessagePattern != "" && matchesAny([]string{repo.SkipCommitMessagePattern}, commit.Message) {
+			return "commit message"
+		}
+	}
+	if !repo.matchesPaths(d) {
+		return "no matching changed files"
+	}
+	if d.Release != nil && d.Release.IsPrerelease && repo.SkipPrereleases {
+		return "prerelease"
+	}
+	return repo.pullRequestSkipReason(d)
+}
+
+//matchesAction reports whether the action of the delivery is one of the actions of the repository,
+//"merged" matches pull requests that were closed by merging them
+func (repo ConfigRepository) matchesAction(d *Delivery) bool {
+	if len(repo.Actions) == 0 || d.Action == "" {
+		return true
+	}
+	for _, action := range repo.Actions {
+		if action == d.Action || action == "merged" && d.isMerged() || action == "closed" && d.Action == "merged" {
+			return true
+		}
+	}
+	return false
+}
+
+//pullRequestSkipReason returns why the pull request filters of the repository exclude a delivery,
+//deliveries without a pull request are only filtered by their action
+func (repo ConfigRepository) pullRequestSkipReason(d *Delivery) string {
+	if !repo.matchesAction(d) {
+		return "action " + d.Action
+	}
+
+	pr := d.PullRequest
+	if pr == nil {
+		return ""
+	}
+	if len(repo.BaseBranches) > 0 && (pr.Base == nil || !matchesAny(repo.BaseBranches, pr.Base.Ref)) {
+		return "target branch"
+	}
+	if len(repo.Labels) > 0 && !hasLabel(pr.Labels, repo.Labels) {
+		return "labels"
+	}
+	return ""
+}
+
+//hasLabel reports whether one of the labels has one of the names
+func hasLabel(labels []*api.Label, names []string) bool {
+	for _, label := range labels {
+		for _, name := range names {
+			if label != nil && strings.EqualFold(label.Name, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//changedFiles returns the files added, modified or removed by the commits of a push,
+//it reports false if they are not known because Gitea left commits out of the payload
+func (d *Delivery) changedFiles() ([]string, bool) {
+	if len(d.Commits) == 0 || d.TotalCommits > len(d.Commits) {
+		return nil, false
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	for _, commit := range d.Commits {
+		for _, list := range [][]string{commit.Added, commit.Modified, commit.Removed} {
+			for _, file := range list {
+				if !seen[file] {
+					seen[file] = true
+					files = append(files, file)
+				}
+			}
+		}
+	}
+	return files, true
+}
+
+//matchesPaths reports whether a file changed by the push matches pathsinclude and not pathsexclude,
+//pushes whose changed files are not known always match
+func (repo ConfigRepository) matchesPaths(d *Delivery) bool {
+	if len(repo.PathsInclude) == 0 && len(repo.PathsExclude) == 0 {
+		return true
+	}
+	files, ok := d.changedFiles()
+	if !ok {
+		return true
+	}
+
+	for _, file := range files {
+		if len(repo.PathsInclude) > 0 && !matchesGlob(repo.PathsInclude, file) {
+			continue
+		}
+		if matchesGlob(repo.PathsExclude, file) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+//matchesGlob reports whether a path matches one of the globs
+func matchesGlob(globs []string, file string) bool {
+	for _, glob := range globs {
+		pattern, err := globRegexp(glob)
+		if err != nil {
+			warnf("invalid glob %s: %s\n", glob, err)
+			continue
+		}
+		if pattern.MatchString(file) {
+			return true
+		}
+	}
+	return false
+}
+
+//globRegexp converts a glob to a regular expression: * matches within a directory, ** across
+//directories and ? a single character. A glob ending with / matches everything below the directory.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	if strings.HasSuffix(glob, "/") {
+		glob += "**"
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				//**/ also matches no directory at all
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					pattern.WriteString("(.*/)?")
+				} else {
+					pattern.WriteString(".*")
+				}
+			} else {
+				pattern.WriteString("[^/]*")
+			}
+		case '?':
+			pattern.WriteString("[^/]")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	pattern.WriteString("$")
+	return regexp.Compile(pattern.String())
+}
+
+//matchComment applies the commentpattern and commentersallow settings of the repository to issue
+//and comment deliveries. It returns the delivery with the capture groups of the pattern, or why the
+//delivery does not match.
+func (repo ConfigRepository) matchComment(d *Delivery) (*Delivery, string) {
+	if d.Comment == nil && d.Issue == nil {
+		if repo.CommentPattern != "" {
+			return nil, "not a comment"
+		}
+		return d, ""
+	}
+
+	if len(repo.CommentersAllow) > 0 && (d.Sender == nil || !matchesAny(repo.CommentersAllow, d.Sender.UserName)) {
+		return nil, "commenter not allowed"
+	}
+	if repo.CommentPattern == "" {
+		return d, ""
+	}
+
+	body := ""
+	if d.Comment != nil {
+		body = d.Comment.Body
+	} else {
+		body = d.Issue.Body
+	}
+	pattern, err := regexp.Compile(repo.CommentPattern)
+	if err != nil {
+		warnf("invalid commentpattern %s: %s\n", repo.CommentPattern, err)
+		return nil, "invalid comment pattern"
+	}
+	//comments usually end with a newline, which would keep ^...$ patterns from matching
+	groups := pattern.FindStringSubmatch(strings.TrimSpace(body))
+	if groups == nil {
+		return nil, "comment does not match"
+	}
+
+	//the delivery is shared with the other repositories, the match belongs to this one only
+	matched := *d
+	matched.Match = groups
+	matched.Groups = make(map[string]string)
+	for i, name := range pattern.SubexpNames() {
+		if name != "" {
+			matched.Groups[name] = groups[i]
+		}
+	}
+	return &matched, ""
+}
+
+//matchEnvironment returns the environment variables with the capture groups of the comment pattern
+//and of the name of the repository
+func (d *Delivery) matchEnvironment() []string {
+	var env []string
+	for i, group := range d.Match {
+		env = append(env, "GITEA_MATCH_"+strconv.Itoa(i)+"="+group)
+	}
+	for name, group := range d.Groups {
+		env = append(env, "GITEA_MATCH_"+strings.ToUpper(name)+"="+group)
+	}
+	for i, group := range d.RepoMatch {
+		env = append(env, "GITEA_REPO_MATCH_"+strconv.Itoa(i)+"="+group)
+	}
+	for name, group := range d.RepoGroups {
+		env = append(env, "GITEA_REPO_MATCH_"+strings.ToUpper(name)+"="+group)
+	}
+	for name, value := range d.Vars {
+		env = append(env, "GITEA_VAR_"+strings.ToUpper(name)+"="+value)
+	}
+	return env
+}
@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//ForwardTarget represents a downstream endpoint deliveries of a repository are forwarded to
+type ForwardTarget struct {
+	URL string
+	//Secret re-signs the forwarded body, otherwise the original signature headers are kept
+	Secret  string
+	Gzip    bool
+	Timeout int64
+	MaxSize int64
+	//Retries is the number of times a failed forward is retried, waiting Backoff seconds
+	//before the first retry and twice as long before every following one
+	Retries int
+	Backoff int64
+}
+
+//defaultForwardTimeout is the time in seconds a forward may take when not configured
+const defaultForwardTimeout = 10
+
+//defaultForwardBackoff is the time before the first retry of a forward when not configured
+const defaultForwardBackoff = 1 * time.Second
+
+//permanentError is a forward failure that retrying will not fix
+type permanentError struct {
+	error
+}
+
+//forwardAll forwards a delivery to all targets at the same time, so a slow or failing target
+//does not hold back the others
+func forwardAll(ctx context.Context, config Config, targets []ForwardTarget, d *Delivery, data []byte) {
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target ForwardTarget) {
+			defer wg.Done()
+			err := forwardWithRetries(ctx, config, target, d, data)
+			if err != nil {
+				d.errorf("failed to forward %s of %s to %s: %s\n", d.Event, d.Repo.FullName, target.URL, err)
+			} else {
+				d.logf("forwarded %s of %s to %s\n", d.Event, d.Repo.FullName, target.URL)
+			}
+		}(target)
+	}
+	wg.Wait()
+}
+
+//forwardWithRetries forwards a delivery and retries failures with an exponential backoff,
+//client errors of the target are not retried
+func forwardWithRetries(ctx context.Context, config Config, target ForwardTarget, d *Delivery, data []byte) error {
+	backoff := time.Duration(target.Backoff) * time.Second
+	if backoff <= 0 {
+		backoff = defaultForwardBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := forwardDelivery(config, target, d, data)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(permanentError); ok || attempt >= target.Retries {
+			return err
+		}
+
+		d.warnf("forward to %s failed: %s, retrying in %s (%d of %d)\n", target.URL, err, backoff, attempt+1, target.Retries)
+		if !waitBackoff(ctx, backoff) {
+			return fmt.Errorf("%s, not retrying: %s", err, ctx.Err())
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+//forwardDelivery sends the original headers and body of a delivery to a forward target
+func forwardDelivery(config Config, target ForwardTarget, d *Delivery, data []byte) error {
+	body := data
+	if target.Gzip {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		_, err := writer.Write(data)
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			return permanentError{err}
+		}
+		body = compressed.Bytes()
+		debugf(config, "forward to %s: %d bytes compressed to %d (%.0f%%)", target.URL, len(data), len(body), 100*float64(len(body))/float64(len(data)))
+	} else {
+		debugf(config, "forward to %s: %d bytes", target.URL, len(body))
+	}
+
+	if target.MaxSize > 0 && int64(len(body)) > target.MaxSize {
+		return permanentError{fmt.Errorf("forward body of %d bytes exceeds the maxsize of %s", len(body), target.URL)}
+	}
+
+	request, err := http.NewRequest(http.MethodPost, target.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+
+	for name, values := range d.Header {
+		canonical := http.CanonicalHeaderKey(name)
+		if canonical == "Content-Type" || isProviderHeader(canonical) {
+			request.Header[canonical] = values
+		}
+	}
+	if target.Gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	if target.Secret != "" {
+		signature := signPayload(target.Secret, body)
+		request.Header.Set("X-Gitea-Signature", signature)
+		request.Header.Set("X-Gogs-Signature", signature)
+	}
+
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = defaultForwardTimeout
+	}
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode/100 != 2 {
+		err = fmt.Errorf("forward to %s returned %s", target.URL, response.Status)
+		//the target rejected the delivery itself, except for rate limiting
+		if response.StatusCode/100 == 4 && response.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//ConfigAction represents a built-in action of a repository that runs before its commands
+type ConfigAction struct {
+	//Type is the kind of action, "git-sync", "docker" or the type of a registered executor
+	Type string
+
+	//Path is the directory the repository is cloned to and pulled in
+	Path string
+	//Branch is the branch to check out, the pushed branch by default
+	Branch string
+	//URL is the clone URL, the clone_url of the payload by default
+	URL        string
+	Submodules bool
+
+	//Image is the image the Command of a docker action runs in, with the Volumes, the Env
+	//variables (KEY=VALUE), the Network and the WorkDir inside the container
+	Image   string
+	Command string
+	Volumes []string
+	Env     []string
+	Network string
+	WorkDir string
+	//Pull pulls the image before every run instead of using a local copy
+	Pull bool
+
+	//Options are the settings of the actions of executors registered with RegisterExecutor
+	Options map[string]string
+}
+
+//gitSync clones the repository if the path does not exist yet and fast-forwards it otherwise
+func gitSync(ctx context.Context, d *Delivery, action Action) []Result {
+	branch := action.Branch
+	if branch == "" {
+		branch = d.Branch()
+	}
+	url := action.URL
+	if url == "" {
+		url = d.Repo.CloneURL
+	}
+
+	if action.Path == "" {
+		return []Result{startFailed(d, "git-sync", fmt.Errorf("git-sync of %s has no path", d.Repo.FullName))}
+	}
+	//the path may hold the capture groups of the name of the repository
+	dir := action.Path
+	if isTemplate(dir) {
+		var err error
+		dir, err = expandTemplate(action.Path, d)
+		if err != nil {
+			return []Result{startFailed(d, "git-sync", fmt.Errorf("invalid path template %s: %s", action.Path, err))}
+		}
+	}
+	//a tenant only syncs within its command directory, also when the path comes from a template
+	dir, err := tenantCommand(action.Config.tenant(action.Repository), dir)
+	if err != nil {
+		return []Result{startFailed(d, "git-sync", err)}
+	}
+
+	var steps [][]string
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		clone := []string{"git", "clone"}
+		if branch != "" {
+			clone = append(clone, "--branch", branch)
+		}
+		if action.Submodules {
+			clone = append(clone, "--recurse-submodules")
+		}
+		if url == "" {
+			return []Result{startFailed(d, "git-sync", fmt.Errorf("git-sync of %s has no url to clone", d.Repo.FullName))}
+		}
+		steps = append(steps, append(clone, "--", url, dir))
+	} else if branch != "" {
+		steps = append(steps,
+			[]string{"git", "-C", dir, "fetch", "origin", branch},
+			[]string{"git", "-C", dir, "checkout", branch},
+			[]string{"git", "-C", dir, "merge", "--ff-only", "FETCH_HEAD"})
+	} else {
+		steps = append(steps, []string{"git", "-C", dir, "pull", "--ff-only"})
+	}
+	if action.Submodules && len(steps) > 1 {
+		steps = append(steps, []string{"git", "-C", dir, "submodule", "update", "--init", "--recursive"})
+	}
+
+	var results []Result
+	for _, args := range steps {
+		result := action.runCommand(ctx, d, ConfigCommand{Command: strings.Join(args, " "), args: args})
+		results = append(results, result)
+		if result.Err != nil {
+			break
+		}
+	}
+	return results
+}
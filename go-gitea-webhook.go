@@ -2,175 +2,1045 @@
 // Gitea SDK: https://godoc.org/code.gitea.io/sdk/gitea
 // Gitea webhooks: https://docs.gitea.io/en-us/webhooks
 
-package main
+//Package webhook runs commands for the webhook deliveries of Gitea and other forges,
+//cmd/go-gitea-webhook is the daemon built on it
+package webhook
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	b64 "encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
+	"path"
+	"path/filepath"
 	"regexp"
+	"runtime/debug"
 	"strconv"
-	"syscall"
+	"strings"
+	"sync"
+	"time"
 
 	api "code.gitea.io/sdk/gitea"
+	toml "github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
 )
 
 //ConfigRepository represents a repository from the config file
 type ConfigRepository struct {
-	Secret   string
-	Name     string
-	Commands []string
+	Secret string
+	//SecretFile and SecretEnv read the secret from a file, like a mounted Docker or Kubernetes
+	//secret, or from an environment variable instead
+	SecretFile string
+	SecretEnv  string
+	//TriggerToken is the bearer token that runs the commands from POST /trigger/<owner>/<repo>
+	TriggerToken string
+	Name         string
+	//Path is the URL path the deliveries for the repository are sent to, see servesPath
+	Path string
+	//RepoFromPath serves the repository at the path of the Gitea repository, /<owner>/<name>, instead
+	//of a Path, and rejects deliveries for it that were sent to the path of another one
+	RepoFromPath bool
+	Commands     []ConfigCommand
+	Events       []string
+	//Refs holds regular expressions of which one has to match the full ref of the delivery
+	Refs []string
+	//PushersAllow and PushersDeny are regular expressions matched against the user name and email of the pusher,
+	//AuthorsAllow and AuthorsDeny against the user name, name and email of the author of the head commit
+	PushersAllow []string
+	PushersDeny  []string
+	AuthorsAllow []string
+	AuthorsDeny  []string
+	//SkipCommitMessagePattern skips deliveries whose head commit message matches it
+	SkipCommitMessagePattern string
+	//SkipToken skips pushes whose commit messages contain it, like [skip deploy]; SkipCommits is
+	//which commits are checked, "head" (default), "all" or "none". They override the ones of the config.
+	SkipToken   string
+	SkipCommits string
+	//PathsInclude and PathsExclude are globs the files changed by a push are matched against
+	PathsInclude []string
+	PathsExclude []string
+	//Actions restricts the deliveries to these actions, BaseBranches (regular expressions) and Labels
+	//restrict pull requests to the ones targeting a matching branch and having one of the labels
+	Actions      []string
+	BaseBranches []string
+	Labels       []string
+	//SkipPrereleases ignores releases marked as prerelease
+	SkipPrereleases bool
+	//CommentPattern is a regular expression the comment (or the issue) has to match, its capture groups
+	//are passed to the commands; CommentersAllow restricts comments and issues to matching user names
+	CommentPattern  string
+	CommentersAllow []string
+	Timeout         int64
+	//Retries is the number of times a failed command is retried, waiting RetryBackoff seconds
+	//before the first retry and twice as long before every following one
+	Retries      int
+	RetryBackoff int64
+	RateLimit    float64
+	RateBurst    int
+	//Debounce is the number of seconds without deliveries after which only the latest one runs
+	Debounce int64
+	SudoUser string
+	//Action is a built-in action that runs before the commands
+	Action *ConfigAction
+	//CommitStatus reports the results as a commit status in Gitea, in StatusContext and linking to StatusURL
+	CommitStatus  bool
+	StatusContext string
+	StatusURL     string
+	//CommentOutput comments the output of the commands on the pull request, at most CommentOutputSize
+	//bytes of every command
+	CommentOutput     bool
+	CommentOutputSize int
+	//Concurrency is how jobs of the repository that overlap are handled, see deployLocks
+	Concurrency string
+	//DryRun logs the commands that would run instead of running them
+	DryRun bool
+	//Policy is "stop" to skip the remaining commands after a failure, or "continue" (default)
+	Policy string
+	//OnSuccess and OnFailure are run after the commands when all of them succeeded or one failed
+	OnSuccess []ConfigCommand
+	OnFailure []ConfigCommand
+	//WorkDir is the working directory of the commands, the one of the daemon by default
+	WorkDir string
+	//RunAs is the user the commands run as, as a user name or uid[:gid]
+	RunAs string
+	//EventCommands maps event names to the commands run for them instead of Commands
+	EventCommands map[string][]ConfigCommand
+	Forward       []ForwardTarget
+	//Publish lists the message queues the deliveries are published to, for workers on other machines
+	Publish []ConfigPublish
+	//Notify lists where failures and recoveries of the commands are reported
+	Notify       []ConfigNotification
+	Schedule     []string
+	ScheduleMode string
+	//TriggersRepos lists the repositories (owner/name) whose jobs run after the commands succeeded
+	TriggersRepos []string
+	//OnRestart is what happens to the jobs a restart interrupted, "interrupt" (default) reports
+	//them as failed and "resume" runs them again
+	OnRestart string
+	//AllowShell lets the commands run a shell, which the execution policy refuses because payload data
+	//in its arguments would be run as a script
+	AllowShell bool
+	//Env and EnvFiles add variables to the environment of the commands, like the credentials of a
+	//registry, the files hold NAME=value lines and are read whenever a command runs
+	Env      map[string]string
+	EnvFiles []string
+	//Script is a Starlark script run for every delivery the repository matches, which can set
+	//template variables, skip the delivery or pick one of the CommandSets; ScriptFile reads it from a file
+	Script      string
+	ScriptFile  string
+	CommandSets map[string][]ConfigCommand
+	//Class is the name of the jobclasses entry of the jobs of the repository
+	Class string
+	//Limits are the resources the commands of the repository may use, they override those of the config
+	Limits ConfigLimits
+
+	//tenant is the name of the tenant the repository belongs to, see expandTenants
+	tenant string
+}
+
+//matchesRef reports whether the repository handles deliveries for a ref,
+//deliveries without a ref (like issues) are not filtered
+func (repo ConfigRepository) matchesRef(ref string) bool {
+	if len(repo.Refs) == 0 || ref == "" {
+		return true
+	}
+	for _, pattern := range repo.Refs {
+		match, err := regexp.MatchString(pattern, ref)
+		if err != nil {
+			warnf("invalid refs pattern %s for repo %s: %s\n", pattern, repo.Name, err)
+			continue
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+//servesPath reports whether the repository handles deliveries sent to a URL path. Once any repository
+//of the config has a path, repositories without one only handle deliveries sent to /. A repository
+//with RepoFromPath handles the paths of the Gitea repositories its name matches.
+func (repo ConfigRepository) servesPath(config Config, urlPath string) bool {
+	if !config.routesPaths() {
+		return true
+	}
+	if repo.RepoFromPath {
+		match, err := regexp.MatchString(repo.Name, pathRepo(urlPath))
+		return err == nil && match
+	}
+	repoPath := repo.Path
+	if repoPath == "" {
+		repoPath = "/"
+	}
+	return path.Clean(repoPath) == path.Clean(urlPath)
+}
+
+//pathRepo returns the full name of the Gitea repository a URL path is named after, for repofrompath
+func pathRepo(urlPath string) string {
+	return strings.Trim(path.Clean(urlPath), "/")
+}
+
+//rejectsPath reports whether the repository has RepoFromPath and serves a URL path that a delivery
+//for another Gitea repository was sent to, like by a webhook copied to the wrong repository
+func (repo ConfigRepository) rejectsPath(config Config, fullName string, urlPath string) bool {
+	return repo.RepoFromPath && repo.servesPath(config, urlPath) && !strings.EqualFold(pathRepo(urlPath), fullName)
+}
+
+//servesPath reports whether any repository handles deliveries sent to a URL path
+func (config Config) servesPath(urlPath string) bool {
+	for _, repo := range config.Repositories {
+		if repo.servesPath(config, urlPath) {
+			return true
+		}
+	}
+	return false
+}
+
+//routesPaths reports whether deliveries are routed to the repositories by their path
+func (config Config) routesPaths() bool {
+	for _, repo := range config.Repositories {
+		if repo.Path != "" || repo.RepoFromPath {
+			return true
+		}
+	}
+	return false
+}
+
+//commandsFor returns the commands of the repository for a delivery
+func (repo ConfigRepository) commandsFor(d *Delivery) []ConfigCommand {
+	for _, event := range d.refEvents() {
+		if commands, ok := repo.EventCommands[event]; ok {
+			return commands
+		}
+	}
+	if commands, ok := repo.EventCommands[d.Event]; ok {
+		return commands
+	}
+
+	if d.matchesEvent(repo.events()) {
+		return repo.Commands
+	}
+	return nil
+}
+
+//events returns the events that trigger the commands and the action of the repository
+func (repo ConfigRepository) events() []string {
+	if len(repo.Events) == 0 {
+		return []string{"push"}
+	}
+	return repo.Events
+}
+
+//actionFor returns the built-in action of the repository for a delivery, if any
+func (repo ConfigRepository) actionFor(d *Delivery) *ConfigAction {
+	if repo.Action != nil && d.matchesEvent(repo.events()) {
+		return repo.Action
+	}
+	return nil
+}
+
+//RefEnvironment maps the refs matching Pattern to an environment name
+type RefEnvironment struct {
+	Pattern     string
+	Environment string
 }
 
 //Config represents the config file
 type Config struct {
-	Logfile      string
-	Address      string
-	Port         int64
-	Repositories []ConfigRepository
+	Logfile string
+	//LogTarget writes the log to stdout or stderr instead of the logfile, for container deployments
+	LogTarget string
+	LogFormat string
+	//LogLevel is the minimum level of the lines written to the log: debug, info, warn or error
+	LogLevel string
+	//LogMaxSize is the size in megabytes at which the logfile is rotated, at most LogMaxBackups
+	//rotated files that are at most LogMaxAge days old are kept
+	LogMaxSize    int64
+	LogMaxBackups int
+	LogMaxAge     int64
+	Address       string
+	//AllowedIPs restricts deliveries to clients from these CIDRs, TrustedProxies are the proxies
+	//whose X-Forwarded-For header is used to find the client
+	AllowedIPs        []string
+	TrustedProxies    []string
+	BasicAuthUser     string
+	BasicAuthPassword string
+	//SocketMode holds the octal permissions of the socket if Address is unix:/path
+	SocketMode  string
+	Port        int64
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	//Listeners replace the address, port and TLS settings with several addresses, like one for
+	//webhooks and one for the admin API
+	Listeners        []ConfigListener
+	Strict           bool
+	ShutdownCommands []string
+	ShutdownTimeout  int64
+	DrainTimeout     int64
+	AdminAPI         bool
+	AdminToken       string
+	GiteaURL         string
+	GiteaToken       string
+	Metrics          bool
+	HistorySize      int
+	//DedupSize is the number of delivery IDs remembered to skip redeliveries, DisableDedup runs
+	//redeliveries again
+	DedupSize          int
+	DisableDedup       bool
+	Health             bool
+	RefEnvMap          []RefEnvironment
+	DefaultEnvironment string
+	//SkipToken and SkipCommits apply to the repositories without their own, see ConfigRepository
+	SkipToken          string
+	SkipCommits        string
+	SudoCommands       []string
+	Base64ContentTypes []string
+	Base64Header       string
+	//MaxBodySize is the size in bytes a request body may have, before and after base64 decoding
+	MaxBodySize   int64
+	CommandOutput []string
+	//RunLogDir is the directory the output of every command is written to, see runLog
+	RunLogDir          string
+	RunLogKeep         int
+	RunLogMaxAge       int64
+	LockFile           string
+	LockWait           bool
+	CommandTimeout     int64
+	StartupQuietPeriod int64
+	AbortOnStartError  bool
+	StatusFile         string
+	StatusFormat       string
+	Workers            int
+	QueueSize          int
+	WatchConfig        bool
+	Debug              bool
+	Repositories       []ConfigRepository
+	//Include lists globs of files with more repositories, like conf.d/*.json next to the config file
+	Include []string
+	//Schedules run commands periodically instead of on deliveries
+	Schedules []ConfigSchedule
+	//JobStateFile keeps the queued and running jobs, for the onrestart setting of the repositories
+	JobStateFile string
+	//Tracing exports spans of the processing of deliveries and their commands to OpenTelemetry
+	Tracing *ConfigTracing
+	//Synchronous answers deliveries once their commands are done instead of when they are queued,
+	//like ?wait on a single request, for at most WaitTimeout seconds (30 by default)
+	Synchronous bool
+	WaitTimeout int64
+	//ResponseOutputSize is the number of bytes of the end of the output of every command included in
+	//the response of a synchronous delivery, none by default
+	ResponseOutputSize int
+	//Tenants are teams with repositories of their own below a URL path of their own
+	Tenants []ConfigTenant
+	//CommandDirs are the directories the commands have to be in, relative commands are looked up in
+	//them instead of the PATH; any command may run when empty
+	CommandDirs []string
+	//HookURL is the URL Gitea reaches the daemon at, like https://deploy.example.com, for registering
+	//the webhooks of the repositories with -register
+	HookURL string
+	//JobClasses order the queued jobs by priority and limit how many jobs of a class run at once
+	JobClasses []ConfigJobClass
+	//Database is where every delivery and the results of its commands are written to
+	Database *ConfigDatabase
+	//BasePath is the URL path the daemon is mounted at behind a reverse proxy, like /hooks/; it is
+	//removed from the paths of the requests before they are routed
+	BasePath string
+	//Limits are the resources every command may use, see ConfigLimits
+	Limits ConfigLimits
 }
 
-func check(err error, what ...string) {
-	if err != nil {
-		if len(what) == 0 {
-			log.Fatal(err)
+//defaultShutdownTimeout is the time in seconds the shutdown commands may take when not configured
+const defaultShutdownTimeout = 30
+
+//defaultMaxBodySize is the size of request bodies accepted when maxbodysize is not set, GitHub
+//caps its payloads at 25 MB
+const defaultMaxBodySize = 25 << 20
+
+//resolveEnvironment returns the environment of the first mapping whose pattern matches ref
+func resolveEnvironment(config Config, ref string) string {
+	for _, mapping := range config.RefEnvMap {
+		match, err := regexp.MatchString(mapping.Pattern, ref)
+		if err != nil {
+			warnf("invalid refenvmap pattern %s: %s\n", mapping.Pattern, err)
+			continue
+		}
+		if match {
+			return mapping.Environment
+		}
+	}
+
+	return config.DefaultEnvironment
+}
+
+//skipToken returns the skip token of the repository and which commits are checked for it, the
+//settings of the repository win over the ones of the config
+func (repo ConfigRepository) skipToken(config Config) (token string, commits string) {
+	return orDefault(repo.SkipToken, config.SkipToken), orDefault(orDefault(repo.SkipCommits, config.SkipCommits), "head")
+}
+
+//hasSkipToken reports whether the checked commit messages of a push contain the skip token, there is
+//none unless configured
+func hasSkipToken(token string, which string, d *Delivery) bool {
+	if token == "" || d.Event != "push" {
+		return false
+	}
+
+	var commits []*api.PayloadCommit
+	switch which {
+	case "head":
+		if commit := d.headCommit(); commit != nil {
+			commits = append(commits, commit)
+		}
+	case "all":
+		commits = d.Commits
+	}
+
+	for _, commit := range commits {
+		if commit != nil && strings.Contains(commit.Message, token) {
+			return true
 		}
+	}
 
-		log.Fatal(errors.New(err.Error() + (" " + what[0])))
+	return false
+}
+
+//debugf logs a message only when debug logging is enabled
+func debugf(config Config, format string, v ...interface{}) {
+	if configLogLevel(config) == "debug" {
+		log.Printf("debug: "+format, v...)
 	}
 }
 
 var config Config
 var configFile string
+var configMutex sync.RWMutex
+
+//reloads serializes config reloads
+var reloads struct {
+	sync.Mutex
+	running bool
+	pending bool
+}
 
-func main() {
-	args := os.Args
+//currentConfig returns the active config
+func currentConfig() Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config
+}
 
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGHUP)
+//listen opens the listening socket, a TCP address or unix:/path for a UNIX domain socket
+//with the permissions of socketmode
+func listen(config Config, address string) (net.Listener, error) {
+	socket := strings.TrimPrefix(address, "unix:")
+	if socket == address {
+		return net.Listen("tcp", address)
+	}
 
-	go func() {
-		<-sigc
-		config = loadConfig(configFile)
-		log.Println("config reloaded")
-	}()
+	//a socket left behind by a crash would make listening fail
+	if info, err := os.Lstat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(socket)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if config.SocketMode != "" {
+		mode, _ := strconv.ParseUint(config.SocketMode, 8, 32)
+		err = os.Chmod(socket, os.FileMode(mode))
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
 
-	//if we have a "real" argument we take this as conf path to the config file
-	if len(args) > 1 {
-		configFile = args[1]
-	} else {
-		configFile = "config.json"
+//runShutdownCommands executes the configured shutdown commands within the shutdown timeout
+func runShutdownCommands(config Config) {
+	if len(config.ShutdownCommands) == 0 {
+		return
 	}
 
-	//load config
-	config = loadConfig(configFile)
+	timeout := config.ShutdownTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
 
-	//open log file
-	writer, err := os.OpenFile(config.Logfile, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
-	check(err)
+	for _, cmd := range config.ShutdownCommands {
+		out, err := exec.CommandContext(ctx, cmd).CombinedOutput()
+		if ctx.Err() != nil {
+			warnf("shutdown command %s did not finish within %ds\n", cmd, timeout)
+			return
+		}
+		if err != nil {
+			errorf("shutdown command %s failed: %s\n", cmd, err)
+		} else {
+			log.Println("Executed: " + cmd)
+		}
+		writeCommandOutput(config, "shutdown", cmd, out)
+	}
+}
 
-	//close logfile on exit
-	defer func() {
-		writer.Close()
-	}()
+//reloadConfig loads the config file again and replaces the active config,
+//a reload requested while another one is running is coalesced into a single extra reload
+func reloadConfig() {
+	reloads.Lock()
+	if reloads.running {
+		reloads.pending = true
+		reloads.Unlock()
+		log.Println("config reload already in progress, coalescing")
+		return
+	}
+	reloads.running = true
+	reloads.Unlock()
 
-	//setting logging output
-	log.SetOutput(writer)
+	sdNotify("RELOADING=1")
+	defer sdNotify("READY=1")
 
-	//setting handler
-	http.HandleFunc("/", hookHandler)
+	for {
+		//keep serving with the old config if the new one is broken
+		newConfig, err := ReadConfig(configFile)
+		if err != nil {
+			errorf("not reloading invalid config file %s: %s\n", configFile, err)
+		} else {
+			configMutex.Lock()
+			config = newConfig
+			configMutex.Unlock()
 
-	address := config.Address + ":" + strconv.FormatInt(config.Port, 10)
+			state.mutex.Lock()
+			state.reloaded = time.Now()
+			state.mutex.Unlock()
 
-	log.Println("Listening on " + address)
+			log.Println("config reloaded")
+		}
 
-	//starting server
-	err = http.ListenAndServe(address, nil)
+		reloads.Lock()
+		if !reloads.pending {
+			reloads.running = false
+			reloads.Unlock()
+			return
+		}
+		reloads.pending = false
+		reloads.Unlock()
+
+		log.Println("reloading config again for coalesced requests")
+	}
+}
+
+//ReadConfig reads a config file and the files it includes, validates it and applies the defaults
+func ReadConfig(configFile string) (Config, error) {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var config Config
+	err = decodeConfig(data, configFormat(configFile), &config)
 	if err != nil {
-		log.Println(err)
+		return Config{}, err
 	}
+	err = readIncludes(configFile, &config)
+	if err != nil {
+		return Config{}, err
+	}
+	return prepareConfig(config)
 }
 
-func loadConfig(configFile string) Config {
-	var file, err = os.Open(configFile)
-	check(err)
+//prepareConfig reads the secrets, validates a config and applies the defaults
+func prepareConfig(config Config) (Config, error) {
+	config, err := resolveSecrets(expandTenants(config))
+	if err != nil {
+		return Config{}, err
+	}
+	err = validateConfig(config)
+	if err != nil {
+		return Config{}, err
+	}
 
-	// close file on exit and check for its returned error
-	defer func() {
-		check(file.Close())
-	}()
+	if config.StatusFormat == "" {
+		config.StatusFormat = "json"
+	}
+	//with run logs the output does not need to go to the shared log as well
+	if len(config.CommandOutput) == 0 && config.RunLogDir == "" {
+		config.CommandOutput = []string{"log"}
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if config.Workers <= 0 {
+		config.Workers = defaultWorkers
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
+	}
+	if config.MaxBodySize == 0 {
+		config.MaxBodySize = defaultMaxBodySize
+	}
+	if config.DedupSize == 0 {
+		config.DedupSize = defaultDedupSize
+	}
+
+	return config, nil
+}
+
+//configFormat returns the format of a config file from its extension, JSON by default
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "json"
+}
 
-	buffer := make([]byte, 1024)
+//decodeConfig decodes a JSON, YAML or TOML config. YAML and TOML are converted to JSON first,
+//so the keys and the forms of the values are exactly the same in every format.
+func decodeConfig(data []byte, format string, config interface{}) error {
+	var value interface{}
+	switch format {
+	case "json":
+		if !bytes.Contains(data, []byte("${")) {
+			return jsonErrorPosition(data, json.Unmarshal(data, config))
+		}
+		//keep the numbers as they are when encoding the expanded config again
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err := decoder.Decode(&value)
+		if err != nil {
+			return jsonErrorPosition(data, err)
+		}
+	case "yaml":
+		err := yaml.Unmarshal(data, &value)
+		if err != nil {
+			return err
+		}
+		value = yamlToJSON(value)
+	case "toml":
+		var table map[string]interface{}
+		_, err := toml.Decode(string(data), &table)
+		if err != nil {
+			return err
+		}
+		value = table
+	default:
+		return fmt.Errorf("unknown config format %s", format)
+	}
 
-	count, err := file.Read(buffer)
-	check(err)
+	value, err := expandConfigValue(value)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, config)
+}
 
-	err = json.Unmarshal(buffer[:count], &config)
-	check(err)
+//jsonErrorPosition adds the line and column to errors of the JSON decoder, which only report the offset
+func jsonErrorPosition(data []byte, err error) error {
+	var offset int64
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		offset = err.Offset
+	case *json.UnmarshalTypeError:
+		offset = err.Offset
+	default:
+		return err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
 
-	return config
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(data[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %s", line, column, err)
+}
+
+//yamlToJSON converts the maps decoded by yaml to maps with string keys that can be encoded as JSON
+func yamlToJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			converted[fmt.Sprint(key)] = yamlToJSON(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range value {
+			value[i] = yamlToJSON(item)
+		}
+	}
+	return value
+}
+
+//WriteConfig encodes the config as JSON or YAML
+func WriteConfig(w io.Writer, config Config, format string) error {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(config, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	case "yaml":
+		data, err := yaml.Marshal(config)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	return fmt.Errorf("unknown config format %s", format)
+}
+
+//deliveryID returns the unique ID the provider assigned to the delivery
+func deliveryID(r *http.Request) string {
+	for _, name := range []string{"X-Gitea-Delivery", "X-Gogs-Delivery", "X-GitHub-Delivery", "X-Gitlab-Event-UUID"} {
+		if id := r.Header.Get(name); len(id) != 0 {
+			return id
+		}
+	}
+	return ""
+}
+
+//isJSONBody reports whether the content type of a request is JSON, or one of the base64 content types.
+//Requests without a content type are accepted as well.
+func isJSONBody(config Config, r *http.Request) bool {
+	if r.Header.Get("Content-Type") == "" || isBase64Body(config, r) {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+//isBase64Body reports whether the config marks the request body as base64 encoded
+func isBase64Body(config Config, r *http.Request) bool {
+	if config.Base64Header != "" && strings.EqualFold(r.Header.Get(config.Base64Header), "base64") {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	for _, contentType := range config.Base64ContentTypes {
+		if strings.EqualFold(contentType, mediaType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//payloadFingerprint returns a short SHA256 of the raw body to correlate a delivery with a captured payload
+func payloadFingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
 }
 
 func hookHandler(w http.ResponseWriter, r *http.Request) {
+	//use the same config for the whole delivery even if it gets reloaded meanwhile
+	config := currentConfig()
+
+	//a bug triggered by one delivery must not take the daemon down
 	defer func() {
-		if r := recover(); r != nil {
-			log.Println(r)
+		if recovered := recover(); recovered != nil {
+			errorf("panic while handling a delivery: %v\n%s", recovered, debug.Stack())
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
 		}
 	}()
 
-	//get the hook event from the headers
-	event := r.Header.Get("X-Gogs-Event")
-	if len(event) == 0 {
-		event = r.Header.Get("X-Gitea-Event")
+	//replays were authorized by the admin API already
+	if !isReplay(r) && !checkAccess(accessConfig(config, r), w, r) {
+		return
+	}
+
+	//webhooks are always posted
+	if r.Method != http.MethodPost {
+		log.Printf("rejected %s request for %s\n", r.Method, r.URL.Path)
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	//reject deliveries to unknown paths before reading them
+	if config.routesPaths() && !config.servesPath(r.URL.Path) {
+		log.Printf("received a request for unknown path %s\n", r.URL.Path)
+		writeJSONError(w, http.StatusNotFound, "no repository for path")
+		return
+	}
+
+	//get the hook event from the headers, which also tell the provider that sent it
+	provider, event := detectProvider(r.Header)
+	if provider == nil {
+		log.Println("received a request without an event header")
+		writeJSONError(w, http.StatusBadRequest, "unsupported event")
+		return
+	}
+	if !provider.supports(event) {
+		warnf("received unknown %s event \"%s\"\n", provider.name, event)
+		writeJSONError(w, http.StatusBadRequest, "unsupported event")
+		return
+	}
+
+	if !isJSONBody(config, r) {
+		warnf("rejected request with content type %s\n", r.Header.Get("Content-Type"))
+		writeJSONError(w, http.StatusUnsupportedMediaType, "unsupported content type")
+		return
 	}
 
-	//only push events are current supported
-	if event != "push" {
-		log.Printf("received unknown event \"%s\"\n", event)
+	//read request body, a client streaming a huge body must not exhaust the memory
+	var data, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, config.MaxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			warnf("request body exceeds maxbodysize of %d bytes\n", config.MaxBodySize)
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		warnf("failed to read request body: %s\n", err)
+		writeJSONError(w, http.StatusBadRequest, "failed to read request body")
 		return
 	}
+	//the signature is computed over the body as it was sent
+	body := data
 
-	//read request body
-	var data, err = ioutil.ReadAll(r.Body)
-	check(err, "while reading request body")
+	//some proxies deliver the payload base64 encoded
+	if isBase64Body(config, r) {
+		data, err = b64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			warnf("invalid base64 request body: %s\n", err)
+			writeJSONError(w, http.StatusBadRequest, "invalid base64 body")
+			return
+		}
+		if int64(len(data)) > config.MaxBodySize {
+			warnf("decoded request body of %d bytes exceeds maxbodysize\n", len(data))
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+	}
 
 	//unmarshal request body
-	var hook api.PushPayload
-	err = json.Unmarshal(data, &hook)
-	check(err, fmt.Sprintf("while unmarshaling request base64(%s)", b64.StdEncoding.EncodeToString(data)))
+	d, err := provider.parseDelivery(config, event, data)
+	if err != nil {
+		warnf("%s while unmarshaling request\n", err)
+		debugf(config, "malformed payload base64(%s)\n", b64.StdEncoding.EncodeToString(data))
+		writeJSONError(w, http.StatusBadRequest, "malformed payload: "+err.Error())
+		return
+	}
+	d.ID = deliveryID(r)
+	d.Header = r.Header
 
-	log.Printf("received webhook on %s", hook.Repo.FullName)
+	info := &DeliveryInfo{
+		ID:         d.ID,
+		PayloadSHA: payloadFingerprint(data),
+		Event:      d.Event,
+		Repository: d.Repo.FullName,
+		Ref:        d.Ref,
+		Received:   time.Now(),
+		Replayed:   isReplay(r),
+	}
+	defer func() {
+		state.recordDelivery(info, data, &recordedRequest{path: r.URL.Path, header: r.Header, body: body}, config.HistorySize)
+	}()
 
-	//find matching config for repository name
+	//the processing of the delivery up to queueing its jobs, in the trace of the sender if it has one
+	root := startSpan(config, parseTraceParent(r.Header.Get("traceparent")), "webhook "+d.Event, spanKindServer)
+	root.set("gitea.event", d.Event)
+	root.set("gitea.delivery", d.ID)
+	root.set("gitea.repository", d.Repo.FullName)
+	root.set("gitea.ref", d.Ref)
+	d.trace = root.spanContext()
+	defer func() {
+		root.set("gitea.queued", info.Queued)
+		if info.Skipped != "" {
+			root.set("gitea.skipped", info.Skipped)
+		}
+		root.end()
+	}()
+
+	d.logf("received %s webhook on %s payload_sha=%s", d.Event, d.Repo.FullName, info.PayloadSHA)
+	metrics.observeDelivery(d.Event, d.Repo.FullName)
+	fireEventHooks(d)
+
+	//make sure the delivery was sent to the path of the repository in the payload
 	for _, repo := range config.Repositories {
+		if repo.rejectsPath(config, d.Repo.FullName, r.URL.Path) {
+			d.warnf("path %s does not match payload repository %s of repo %s\n", r.URL.Path, d.Repo.FullName, repo.Name)
+			respond(w, http.StatusBadRequest, info, "repository does not match path")
+			return
+		}
+	}
 
-		match, err := regexp.MatchString(repo.Name, hook.Repo.FullName)
-		if match && err == nil {
+	environment := resolveEnvironment(config, d.Ref)
+	if len(config.RefEnvMap) > 0 || config.DefaultEnvironment != "" {
+		d.logf("resolved environment \"%s\" for %s\n", environment, d.Ref)
+	}
 
-			//check if the secret in the configuration matches the request
-			if repo.Secret != "" && repo.Secret != hook.Secret {
-				log.Printf("secret mismatch for repo %s\n", repo.Name)
-				continue
-			}
+	env := append(os.Environ(), "GITEA_ENVIRONMENT="+environment)
+	env = append(env, d.environment()...)
 
-			//execute commands for repository
-			for _, cmd := range repo.Commands {
-				var command = exec.Command(cmd, string(data))
-				out, err := command.Output()
-				if err != nil {
-					log.Println(err)
-				} else {
-					log.Println("Executed: " + cmd)
-					log.Println("Output: " + string(out))
-				}
-			}
+	//Gitea redelivers webhooks on network errors and from its UI, replays from the admin API are intended
+	dedup := !config.DisableDedup && d.ID != "" && !info.Replayed
+	if dedup && !seenDeliveries.reserve(d.ID, config.DedupSize) {
+		d.logf("delivery %s was processed already, skipping %s\n", d.ID, d.Repo.FullName)
+		info.Skipped = "duplicate"
+		respond(w, http.StatusOK, info, "duplicate delivery")
+		return
+	}
+	//a delivery that was rejected before anything was queued runs when Gitea delivers it again
+	forget := func() {
+		if dedup && info.Queued == 0 {
+			seenDeliveries.release(d.ID)
 		}
 	}
+
+	//commands are not run while paused from the admin API
+	if state.isPaused() {
+		d.logf("command execution is paused, skipping %s\n", d.Repo.FullName)
+		info.Skipped = "paused"
+		forget()
+		respond(w, http.StatusOK, info, "command execution is paused")
+		return
+	}
+
+	//find matching config for repository name
+	match := startSpan(config, d.trace, "match", spanKindInternal)
+	matches, matched, skipped := NewMatcher(config).Match(d, r.URL.Path)
+	match.set("gitea.matches", len(matches))
+	match.end()
+	if skipped != "" {
+		info.Skipped = skipped
+	}
+	//check if the request was signed with (or contains) the secret in the configuration
+	authorized := func(repo ConfigRepository) bool {
+		if repo.Secret != "" && !verifySecret(repo.Secret, d, body) {
+			d.warnf("signature mismatch for repo %s\n", repo.Name)
+			return false
+		}
+		return true
+	}
+	dispatch(w, config, d, info, matches, matched, data, env, waitRequested(config, r), authorized, forget)
+}
+
+//dispatch queues the jobs of the repositories matching a delivery and answers the request with the
+//outcome, authorized reports whether a repository accepts the delivery and forget is called when a
+//retry of the delivery has to run again, with wait the request is answered once the jobs are done
+func dispatch(w http.ResponseWriter, config Config, d *Delivery, info *DeliveryInfo, matches []Match, matched bool, data []byte, env []string, wait bool, authorized func(repo ConfigRepository) bool, forget func()) {
+	unauthorized := false
+	deferred := false
+	throttled := false
+	full := false
+	busy := false
+	for _, match := range matches {
+		repo := match.Repository
+		jobEnv := env
+		if match.Delivery != d {
+			jobEnv = append(append([]string{}, env...), match.Delivery.matchEnvironment()...)
+		}
+
+		if !authorized(repo) {
+			unauthorized = true
+			continue
+		}
+
+		//keep a noisy repository from starving the others
+		if repo.RateLimit > 0 && !limiters.allow(repo, d.Repo.FullName) {
+			d.warnf("rate limit exceeded for repo %s\n", d.Repo.FullName)
+			throttled = true
+			continue
+		}
+
+		j := &job{config: config, repo: repo, delivery: match.Delivery, action: match.Action, commands: match.Commands, data: data, env: jobEnv, info: info}
+
+		//smooth out the burst of queued deliveries after a restart
+		if startupQuiet.add(j) {
+			info.Skipped = "deferred by startup quiet period"
+			deferred = true
+			continue
+		}
+
+		//collapse a burst of deliveries into a single run
+		if debounces.hold(j) {
+			info.Skipped = "debounced"
+			deferred = true
+			continue
+		}
+
+		//only deploy within the time windows of the repository
+		if schedules.hold(j) {
+			info.Skipped = "outside schedule"
+			deferred = true
+			continue
+		}
+
+		//a deploy of the repository may already be queued or running
+		if !deploys.admit(j) {
+			info.Skipped = "already running"
+			busy = true
+			continue
+		}
+
+		//execute commands for repository in the background, Gitea gives up on slow deliveries
+		if !queue.enqueue(j) {
+			full = true
+			continue
+		}
+		info.Queued++
+		info.Matched = append(info.Matched, repo.Name)
+	}
+
+	switch {
+	case throttled:
+		info.Skipped = "rate limited"
+		forget()
+		respond(w, http.StatusTooManyRequests, info, "rate limit exceeded")
+	case full:
+		info.Skipped = "queue full"
+		forget()
+		respond(w, http.StatusServiceUnavailable, info, "queue full")
+	case info.Queued > 0 && wait:
+		respondWhenDone(w, config, info)
+	case info.Queued > 0:
+		respond(w, http.StatusAccepted, info, "commands queued")
+	case deferred:
+		respond(w, http.StatusAccepted, info, "commands deferred")
+	case busy:
+		respond(w, http.StatusOK, info, "skipped, already running")
+	case unauthorized:
+		forget()
+		respond(w, http.StatusUnauthorized, info, "invalid signature")
+	case !matched:
+		forget()
+		respond(w, http.StatusNotFound, info, "no repository matched")
+	default:
+		respond(w, http.StatusOK, info, "nothing to do")
+	}
+}
+
+//respond answers a delivery with a status code and a JSON summary of what was done with it
+func respond(w http.ResponseWriter, status int, info *DeliveryInfo, message string) {
+	//queued jobs may already be adding their results
+	state.mutex.Lock()
+	summary := *info
+	state.mutex.Unlock()
+
+	writeJSON(w, status, struct {
+		Message string `json:"message"`
+		DeliveryInfo
+	}{message, summary})
 }
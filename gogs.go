@@ -0,0 +1,246 @@
+package webhook
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//gogsUser is a user of a Gogs payload, which has the user name in "username" (and "login" in newer
+//versions) where the Gitea SDK only reads "login"
+type gogsUser struct {
+	ID        int64  `json:"id"`
+	UserName  string `json:"username"`
+	Login     string `json:"login"`
+	FullName  string `json:"full_name"`
+	Email     string `json:"email"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+//user converts the user to the user of a delivery
+func (u *gogsUser) user() *api.User {
+	if u == nil {
+		return nil
+	}
+	name := u.Login
+	if name == "" {
+		name = u.UserName
+	}
+	return &api.User{ID: u.ID, UserName: name, FullName: u.FullName, Email: u.Email, AvatarURL: u.AvatarURL}
+}
+
+//gogsRepository is the repository of a Gogs payload
+type gogsRepository struct {
+	ID            int64     `json:"id"`
+	Owner         *gogsUser `json:"owner"`
+	Name          string    `json:"name"`
+	FullName      string    `json:"full_name"`
+	Description   string    `json:"description"`
+	Private       bool      `json:"private"`
+	Fork          bool      `json:"fork"`
+	HTMLURL       string    `json:"html_url"`
+	SSHURL        string    `json:"ssh_url"`
+	CloneURL      string    `json:"clone_url"`
+	Website       string    `json:"website"`
+	DefaultBranch string    `json:"default_branch"`
+}
+
+//repository converts the repository to the repository of a delivery
+func (r *gogsRepository) repository() *api.Repository {
+	if r == nil {
+		return nil
+	}
+	return &api.Repository{
+		ID:            r.ID,
+		Owner:         r.Owner.user(),
+		Name:          r.Name,
+		FullName:      r.FullName,
+		Description:   r.Description,
+		Private:       r.Private,
+		Fork:          r.Fork,
+		HTMLURL:       r.HTMLURL,
+		SSHURL:        r.SSHURL,
+		CloneURL:      r.CloneURL,
+		Website:       r.Website,
+		DefaultBranch: r.DefaultBranch,
+	}
+}
+
+//gogsPushPayload is the payload of a Gogs push, without the head commit and the total number of
+//commits of Gitea
+type gogsPushPayload struct {
+	//Secret is only sent by old versions of Gogs
+	Secret     string          `json:"secret"`
+	Ref        string          `json:"ref"`
+	Before     string          `json:"before"`
+	After      string          `json:"after"`
+	CompareURL string          `json:"compare_url"`
+	Repository *gogsRepository `json:"repository"`
+	Pusher     *gogsUser       `json:"pusher"`
+	Sender     *gogsUser       `json:"sender"`
+	Commits    []struct {
+		ID        string           `json:"id"`
+		Message   string           `json:"message"`
+		URL       string           `json:"url"`
+		Author    *api.PayloadUser `json:"author"`
+		Committer *api.PayloadUser `json:"committer"`
+		Added     []string         `json:"added"`
+		Removed   []string         `json:"removed"`
+		Modified  []string         `json:"modified"`
+		Timestamp time.Time        `json:"timestamp"`
+	} `json:"commits"`
+}
+
+func parseGogsPush(config Config, data []byte) (*Delivery, error) {
+	var hook gogsPushPayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Delivery{
+		Secret:     hook.Secret,
+		Repo:       hook.Repository.repository(),
+		Sender:     hook.Sender.user(),
+		Pusher:     hook.Pusher.user(),
+		Ref:        hook.Ref,
+		Before:     hook.Before,
+		After:      hook.After,
+		CompareURL: hook.CompareURL,
+	}
+	for _, c := range hook.Commits {
+		commit := &api.PayloadCommit{ID: c.ID, Message: c.Message, URL: c.URL, Author: c.Author, Committer: c.Committer, Timestamp: c.Timestamp, Added: c.Added, Removed: c.Removed, Modified: c.Modified}
+		d.Commits = append(d.Commits, commit)
+		if c.ID == hook.After {
+			d.HeadCommit = commit
+		}
+	}
+	d.TotalCommits = len(d.Commits)
+	d.Env = []string{
+		"GITEA_COMMIT_COUNT=" + strconv.Itoa(len(d.Commits)),
+		"GITEA_TOTAL_COMMITS=" + strconv.Itoa(d.TotalCommits),
+	}
+	return d, nil
+}
+
+//gogsRefPayload is the payload of a Gogs create or delete, which has no commit
+type gogsRefPayload struct {
+	Secret     string          `json:"secret"`
+	Ref        string          `json:"ref"`
+	RefType    string          `json:"ref_type"`
+	Repository *gogsRepository `json:"repository"`
+	Sender     *gogsUser       `json:"sender"`
+}
+
+func parseGogsRef(config Config, data []byte) (*Delivery, error) {
+	var hook gogsRefPayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Delivery{
+		Secret:  hook.Secret,
+		Repo:    hook.Repository.repository(),
+		Sender:  hook.Sender.user(),
+		Ref:     fullRef(hook.Ref, hook.RefType),
+		RefType: hook.RefType,
+	}, nil
+}
+
+//gogsPullRequestPayload is the payload of a Gogs pull request, whose branches are plain names instead
+//of the head and base of Gitea
+type gogsPullRequestPayload struct {
+	Secret      string `json:"secret"`
+	Action      string `json:"action"`
+	PullRequest *struct {
+		ID             int64           `json:"id"`
+		Index          int64           `json:"number"`
+		Poster         *gogsUser       `json:"user"`
+		Title          string          `json:"title"`
+		Body           string          `json:"body"`
+		State          api.StateType   `json:"state"`
+		HTMLURL        string          `json:"html_url"`
+		Mergeable      bool            `json:"mergeable"`
+		HasMerged      bool            `json:"merged"`
+		Merged         *time.Time      `json:"merged_at"`
+		MergedCommitID string          `json:"merged_commit_id"`
+		MergedBy       *gogsUser       `json:"merged_by"`
+		HeadBranch     string          `json:"head_branch"`
+		HeadRepo       *gogsRepository `json:"head_repo"`
+		BaseBranch     string          `json:"base_branch"`
+		BaseRepo       *gogsRepository `json:"base_repo"`
+	} `json:"pull_request"`
+	Repository *gogsRepository `json:"repository"`
+	Sender     *gogsUser       `json:"sender"`
+}
+
+func parseGogsPullRequest(config Config, data []byte) (*Delivery, error) {
+	var hook gogsPullRequestPayload
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+	if hook.PullRequest == nil {
+		return nil, errors.New("payload has no pull request")
+	}
+
+	pr := hook.PullRequest
+	pull := &api.PullRequest{
+		ID:        pr.ID,
+		Index:     pr.Index,
+		Poster:    pr.Poster.user(),
+		Title:     pr.Title,
+		Body:      pr.Body,
+		State:     pr.State,
+		HTMLURL:   pr.HTMLURL,
+		Mergeable: pr.Mergeable,
+		HasMerged: pr.HasMerged,
+		Merged:    pr.Merged,
+		MergedBy:  pr.MergedBy.user(),
+		//Gogs does not send the commits of the branches
+		Head: &api.PRBranchInfo{Name: pr.HeadBranch, Ref: pr.HeadBranch, Repository: pr.HeadRepo.repository()},
+		Base: &api.PRBranchInfo{Name: pr.BaseBranch, Ref: pr.BaseBranch, Repository: pr.BaseRepo.repository()},
+	}
+	if pr.MergedCommitID != "" {
+		pull.MergedCommitID = &pr.MergedCommitID
+	}
+
+	return &Delivery{
+		Secret:      hook.Secret,
+		Action:      hook.Action,
+		Repo:        hook.Repository.repository(),
+		Sender:      hook.Sender.user(),
+		Ref:         pullRequestRef(pull),
+		PullRequest: pull,
+	}, nil
+}
+
+//gogsUsers parses a Gogs payload like a Gitea one and reads the users again, the issue, comment,
+//fork and release payloads only differ from Gitea in the user names
+func gogsUsers(parse func(config Config, data []byte) (*Delivery, error)) func(config Config, data []byte) (*Delivery, error) {
+	return func(config Config, data []byte) (*Delivery, error) {
+		d, err := parse(config, data)
+		if err != nil {
+			return nil, err
+		}
+
+		var hook struct {
+			Repository *gogsRepository `json:"repository"`
+			Sender     *gogsUser       `json:"sender"`
+		}
+		err = unmarshalPayload(config, data, &hook)
+		if err != nil {
+			return nil, err
+		}
+		if hook.Repository != nil {
+			d.Repo = hook.Repository.repository()
+		}
+		if hook.Sender != nil {
+			d.Sender = hook.Sender.user()
+		}
+		return d, nil
+	}
+}
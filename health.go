@@ -0,0 +1,37 @@
+package webhook
+
+import (
+	"net/http"
+)
+
+//reloading reports whether a config reload is in progress
+func reloading() bool {
+	reloads.Lock()
+	defer reloads.Unlock()
+	return reloads.running
+}
+
+//notReady returns why the daemon should not receive deliveries right now, or an empty string
+func notReady() string {
+	if reloading() {
+		return "config reload in progress"
+	}
+	if queue == nil {
+		return "starting"
+	}
+	return queue.notReady()
+}
+
+//healthHandler reports that the daemon is alive
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+//readyHandler reports whether the daemon can accept deliveries
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if reason := notReady(); reason != "" {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "reason": reason})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
@@ -0,0 +1,195 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//maxRecordedOutput is the number of bytes of the output of a command kept in the history
+const maxRecordedOutput = 64 << 10
+
+//CommandRecord is the result of a command as kept in the history of a delivery
+type CommandRecord struct {
+	Repository string    `json:"repository"`
+	Command    string    `json:"command"`
+	ExitCode   int       `json:"exitcode"`
+	Started    time.Time `json:"started"`
+	Duration   float64   `json:"duration"`
+	Output     string    `json:"output,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	LogFile    string    `json:"logfile,omitempty"`
+	Attempts   int       `json:"attempts,omitempty"`
+}
+
+//newCommandRecord keeps the result of a command with its output trimmed to the last bytes
+func newCommandRecord(repository string, result Result) CommandRecord {
+	output := result.Output
+	if len(output) > maxRecordedOutput {
+		output = output[len(output)-maxRecordedOutput:]
+	}
+	record := CommandRecord{
+		Repository: repository,
+		Command:    result.Command,
+		ExitCode:   result.ExitCode,
+		Started:    result.Started,
+		Duration:   result.Duration.Seconds(),
+		Output:     string(output),
+		LogFile:    result.LogFile,
+		Attempts:   result.Attempts,
+	}
+	if result.Err != nil {
+		record.Error = result.Err.Error()
+	}
+	return record
+}
+
+//historyEntry is a delivery kept in the history together with its payload
+type historyEntry struct {
+	info    *DeliveryInfo
+	payload []byte
+	//request holds the original request so the delivery can be replayed
+	request *recordedRequest
+}
+
+//recordedRequest is the part of a request needed to replay it
+type recordedRequest struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+//historyRecord is a delivery of the history as served by the admin API
+type historyRecord struct {
+	DeliveryInfo
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+//deliveryHistory returns copies of the deliveries in the history, newest first
+func (s *runtimeState) deliveryHistory() []historyRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	records := make([]historyRecord, 0, len(s.history))
+	for i := len(s.history) - 1; i >= 0; i-- {
+		entry := s.history[i]
+		record := historyRecord{DeliveryInfo: *entry.info}
+		if json.Valid(entry.payload) {
+			record.Payload = entry.payload
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+//historyView is what the history page shows, Base is the external URL of the daemon the links of
+//the page start with
+type historyView struct {
+	Base       string
+	Deliveries []historyRecord
+}
+
+//historyPage is a minimal page to browse the history
+var historyPage = template.Must(template.New("deliveries").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Deliveries</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { border-bottom: 1px solid #ddd; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+pre { background: #f6f6f6; padding: 0.5em; max-height: 30em; overflow: auto; }
+.failed { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Deliveries</h1>
+<table>
+<tr><th>Received</th><th>Event</th><th>Repository</th><th>Ref</th><th>Result</th></tr>
+{{range .Deliveries}}
+<tr>
+<td>{{.Received.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.Event}}</td>
+<td>{{.Repository}}</td>
+<td>{{.Ref}}</td>
+<td>
+{{if .Skipped}}{{.Skipped}}<br>{{end}}
+<span{{if .Failed}} class="failed"{{end}}>{{.Executed}} executed, {{.Failed}} failed</span>
+<details>
+<summary>{{.ID}}</summary>
+<p><a href="{{$.Base}}/admin/deliveries/{{.ID}}/stream">Output</a></p>
+{{range .Results}}
+<p{{if .Error}} class="failed"{{end}}>{{.Repository}}: {{.Command}} exited with {{.ExitCode}} after {{printf "%.1f" .Duration}}s</p>
+{{if .Output}}<pre>{{.Output}}</pre>{{end}}
+{{end}}
+{{if .Payload}}<p>Payload</p><pre>{{printf "%s" .Payload}}</pre>{{end}}
+</details>
+</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+func adminDeliveries(w http.ResponseWriter, r *http.Request) {
+	records := state.deliveryHistory()
+
+	if r.URL.Query().Get("format") == "html" || strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := historyPage.Execute(w, historyView{Base: externalURL(currentConfig(), r), Deliveries: records})
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+//replayKey marks the context of replayed requests
+type replayKey struct{}
+
+//isReplay reports whether the request replays a delivery from the history
+func isReplay(r *http.Request) bool {
+	return r.Context().Value(replayKey{}) != nil
+}
+
+//findDelivery returns the entry of a delivery in the history by its ID or payload_sha
+func (s *runtimeState) findDelivery(id string) *historyEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := len(s.history) - 1; i >= 0; i-- {
+		entry := s.history[i]
+		if entry.info.ID == id || entry.info.PayloadSHA == id {
+			return entry
+		}
+	}
+	return nil
+}
+
+//adminReplay runs a delivery from the history again, the response is the one of the replayed delivery
+func adminReplay(w http.ResponseWriter, r *http.Request) {
+	id := pathID(r, 1)
+	entry := state.findDelivery(id)
+	if entry == nil || entry.request == nil {
+		writeJSONError(w, http.StatusNotFound, "delivery not in the history")
+		return
+	}
+
+	log.Printf("replaying delivery %s\n", id)
+	replay, err := http.NewRequest(http.MethodPost, entry.request.path, bytes.NewReader(entry.request.body))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	replay.Header = entry.request.header.Clone()
+	replay.RemoteAddr = r.RemoteAddr
+	hookHandler(w, replay.WithContext(context.WithValue(r.Context(), replayKey{}, id)))
+}
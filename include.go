@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//configInclude is a file of the include directories holding several repositories and schedules,
+//a file without them holds a single repository
+type configInclude struct {
+	Repositories []ConfigRepository
+	Schedules    []ConfigSchedule
+}
+
+//includeFiles returns the files matching the include patterns of a config file in order, relative
+//patterns are relative to the directory of the config file
+func includeFiles(configFile string, patterns []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configFile), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern %s: %s", pattern, err)
+		}
+		for _, match := range matches {
+			//editors and config management leave hidden backup and temporary files behind
+			if seen[match] || strings.HasPrefix(filepath.Base(match), ".") {
+				continue
+			}
+			if info, err := os.Stat(match); err != nil || info.IsDir() {
+				continue
+			}
+			seen[match] = true
+			files = append(files, match)
+		}
+	}
+	return files, nil
+}
+
+//readIncludes appends the repositories and schedules of the included files to the config
+func readIncludes(configFile string, config *Config) error {
+	files, err := includeFiles(configFile, config.Include)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var include configInclude
+		err = decodeConfig(data, configFormat(file), &include)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		if len(include.Repositories) == 0 && len(include.Schedules) == 0 {
+			var repo ConfigRepository
+			err = decodeConfig(data, configFormat(file), &repo)
+			if err != nil {
+				return fmt.Errorf("%s: %s", file, err)
+			}
+			include.Repositories = []ConfigRepository{repo}
+		}
+		config.Repositories = append(config.Repositories, include.Repositories...)
+		config.Schedules = append(config.Schedules, include.Schedules...)
+	}
+	return nil
+}
+
+//configFiles returns the config file and the files it includes, for watching them for changes
+func configFiles(configFile string) []string {
+	files := []string{configFile}
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return files
+	}
+	var config Config
+	if decodeConfig(data, configFormat(configFile), &config) != nil {
+		return files
+	}
+	includes, _ := includeFiles(configFile, config.Include)
+	return append(files, includes...)
+}
+
+//configDirectories returns the directories of the config file and of its include patterns
+func configDirectories(configFile string, config Config) []string {
+	seen := map[string]bool{filepath.Dir(configFile): true}
+	dirs := []string{filepath.Dir(configFile)}
+	for _, pattern := range config.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configFile), pattern)
+		}
+		dir := filepath.Dir(pattern)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
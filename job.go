@@ -0,0 +1,265 @@
+package webhook
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//job is the execution of the commands of a matched repository for a delivery
+type job struct {
+	config   Config
+	repo     ConfigRepository
+	delivery *Delivery
+	action   *ConfigAction
+	commands []ConfigCommand
+	data     []byte
+	env      []string
+	//info is the record of the delivery the results are added to
+	info *DeliveryInfo
+	//runLog holds the output files of the commands while the job runs
+	runLog *runLog
+	//journalID is the ID of the job in the job state file
+	journalID string
+}
+
+//key identifies jobs that can be coalesced into a single run, the jobs of other tenants never are
+func (j *job) key() string {
+	return j.repo.tenant + "\x00" + j.repo.Name + "\x00" + j.delivery.Repo.FullName + "\x00" + j.delivery.Event
+}
+
+//run executes the commands of the job and returns their results,
+//the remaining commands are skipped once ctx is cancelled
+func (j *job) run(ctx context.Context) []Result {
+	span := startSpan(j.config, j.delivery.trace, "job "+j.repo.Name, spanKindInternal)
+	span.set("gitea.repository", j.delivery.Repo.FullName)
+	span.set("gitea.delivery", j.delivery.ID)
+	ctx = contextWithSpan(ctx, span)
+
+	j.postCommitStatus(api.StatusPending, "running")
+
+	if !isDryRun(j.repo) {
+		var err error
+		j.runLog, err = newRunLog(j.config, j.delivery)
+		if err != nil {
+			j.delivery.errorf("failed to create run log directory: %s\n", err)
+		}
+	}
+
+	var results []Result
+	var failed *Result
+	if j.action != nil {
+		results = j.runAction(ctx)
+		for i := range results {
+			if results[i].Err != nil {
+				failed = &results[i]
+			}
+		}
+	}
+
+	//the commands usually deploy what the action checked out, so they are skipped when it failed
+	if failed == nil {
+		var commands []Result
+		commands, failed = j.runCommands(ctx, j.commands, j.env, j.repo.Policy == "stop")
+		results = append(results, commands...)
+	} else if len(j.commands) > 0 {
+		j.delivery.errorf("%s action failed, skipping %d commands for %s\n", j.action.Type, len(j.commands), j.delivery.Repo.FullName)
+	}
+
+	//conditional steps, like a rollback or a notification when a deploy step broke
+	if failed != nil && len(j.repo.OnFailure) > 0 {
+		//the environment is shared with the other jobs of the delivery
+		env := append(append([]string{}, j.env...), "GITEA_FAILED_COMMAND="+failed.Command, "GITEA_EXIT_CODE="+strconv.Itoa(failed.ExitCode))
+		j.delivery.logf("%s failed, running %d onfailure commands\n", failed.Command, len(j.repo.OnFailure))
+		onFailure, _ := j.runCommands(ctx, j.repo.OnFailure, env, false)
+		results = append(results, onFailure...)
+	} else if failed == nil && len(j.repo.OnSuccess) > 0 && len(results) > 0 {
+		onSuccess, _ := j.runCommands(ctx, j.repo.OnSuccess, j.env, false)
+		results = append(results, onSuccess...)
+	}
+
+	if isDryRun(j.repo) {
+		for _, target := range j.repo.Forward {
+			j.delivery.logf("dry run: would forward %s of %s to %s\n", j.delivery.Event, j.delivery.Repo.FullName, target.URL)
+		}
+	} else if len(j.repo.Forward) > 0 {
+		forwardAll(ctx, j.config, j.repo.Forward, j.delivery, j.data)
+	}
+
+	if isDryRun(j.repo) {
+		for _, target := range j.repo.Publish {
+			j.delivery.logf("dry run: would publish %s of %s to %s %s\n", j.delivery.Event, j.delivery.Repo.FullName, target.Type, target.Subject)
+		}
+	} else if len(j.repo.Publish) > 0 {
+		publishAll(ctx, j.repo.Publish, j.delivery, j.data, j.env)
+	}
+
+	if j.config.StatusFile != "" && !isDryRun(j.repo) {
+		err := statusFile.update(j.config, j, results)
+		if err != nil {
+			j.delivery.errorf("failed to write status file: %s\n", err)
+		}
+	}
+
+	j.postCommitStatus(statusDescription(results))
+	j.postComment(results)
+	//dependent repositories deploy what the commands built or deployed
+	if failed == nil && ctx.Err() == nil && len(results) > 0 {
+		j.triggerRepos()
+	}
+	j.notify(results)
+
+	state.recordResults(j.info, j.repo.Name, results)
+	streams.publish(j.delivery.ID, streamEvent{Type: "finished", Repository: j.repo.Name})
+	metrics.observeResults(j.delivery.Repo.FullName, results)
+	if failed != nil {
+		span.fail(failed.Err)
+	}
+	span.end()
+	return results
+}
+
+//runCommands executes commands in order and returns their results and the first failed one,
+//stopping at the first failure if requested
+func (j *job) runCommands(ctx context.Context, commands []ConfigCommand, env []string, stopOnFailure bool) ([]Result, *Result) {
+	var results []Result
+	var failed *Result
+	for i, cmd := range commands {
+		if ctx.Err() != nil {
+			j.delivery.logf("cancelled, skipping %d remaining commands for %s\n", len(commands)-i, j.delivery.Repo.FullName)
+			break
+		}
+
+		result := j.runWithRetries(ctx, cmd, env)
+		results = append(results, result)
+		if result.Err == nil {
+			continue
+		}
+		if failed == nil {
+			failed = &result
+		}
+
+		//a command that cannot be started usually means a broken config
+		if stopOnFailure || result.StartFailed && j.config.AbortOnStartError {
+			j.delivery.logf("skipping %d remaining commands for %s\n", len(commands)-i-1, j.delivery.Repo.FullName)
+			break
+		}
+	}
+	return results, failed
+}
+
+//maxRetryBackoff limits the time between retries of commands and forwards
+const maxRetryBackoff = 5 * time.Minute
+
+//defaultRetryBackoff is the time before the first retry of a command when not configured
+const defaultRetryBackoff = 5 * time.Second
+
+//runWithRetries executes a command and retries it with an exponential backoff while it fails,
+//commands that could not be started or were cancelled are not retried
+func (j *job) runWithRetries(ctx context.Context, cmd ConfigCommand, env []string) Result {
+	backoff := time.Duration(j.repo.RetryBackoff) * time.Second
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		result := runCommand(ctx, j.config, j.repo, cmd, j.delivery, j.data, env, j.runLog)
+		result.Attempts = attempt
+		if result.Err == nil || result.StartFailed || ctx.Err() != nil || attempt > j.repo.Retries {
+			return result
+		}
+
+		j.delivery.warnf("%s failed with exit code %d, retrying in %s (%d of %d)\n", cmd.Command, result.ExitCode, backoff, attempt, j.repo.Retries)
+		if !waitBackoff(ctx, backoff) {
+			return result
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+//waitBackoff waits before a retry and reports false if ctx was cancelled meanwhile
+func waitBackoff(ctx context.Context, backoff time.Duration) bool {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//nextBackoff doubles the time before the next retry
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
+
+//quietPeriod defers and coalesces jobs for a while after startup
+type quietPeriod struct {
+	mutex    sync.Mutex
+	active   bool
+	deferred int
+	order    []string
+	pending  map[string]*job
+}
+
+var startupQuiet = &quietPeriod{}
+
+//start defers all jobs until the duration elapsed
+func (q *quietPeriod) start(duration time.Duration) {
+	q.mutex.Lock()
+	q.active = true
+	q.pending = make(map[string]*job)
+	q.mutex.Unlock()
+
+	log.Printf("startup quiet period of %s, commands are deferred until it is over\n", duration)
+	time.AfterFunc(duration, q.end)
+}
+
+//add defers the job if the quiet period is active, only the latest job per repository and event is kept
+func (q *quietPeriod) add(j *job) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !q.active {
+		return false
+	}
+
+	key := j.key()
+	if _, ok := q.pending[key]; !ok {
+		q.order = append(q.order, key)
+	}
+	q.pending[key] = j
+	q.deferred++
+
+	j.delivery.logf("deferred %s for %s during startup quiet period (%d deferred so far)\n", j.delivery.Event, j.delivery.Repo.FullName, q.deferred)
+	return true
+}
+
+//end runs the coalesced jobs and resumes normal operation
+func (q *quietPeriod) end() {
+	q.mutex.Lock()
+	q.active = false
+	jobs := make([]*job, 0, len(q.order))
+	for _, key := range q.order {
+		jobs = append(jobs, q.pending[key])
+	}
+	deferred := q.deferred
+	q.pending = nil
+	q.order = nil
+	q.mutex.Unlock()
+
+	log.Printf("startup quiet period over, running %d jobs for %d deferred deliveries\n", len(jobs), deferred)
+	for _, j := range jobs {
+		queue.push(j)
+	}
+	log.Println("resumed normal operation")
+}
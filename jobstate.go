@@ -0,0 +1,206 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//jobRecord is a queued or running job as written to the job state file
+type jobRecord struct {
+	ID string `json:"id"`
+	//Repository is the name of the repository (or schedule) of the config the job runs for
+	Repository string `json:"repository"`
+	//Tenant is the tenant of the repository, if any
+	Tenant   string    `json:"tenant,omitempty"`
+	Delivery *Delivery `json:"delivery"`
+	Payload  []byte    `json:"payload,omitempty"`
+	Queued   time.Time `json:"queued"`
+	//Started is set once a worker runs the job
+	Started time.Time `json:"started,omitempty"`
+}
+
+//jobJournal keeps the queued and running jobs in the job state file, so the jobs a crash or a
+//restart interrupted are not lost silently
+type jobJournal struct {
+	mutex   sync.Mutex
+	path    string
+	records map[string]*jobRecord
+}
+
+var journal = &jobJournal{}
+
+//add records a job that was queued
+func (l *jobJournal) add(j *job) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.path == "" {
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	j.journalID = hex.EncodeToString(id)
+	l.records[j.journalID] = &jobRecord{ID: j.journalID, Repository: j.repo.Name, Tenant: j.repo.tenant, Delivery: j.delivery, Payload: j.data, Queued: time.Now()}
+	l.write()
+}
+
+//start records that a worker runs a job
+func (l *jobJournal) start(j *job) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if record, ok := l.records[j.journalID]; ok {
+		record.Started = time.Now()
+		l.write()
+	}
+}
+
+//remove forgets a job that is done
+func (l *jobJournal) remove(j *job) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.records[j.journalID]; ok {
+		delete(l.records, j.journalID)
+		l.write()
+	}
+}
+
+//write replaces the job state file with the current records, oldest first
+func (l *jobJournal) write() {
+	records := make([]*jobRecord, 0, len(l.records))
+	for _, record := range l.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, k int) bool {
+		return records[i].Queued.Before(records[k].Queued)
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err == nil {
+		//the payloads and headers of the deliveries are not for everyone
+		err = writeFileAtomicMode(l.path, append(data, '\n'), 0600)
+	}
+	if err != nil {
+		errorf("failed to write job state file %s: %s\n", l.path, err)
+	}
+}
+
+//restoreJobs starts recording the jobs in the job state file of a config and handles the jobs a
+//previous run of the daemon did not finish, they are queued again or reported as interrupted
+//depending on the onrestart setting of their repository
+func restoreJobs(config Config) {
+	if config.JobStateFile == "" {
+		return
+	}
+
+	var records []*jobRecord
+	data, err := ioutil.ReadFile(config.JobStateFile)
+	if err == nil {
+		err = json.Unmarshal(data, &records)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		//keep the file for a look at what was lost, the journal starts over
+		backup := config.JobStateFile + ".corrupt"
+		errorf("failed to read job state file %s, moving it to %s: %s\n", config.JobStateFile, backup, err)
+		if err := os.Rename(config.JobStateFile, backup); err != nil {
+			errorf("failed to move job state file %s, not recording jobs: %s\n", config.JobStateFile, err)
+			return
+		}
+		records = nil
+	}
+
+	journal.mutex.Lock()
+	journal.path = config.JobStateFile
+	journal.records = make(map[string]*jobRecord)
+	journal.write()
+	journal.mutex.Unlock()
+
+	for _, record := range records {
+		restoreJob(config, record)
+	}
+}
+
+//restoreJob queues a job of the job state file again or reports it as interrupted
+func restoreJob(config Config, record *jobRecord) {
+	d := record.Delivery
+	if d == nil || d.Repo == nil {
+		return
+	}
+	d.raw = record.Payload
+	repo, ok := findJobRepository(config, record.Repository, record.Tenant)
+	if !ok {
+		warnf("dropping interrupted job of %s for %s, the repository is no longer configured\n", record.Repository, d.Repo.FullName)
+		return
+	}
+
+	info := &DeliveryInfo{
+		ID:         d.ID,
+		Event:      d.Event,
+		Repository: d.Repo.FullName,
+		Ref:        d.Ref,
+		Received:   time.Now(),
+		Queued:     1,
+		Matched:    []string{repo.Name},
+	}
+	state.recordDelivery(info, nil, nil, config.HistorySize)
+
+	env := append(os.Environ(), "GITEA_ENVIRONMENT="+resolveEnvironment(config, d.Ref))
+	env = append(env, d.environment()...)
+	env = append(env, d.matchEnvironment()...)
+	j := &job{config: config, repo: repo, delivery: d, action: repo.actionFor(d), commands: repo.commandsFor(d), data: record.Payload, env: env, info: info}
+	if d.Event == "schedule" {
+		j.action, j.commands = repo.Action, repo.Commands
+	}
+
+	interrupted := "queued"
+	if !record.Started.IsZero() {
+		interrupted = "running"
+	}
+	if repo.OnRestart == "resume" {
+		d.logf("resuming the %s job of %s for %s interrupted by a restart\n", interrupted, repo.Name, d.Repo.FullName)
+		if !deploys.admit(j) {
+			info.Skipped = "already running"
+			return
+		}
+		if !queue.enqueue(j) {
+			info.Skipped = "queue full"
+		}
+		return
+	}
+
+	d.warnf("the %s job of %s for %s was interrupted by a restart\n", interrupted, repo.Name, d.Repo.FullName)
+	started := record.Started
+	if started.IsZero() {
+		started = record.Queued
+	}
+	results := []Result{{Command: "job", ExitCode: exitCodeCancelled, Started: started, Err: fmt.Errorf("the %s job was interrupted by a restart of the daemon", interrupted)}}
+	state.recordResults(info, repo.Name, results)
+	//the reports go to Gitea and the notification targets, startup does not wait for them
+	go func() {
+		j.postCommitStatus(api.StatusError, "interrupted by a restart")
+		j.notify(results)
+	}()
+}
+
+//findJobRepository returns the repository or schedule of the config a job was recorded for
+func findJobRepository(config Config, name string, tenant string) (ConfigRepository, bool) {
+	for _, repo := range config.Repositories {
+		if repo.Name == name && repo.tenant == tenant {
+			return repo, true
+		}
+	}
+	for _, schedule := range config.Schedules {
+		if schedule.Name == name {
+			return schedule.repository(), true
+		}
+	}
+	return ConfigRepository{}, false
+}
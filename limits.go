@@ -0,0 +1,95 @@
+package webhook
+
+import (
+	"fmt"
+	"io"
+)
+
+//ConfigLimits are the resources a command and the processes it starts may use, so a runaway build
+//cannot take down the host. A field of 0 sets no limit.
+type ConfigLimits struct {
+	//CPUTime is the CPU time in seconds every process of the command may use before it is killed
+	CPUTime int64
+	//CPUs is the number of CPUs the command may keep busy, like 1.5; it needs cgroups
+	CPUs float64
+	//Memory is the memory in bytes the command may use, all its processes together with cgroups
+	//and every process on its own without them
+	Memory int64
+	//Processes is the number of processes the command may run at once; it needs cgroups
+	Processes int64
+	//OutputSize is the number of bytes of stdout and of stderr kept, logged and streamed, the
+	//command may write more but the rest is discarded
+	OutputSize int64
+}
+
+//commandLimits returns the limits of a command, the most specific setting of every limit wins like
+//for the timeout
+func commandLimits(config Config, repo ConfigRepository, cmd ConfigCommand) ConfigLimits {
+	limits := config.Limits
+	for _, specific := range []ConfigLimits{repo.Limits, cmd.Limits} {
+		if specific.CPUTime > 0 {
+			limits.CPUTime = specific.CPUTime
+		}
+		if specific.CPUs > 0 {
+			limits.CPUs = specific.CPUs
+		}
+		if specific.Memory > 0 {
+			limits.Memory = specific.Memory
+		}
+		if specific.Processes > 0 {
+			limits.Processes = specific.Processes
+		}
+		if specific.OutputSize > 0 {
+			limits.OutputSize = specific.OutputSize
+		}
+	}
+	return limits
+}
+
+//needsCgroup reports whether the limits can only be enforced by a cgroup of its own
+func (limits ConfigLimits) needsCgroup() bool {
+	return limits.CPUs > 0 || limits.Memory > 0 || limits.Processes > 0
+}
+
+//checkLimits reports the problems of the limits of a config, a repository or a command
+func checkLimits(problem func(format string, v ...interface{}), limits ConfigLimits, owner string) {
+	if limits.CPUTime < 0 || limits.CPUs < 0 || limits.Memory < 0 || limits.Processes < 0 || limits.OutputSize < 0 {
+		problem("limits of %s are negative", owner)
+	}
+	if limits.Memory > 0 && limits.Memory < 1<<20 {
+		problem("memory limit of %s is below 1 MiB, it is in bytes", owner)
+	}
+}
+
+//limitedWriter passes on the first size bytes written to it and discards the rest, noting once that
+//the output was truncated. Writes always succeed, so the command does not block on a full pipe.
+type limitedWriter struct {
+	out       io.Writer
+	size      int64
+	written   int64
+	truncated bool
+}
+
+//limitOutput returns out limited to size bytes, or out itself without a limit
+func limitOutput(out io.Writer, size int64) io.Writer {
+	if size <= 0 {
+		return out
+	}
+	return &limitedWriter{out: out, size: size}
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	kept := p
+	if room := w.size - w.written; int64(len(kept)) > room {
+		kept = kept[:room]
+	}
+	if len(kept) > 0 {
+		w.out.Write(kept)
+		w.written += int64(len(kept))
+	}
+	if len(kept) < len(p) && !w.truncated {
+		w.truncated = true
+		fmt.Fprintf(w.out, "\n[output truncated after %d bytes]\n", w.size)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,267 @@
+//go:build linux
+
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+//cgroupMount is where the unified cgroup v2 hierarchy is mounted
+const cgroupMount = "/sys/fs/cgroup"
+
+//cgroupFallback describes the limits of the commands when they cannot have cgroups
+const cgroupFallback = "the memory limits of commands apply to every process on its own and the cpus and processes limits are not enforced"
+
+//cgroupPeriod is the period in microseconds the CPU limit of a cgroup is enforced in
+const cgroupPeriod = 100000
+
+//prlimitPath is the prlimit(1) of util-linux the commands with rlimits are started through, so the
+//limits are in place before the command runs. Without it they are set right after the start, and what
+//the command forks or allocates before that is not limited.
+var prlimitPath struct {
+	once sync.Once
+	path string
+}
+
+//findPrlimit returns the path of prlimit(1), "" if it is not installed
+func findPrlimit() string {
+	prlimitPath.once.Do(func() {
+		path, err := exec.LookPath("prlimit")
+		if err != nil {
+			warnf("prlimit is not installed, the rlimits of commands are applied once they started and miss what they do in the first instant\n")
+			return
+		}
+		prlimitPath.path = path
+	})
+	return prlimitPath.path
+}
+
+//commandCgroups is the cgroup the cgroups of the commands are created in, the cgroup of the daemon
+//if it was delegated to the daemon, like with Delegate=yes in the systemd unit
+var commandCgroups struct {
+	once sync.Once
+	dir  string
+}
+
+//cgroupParent returns the cgroup directory the cgroups of the commands are created in, "" without
+//cgroup v2 or without write access to the cgroup of the daemon
+func cgroupParent() string {
+	commandCgroups.once.Do(func() {
+		if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err != nil {
+			warnf("cgroup v2 is not available, %s\n", cgroupFallback)
+			return
+		}
+		data, err := ioutil.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			warnf("failed to find the cgroup of the daemon: %s\n", err)
+			return
+		}
+		var own string
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "0::") {
+				own = strings.TrimPrefix(scanner.Text(), "0::")
+			}
+		}
+		dir := filepath.Join(cgroupMount, own)
+
+		//a cgroup that passes its controllers on to children cannot have processes of its own, so
+		//the daemon moves to a child as well
+		leaf := filepath.Join(dir, "daemon")
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			warnf("the cgroup %s is not delegated to the daemon, %s: %s\n", dir, cgroupFallback, err)
+			return
+		}
+		err = ioutil.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0644)
+		}
+		if err != nil {
+			warnf("failed to set up the cgroups of the commands in %s, %s: %s\n", dir, cgroupFallback, err)
+			return
+		}
+		commandCgroups.dir = dir
+		log.Printf("moved the daemon to the cgroup %s, the commands with limits run in cgroups next to it\n", leaf)
+	})
+	return commandCgroups.dir
+}
+
+//resourceLimits enforces the limits of a running command, with a cgroup of its own where needed
+//and rlimits otherwise
+type resourceLimits struct {
+	limits  ConfigLimits
+	command *exec.Cmd
+	//wrapped is set when the command is started through prlimit, which set the rlimits already
+	wrapped bool
+	//cgroup is the directory of the cgroup of the command, and fd the open directory the command
+	//is started in
+	cgroup string
+	fd     *os.File
+}
+
+//newResourceLimits prepares a command to be started with its limits, it has to be called after
+//newProcessGroup
+func newResourceLimits(limits ConfigLimits, command *exec.Cmd) (*resourceLimits, error) {
+	r := &resourceLimits{limits: limits, command: command}
+	if limits.needsCgroup() {
+		if parent := cgroupParent(); parent != "" {
+			if err := r.createCgroup(parent); err != nil {
+				return nil, err
+			}
+		}
+	}
+	r.wrap()
+	return r, nil
+}
+
+//rlimits returns the rlimits of the command, the memory limit is one without a cgroup
+func (r *resourceLimits) rlimits() map[int]unix.Rlimit {
+	rlimits := map[int]unix.Rlimit{}
+	if r.limits.CPUTime > 0 {
+		//SIGXCPU at the limit, SIGKILL a second later for commands that ignore it
+		rlimits[unix.RLIMIT_CPU] = unix.Rlimit{Cur: uint64(r.limits.CPUTime), Max: uint64(r.limits.CPUTime) + 1}
+	}
+	if r.limits.Memory > 0 && r.cgroup == "" {
+		rlimits[unix.RLIMIT_AS] = unix.Rlimit{Cur: uint64(r.limits.Memory), Max: uint64(r.limits.Memory)}
+	}
+	return rlimits
+}
+
+//wrap runs the command through prlimit if it has rlimits, prlimit sets them and executes the command
+//in its place, with the same process ID
+func (r *resourceLimits) wrap() {
+	rlimits := r.rlimits()
+	if len(rlimits) == 0 || r.command.Err != nil {
+		return
+	}
+	prlimit := findPrlimit()
+	if prlimit == "" {
+		return
+	}
+	args := []string{prlimit}
+	if limit, ok := rlimits[unix.RLIMIT_CPU]; ok {
+		args = append(args, fmt.Sprintf("--cpu=%d:%d", limit.Cur, limit.Max))
+	}
+	if limit, ok := rlimits[unix.RLIMIT_AS]; ok {
+		args = append(args, fmt.Sprintf("--as=%d:%d", limit.Cur, limit.Max))
+	}
+	args = append(append(args, "--", r.command.Path), r.command.Args[1:]...)
+	r.command.Path, r.command.Args = prlimit, args
+	r.wrapped = true
+}
+
+//createCgroup creates the cgroup of the command below parent with its limits, the command is
+//started in it
+func (r *resourceLimits) createCgroup(parent string) error {
+	limits, command := r.limits, r.command
+
+	id := make([]byte, 6)
+	rand.Read(id)
+	r.cgroup = filepath.Join(parent, "command-"+hex.EncodeToString(id))
+	if err := os.Mkdir(r.cgroup, 0755); err != nil {
+		r.cgroup = ""
+		return fmt.Errorf("failed to create cgroup: %s", err)
+	}
+	settings := map[string]string{}
+	if limits.Memory > 0 {
+		settings["memory.max"] = strconv.FormatInt(limits.Memory, 10)
+		settings["memory.swap.max"] = "0"
+	}
+	if limits.Processes > 0 {
+		settings["pids.max"] = strconv.FormatInt(limits.Processes, 10)
+	}
+	if limits.CPUs > 0 {
+		settings["cpu.max"] = fmt.Sprintf("%d %d", int64(limits.CPUs*cgroupPeriod), cgroupPeriod)
+	}
+	for file, value := range settings {
+		err := ioutil.WriteFile(filepath.Join(r.cgroup, file), []byte(value), 0644)
+		//without swap there is no memory.swap.max
+		if err != nil && !(file == "memory.swap.max" && os.IsNotExist(err)) {
+			r.release()
+			return fmt.Errorf("failed to set %s of cgroup: %s", file, err)
+		}
+	}
+
+	fd, err := os.Open(r.cgroup)
+	if err != nil {
+		r.release()
+		return fmt.Errorf("failed to open cgroup: %s", err)
+	}
+	r.fd = fd
+	command.SysProcAttr.UseCgroupFD = true
+	command.SysProcAttr.CgroupFD = int(fd.Fd())
+	return nil
+}
+
+//started applies the rlimits to the started command if prlimit did not, the processes it started in
+//the meantime keep the limits of the daemon
+func (r *resourceLimits) started(d *Delivery) {
+	if r.fd != nil {
+		r.fd.Close()
+		r.fd = nil
+	}
+	if r.wrapped {
+		return
+	}
+	for resource, limit := range r.rlimits() {
+		limit := limit
+		if err := unix.Prlimit(r.command.Process.Pid, resource, &limit, nil); err != nil {
+			d.warnf("failed to limit the resources of %s: %s\n", r.command.Path, err)
+		}
+	}
+}
+
+//exceeded explains the exit of a command that was killed for going over a limit, or returns ""
+func (r *resourceLimits) exceeded() string {
+	if status, ok := r.command.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == syscall.SIGXCPU {
+		return fmt.Sprintf("exceeded the cpu time limit of %ds", r.limits.CPUTime)
+	}
+	if r.cgroup == "" {
+		return ""
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(r.cgroup, "memory.events"))
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+			return fmt.Sprintf("exceeded the memory limit of %d bytes", r.limits.Memory)
+		}
+	}
+	return ""
+}
+
+//release removes the cgroup of the command, once the processes in it were killed
+func (r *resourceLimits) release() {
+	if r.fd != nil {
+		r.fd.Close()
+		r.fd = nil
+	}
+	if r.cgroup == "" {
+		return
+	}
+	//processes that left the process group are in the cgroup still
+	ioutil.WriteFile(filepath.Join(r.cgroup, "cgroup.kill"), []byte("1"), 0644)
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = os.Remove(r.cgroup); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	warnf("failed to remove cgroup %s: %s\n", r.cgroup, err)
+}
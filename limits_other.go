@@ -0,0 +1,39 @@
+//go:build !linux
+
+package webhook
+
+import (
+	"os/exec"
+	"sync"
+)
+
+//limitsWarning is logged once, the first time a command has limits that cannot be enforced
+var limitsWarning sync.Once
+
+//resourceLimits only limits the output of commands outside of Linux, there are no rlimits for other
+//processes and no cgroups
+type resourceLimits struct {
+	limits ConfigLimits
+}
+
+//newResourceLimits prepares a command to be started with its limits
+func newResourceLimits(limits ConfigLimits, command *exec.Cmd) (*resourceLimits, error) {
+	return &resourceLimits{limits: limits}, nil
+}
+
+//started warns that the limits besides outputsize are not enforced
+func (r *resourceLimits) started(d *Delivery) {
+	if r.limits.needsCgroup() || r.limits.CPUTime > 0 {
+		limitsWarning.Do(func() {
+			d.warnf("the cputime, cpus, memory and processes limits of commands are only enforced on Linux\n")
+		})
+	}
+}
+
+//exceeded explains the exit of a command that was killed for going over a limit, or returns ""
+func (r *resourceLimits) exceeded() string {
+	return ""
+}
+
+//release frees what enforcing the limits took
+func (r *resourceLimits) release() {}
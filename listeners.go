@@ -0,0 +1,139 @@
+package webhook
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//ConfigListener is an address the daemon listens on with the parts it serves, its own TLS settings
+//and its own access settings, which replace the global allowedips and basic auth settings
+type ConfigListener struct {
+	Address    string
+	Port       int64
+	SocketMode string
+	//Serve lists what the listener serves: webhooks, admin, metrics and health, everything by default
+	Serve             []string
+	TLSCert           string
+	TLSKey            string
+	TLSClientCA       string
+	AllowedIPs        []string
+	BasicAuthUser     string
+	BasicAuthPassword string
+}
+
+//listenerParts are the parts a listener can serve
+var listenerParts = []string{"webhooks", "admin", "metrics", "health"}
+
+//listenerKey marks the context of requests received on a configured listener
+type listenerKey struct{}
+
+//serves reports whether the listener serves a part
+func (l ConfigListener) serves(part string) bool {
+	if len(l.Serve) == 0 {
+		return true
+	}
+	for _, p := range l.Serve {
+		if p == part {
+			return true
+		}
+	}
+	return false
+}
+
+//hasAccessSettings reports whether the listener replaces the global access settings
+func (l ConfigListener) hasAccessSettings() bool {
+	return len(l.AllowedIPs) > 0 || l.BasicAuthUser != ""
+}
+
+//apply returns the config with the address, TLS and access settings of the listener
+func (l ConfigListener) apply(config Config) Config {
+	config.Address = l.Address
+	config.Port = l.Port
+	config.SocketMode = l.SocketMode
+	config.TLSCert = l.TLSCert
+	config.TLSKey = l.TLSKey
+	config.TLSClientCA = l.TLSClientCA
+	if l.hasAccessSettings() {
+		config.AllowedIPs = l.AllowedIPs
+		config.BasicAuthUser = l.BasicAuthUser
+		config.BasicAuthPassword = l.BasicAuthPassword
+	}
+	return config
+}
+
+//listeners returns the listeners of the config, the address and port settings if none are configured
+func (config Config) listeners() []ConfigListener {
+	if len(config.Listeners) > 0 {
+		return config.Listeners
+	}
+	return []ConfigListener{{
+		Address:     config.Address,
+		Port:        config.Port,
+		SocketMode:  config.SocketMode,
+		TLSCert:     config.TLSCert,
+		TLSKey:      config.TLSKey,
+		TLSClientCA: config.TLSClientCA,
+	}}
+}
+
+//listenAddress returns the address to listen on, host:port or unix:/path
+func listenAddress(config Config) string {
+	if strings.HasPrefix(config.Address, "unix:") {
+		return config.Address
+	}
+	return net.JoinHostPort(config.Address, strconv.FormatInt(config.Port, 10))
+}
+
+//accessConfig returns the config with the access settings of the listener a request was received on
+func accessConfig(config Config, r *http.Request) Config {
+	if l, ok := r.Context().Value(listenerKey{}).(ConfigListener); ok && l.hasAccessSettings() {
+		return l.apply(config)
+	}
+	return config
+}
+
+//handler returns the routes a listener serves, the requests carry the listener in their context
+func (l ConfigListener) handler(config Config) http.Handler {
+	mux := http.NewServeMux()
+	if l.serves("webhooks") {
+		mux.HandleFunc("/", hookHandler)
+		mux.HandleFunc("/trigger/", triggerHandler)
+	} else {
+		mux.HandleFunc("/", http.NotFound)
+	}
+
+	//the webhooks check the access settings of every delivery themselves, the other parts only
+	//those of the listener
+	guard := func(handler http.HandlerFunc) http.HandlerFunc {
+		if !l.hasAccessSettings() {
+			return handler
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !checkAccess(accessConfig(currentConfig(), r), w, r) {
+				return
+			}
+			handler(w, r)
+		}
+	}
+	if config.AdminAPI && l.serves("admin") {
+		mux.HandleFunc("/admin/", guard(adminHandler))
+	}
+	if config.Metrics && l.serves("metrics") {
+		mux.HandleFunc("/metrics", guard(metricsHandler))
+	}
+	if config.Health && l.serves("health") {
+		mux.HandleFunc("/healthz", guard(healthHandler))
+		mux.HandleFunc("/readyz", guard(readyHandler))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, ok := stripBasePath(currentConfig(), w, r)
+		if !ok {
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerKey{}, l)))
+	})
+}
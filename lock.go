@@ -0,0 +1,65 @@
+package webhook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//acquireLock takes an exclusive lock on the lock file so only one instance runs at a time,
+//it waits for the lock to be released when wait is set and fails otherwise
+func acquireLock(path string, wait bool) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	held, err := tryLock(file)
+	if held {
+		holder := lockHolder(file)
+		if !wait {
+			file.Close()
+			return nil, fmt.Errorf("lock file %s is held by another instance (pid %s)", path, holder)
+		}
+
+		log.Printf("waiting for lock file %s held by another instance (pid %s)\n", path, holder)
+		err = waitLock(file)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	//record our PID for the instances that are blocked by us
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		releaseLock(file)
+		return nil, err
+	}
+
+	return file, nil
+}
+
+//lockHolder returns the PID recorded in the lock file
+func lockHolder(file *os.File) string {
+	data, err := ioutil.ReadAll(file)
+	if err != nil || len(strings.TrimSpace(string(data))) == 0 {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+//releaseLock releases the lock taken by acquireLock
+func releaseLock(file *os.File) {
+	err := unlock(file)
+	if err != nil {
+		log.Println(err)
+	}
+	file.Close()
+}
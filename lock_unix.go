@@ -0,0 +1,27 @@
+//go:build !windows
+
+package webhook
+
+import (
+	"os"
+	"syscall"
+)
+
+//tryLock takes an exclusive lock on a file without waiting, it reports true if another process holds it
+func tryLock(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return true, nil
+	}
+	return false, err
+}
+
+//waitLock takes an exclusive lock on a file, waiting for other processes to release it
+func waitLock(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+//unlock releases the lock on a file
+func unlock(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
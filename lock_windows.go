@@ -0,0 +1,39 @@
+//go:build windows
+
+package webhook
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+//lockOffset is where the locked byte of lock files lies, locks on Windows keep other processes from
+//reading the locked range, so the byte is far behind the PID written to the file
+const lockOffset = 0x7fffffff
+
+//tryLock takes an exclusive lock on a file without waiting, it reports true if another process holds it
+func tryLock(file *os.File) (bool, error) {
+	err := lockFile(file, windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return true, nil
+	}
+	return false, err
+}
+
+//waitLock takes an exclusive lock on a file, waiting for other processes to release it
+func waitLock(file *os.File) error {
+	return lockFile(file, windows.LOCKFILE_EXCLUSIVE_LOCK)
+}
+
+//lockFile locks the byte at lockOffset
+func lockFile(file *os.File, flags uint32) error {
+	overlapped := &windows.Overlapped{OffsetHigh: lockOffset}
+	return windows.LockFileEx(windows.Handle(file.Fd()), flags, 0, 1, 0, overlapped)
+}
+
+//unlock releases the lock on a file
+func unlock(file *os.File) error {
+	overlapped := &windows.Overlapped{OffsetHigh: lockOffset}
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, overlapped)
+}
@@ -0,0 +1,181 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//logFieldSeparator separates the message of a log line from its fields until the line is formatted
+const logFieldSeparator = "\x1f"
+
+//logLevels are the levels of log lines from the least to the most severe
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+//levelRank returns the position of a level in logLevels, unknown levels count as info
+func levelRank(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return 1
+}
+
+//logWriter formats the lines written by the log package as text, JSON or logfmt
+//and drops the ones below the minimum level
+type logWriter struct {
+	out      io.Writer
+	format   string
+	minLevel int
+}
+
+//setupLogging sends the log to out in the format of the logformat setting
+func setupLogging(config Config, out io.Writer) {
+	format := config.LogFormat
+	switch format {
+	case "json", "logfmt":
+		//the time is added as a field
+		log.SetFlags(0)
+	default:
+		format = "text"
+		log.SetFlags(log.LstdFlags)
+	}
+	log.SetOutput(&logWriter{out: out, format: format, minLevel: levelRank(configLogLevel(config))})
+}
+
+//configLogLevel returns the minimum level of the log, the debug setting implies debug
+func configLogLevel(config Config) string {
+	if config.Debug {
+		return "debug"
+	}
+	if config.LogLevel == "" {
+		return "info"
+	}
+	return config.LogLevel
+}
+
+//Write formats a single line of the log package
+func (w *logWriter) Write(p []byte) (int, error) {
+	parts := strings.Split(strings.TrimSuffix(string(p), "\n"), logFieldSeparator)
+
+	//the level is given as a field, or by the prefix of debugf
+	level := "info"
+	if strings.Contains(parts[0], "debug: ") {
+		level = "debug"
+	}
+	var fields []string
+	for _, field := range parts[1:] {
+		if key, value := splitField(field); key == "level" {
+			level = value
+			continue
+		}
+		fields = append(fields, field)
+	}
+	if levelRank(level) < w.minLevel {
+		return len(p), nil
+	}
+
+	var line string
+	switch w.format {
+	case "json":
+		line = "{" + jsonField("time", time.Now().Format(time.RFC3339Nano)) + "," + jsonField("level", level) + "," + jsonField("msg", parts[0])
+		for _, field := range fields {
+			key, value := splitField(field)
+			line += "," + jsonField(key, value)
+		}
+		line += "}"
+	case "logfmt":
+		line = "time=" + time.Now().Format(time.RFC3339Nano) + " level=" + level + " msg=" + logfmtValue(parts[0])
+		for _, field := range fields {
+			key, value := splitField(field)
+			line += " " + key + "=" + logfmtValue(value)
+		}
+	default:
+		//info and debug lines keep their plain form
+		if level == "warn" || level == "error" {
+			fields = append(fields, "level="+level)
+		}
+		line = strings.Join(append([]string{parts[0]}, fields...), " ")
+	}
+
+	_, err := io.WriteString(w.out, line+"\n")
+	return len(p), err
+}
+
+//splitField splits a key=value field
+func splitField(field string) (string, string) {
+	i := strings.Index(field, "=")
+	if i < 0 {
+		return field, ""
+	}
+	return field[:i], field[i+1:]
+}
+
+//jsonField encodes a key and a string value as a member of a JSON object
+func jsonField(key string, value string) string {
+	k, _ := json.Marshal(key)
+	v, _ := json.Marshal(value)
+	return string(k) + ":" + string(v)
+}
+
+//logfmtValue quotes a value for logfmt if needed
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\\n\t") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+//logFields returns key value pairs to append to a log message
+func logFields(keyValues ...string) string {
+	var fields string
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		if keyValues[i+1] != "" {
+			fields += logFieldSeparator + keyValues[i] + "=" + keyValues[i+1]
+		}
+	}
+	return fields
+}
+
+//logf logs a message about the delivery, tagged with its ID and repository so the
+//lines of the commands it triggered can be correlated
+func (d *Delivery) logf(format string, v ...interface{}) {
+	d.logAt("info", format, v...)
+}
+
+//warnf logs a warning about the delivery, like a rejected signature
+func (d *Delivery) warnf(format string, v ...interface{}) {
+	d.logAt("warn", format, v...)
+}
+
+//errorf logs an error about the delivery, like a failed command
+func (d *Delivery) errorf(format string, v ...interface{}) {
+	d.logAt("error", format, v...)
+}
+
+//logAt logs a message about the delivery at a level
+func (d *Delivery) logAt(level string, format string, v ...interface{}) {
+	fullName := ""
+	if d.Repo != nil {
+		fullName = d.Repo.FullName
+	}
+	if level == "info" {
+		level = ""
+	}
+	log.Print(strings.TrimSuffix(fmt.Sprintf(format, v...), "\n") + logFields("delivery", d.ID, "repo", fullName, "level", level))
+}
+
+//warnf logs a warning that is not about a delivery
+func warnf(format string, v ...interface{}) {
+	log.Print(strings.TrimSuffix(fmt.Sprintf(format, v...), "\n") + logFields("level", "warn"))
+}
+
+//errorf logs an error that is not about a delivery
+func errorf(format string, v ...interface{}) {
+	log.Print(strings.TrimSuffix(fmt.Sprintf(format, v...), "\n") + logFields("level", "error"))
+}
@@ -0,0 +1,162 @@
+package webhook
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//logBackupFormat is appended to the name of rotated logfiles, it sorts in chronological order
+const logBackupFormat = "20060102-150405.000"
+
+//rotatingFile is a logfile that is renamed once it reaches logmaxsize megabytes, keeping at most
+//logmaxbackups rotated files that are at most logmaxage days old
+type rotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	file       *os.File
+	size       int64
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+}
+
+//nopCloser keeps closing the log from closing stdout or stderr
+type nopCloser struct {
+	io.Writer
+}
+
+//Close does nothing
+func (nopCloser) Close() error {
+	return nil
+}
+
+//logTarget returns where the log is written to: file, stdout or stderr. A logfile of - stands for stdout.
+func logTarget(config Config) string {
+	if config.LogTarget != "" {
+		return config.LogTarget
+	}
+	if config.Logfile == "-" {
+		return "stdout"
+	}
+	return "file"
+}
+
+//openLogfile opens the logfile for appending, rotating it if one of the logmax settings is given
+func openLogfile(config Config) (io.WriteCloser, error) {
+	switch logTarget(config) {
+	case "stdout":
+		return nopCloser{os.Stdout}, nil
+	case "stderr":
+		return nopCloser{os.Stderr}, nil
+	}
+
+	if config.LogMaxSize <= 0 && config.LogMaxBackups <= 0 && config.LogMaxAge <= 0 {
+		return os.OpenFile(config.Logfile, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
+	}
+
+	f := &rotatingFile{
+		path:       config.Logfile,
+		maxSize:    config.LogMaxSize * 1024 * 1024,
+		maxBackups: config.LogMaxBackups,
+		maxAge:     time.Duration(config.LogMaxAge) * 24 * time.Hour,
+	}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	f.prune()
+	return f, nil
+}
+
+//open opens the logfile and records its size
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+//Write appends to the logfile, rotating it first if the line would exceed the maximum size
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		//keep logging to the old file if it cannot be rotated
+		if err := f.rotate(); err != nil {
+			os.Stderr.WriteString("failed to rotate logfile: " + err.Error() + "\n")
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+//rotate renames the logfile with the current time and starts a new one
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	if err != nil {
+		return err
+	}
+	renameErr := os.Rename(f.path, f.path+"."+time.Now().Format(logBackupFormat))
+	err = f.open()
+	if err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	f.prune()
+	return nil
+}
+
+//prune removes the rotated logfiles beyond logmaxbackups or older than logmaxage
+func (f *rotatingFile) prune() {
+	if f.maxBackups <= 0 && f.maxAge <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	//the newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	cutoff := time.Now().Add(-f.maxAge)
+	kept := 0
+	for _, backup := range backups {
+		info, err := os.Stat(backup)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(logBackupFormat, backup[len(f.path)+1:]); err != nil {
+			//not one of ours
+			continue
+		}
+		kept++
+		tooMany := f.maxBackups > 0 && kept > f.maxBackups
+		tooOld := f.maxAge > 0 && info.ModTime().Before(cutoff)
+		if tooMany || tooOld {
+			os.Remove(backup)
+		}
+	}
+}
+
+//Close closes the logfile
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,128 @@
+package webhook
+
+import (
+	"regexp"
+)
+
+//Matcher selects the repositories of a config that a delivery triggers, it applies the name, ref,
+//event and path settings and the filters of the repositories but not their secrets
+type Matcher struct {
+	config Config
+}
+
+//Match is a repository triggered by a delivery
+type Match struct {
+	Repository ConfigRepository
+	//Delivery is the delivery as seen by the commands of the repository, with the capture groups of
+	//its commentpattern
+	Delivery *Delivery
+	Action   *ConfigAction
+	Commands []ConfigCommand
+}
+
+//NewMatcher returns the matcher of the repositories of a config
+func NewMatcher(config Config) *Matcher {
+	return &Matcher{config: config}
+}
+
+//Match returns the repositories a delivery to a URL path triggers. It also reports whether the name of
+//any repository matched and the reason why the last of those was skipped.
+func (m *Matcher) Match(d *Delivery, urlPath string) (matches []Match, found bool, skipped string) {
+	for _, repo := range m.config.Repositories {
+		if !repo.servesPath(m.config, urlPath) {
+			continue
+		}
+
+		pattern, err := regexp.Compile(repo.Name)
+		if err != nil {
+			continue
+		}
+		groups := pattern.FindStringSubmatch(d.Repo.FullName)
+		if groups == nil {
+			continue
+		}
+
+		found = true
+		//a webhook copied to the path of another repository
+		if repo.rejectsPath(m.config, d.Repo.FullName, urlPath) {
+			d.warnf("skipping repo %s: path %s does not match payload repository %s\n", repo.Name, urlPath, d.Repo.FullName)
+			skipped = "repository does not match path"
+			continue
+		}
+		//paused for maintenance from the admin API
+		if state.isDisabled(repo.Name, d.Repo.FullName) {
+			d.logf("skipping repo %s: disabled\n", repo.Name)
+			skipped = "disabled"
+			continue
+		}
+		if !repo.matchesRef(d.Ref) {
+			debugf(m.config, "ref %s does not match the refs of repo %s\n", d.Ref, repo.Name)
+			continue
+		}
+		//keep automation pushes from triggering redeploy loops
+		if reason := repo.skipReason(d); reason != "" {
+			d.logf("skipping repo %s: %s\n", repo.Name, reason)
+			skipped = reason
+			continue
+		}
+
+		//pushes that opted out of deploying
+		if token, commits := repo.skipToken(m.config); hasSkipToken(token, commits, d) {
+			d.logf("skipping repo %s: commit message contains %s\n", repo.Name, token)
+			skipped = "skip token"
+			continue
+		}
+
+		//ChatOps commands in comments, with their arguments as capture groups
+		matched, reason := repo.matchComment(withRepoMatch(d, pattern, groups))
+		if reason != "" {
+			debugf(m.config, "skipping repo %s: %s\n", repo.Name, reason)
+			skipped = reason
+			continue
+		}
+
+		//conditional logic of power users, with the last word on the delivery
+		scripted, err := repo.runScript(matched)
+		if err != nil {
+			d.errorf("skipping repo %s: script failed: %s\n", repo.Name, err)
+			skipped = "script failed"
+			continue
+		}
+		if scripted.skip != "" {
+			d.logf("skipping repo %s: %s\n", repo.Name, scripted.skip)
+			skipped = scripted.skip
+			continue
+		}
+		matched = scripted.delivery
+
+		commands := repo.commandsFor(d)
+		if scripted.commandSet != "" {
+			commands = repo.CommandSets[scripted.commandSet]
+		}
+		action := repo.actionFor(d)
+		if len(commands) == 0 && len(repo.Forward) == 0 && len(repo.Publish) == 0 && action == nil {
+			continue
+		}
+		matches = append(matches, Match{Repository: repo, Delivery: matched, Action: action, Commands: commands})
+	}
+	return matches, found, skipped
+}
+
+//withRepoMatch returns the delivery with the capture groups of the name of a repository, a name like
+//org/(.*)-deploy lets one repository of the config handle a family of repositories
+func withRepoMatch(d *Delivery, pattern *regexp.Regexp, groups []string) *Delivery {
+	if len(groups) < 2 {
+		return d
+	}
+
+	//the delivery is shared with the other repositories, the match belongs to this one only
+	matched := *d
+	matched.RepoMatch = groups
+	matched.RepoGroups = make(map[string]string)
+	for i, name := range pattern.SubexpNames() {
+		if name != "" {
+			matched.RepoGroups[name] = groups[i]
+		}
+	}
+	return &matched
+}
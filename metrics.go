@@ -0,0 +1,188 @@
+package webhook
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//durationBuckets are the upper bounds in seconds of the command duration histogram
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800}
+
+//histogram counts observations in cumulative buckets like a Prometheus histogram
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+//observe adds a value to the histogram
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+//metricsRegistry holds the counters exported on /metrics
+type metricsRegistry struct {
+	mutex      sync.Mutex
+	deliveries map[[2]string]uint64
+	commands   map[string]uint64
+	failures   map[string]uint64
+	durations  map[string]*histogram
+}
+
+var metrics = &metricsRegistry{
+	deliveries: make(map[[2]string]uint64),
+	commands:   make(map[string]uint64),
+	failures:   make(map[string]uint64),
+	durations:  make(map[string]*histogram),
+}
+
+//observeDelivery counts a received delivery
+func (m *metricsRegistry) observeDelivery(event string, repository string) {
+	m.mutex.Lock()
+	m.deliveries[[2]string{event, repository}]++
+	m.mutex.Unlock()
+}
+
+//observeResults counts the executed commands of a repository
+func (m *metricsRegistry) observeResults(repository string, results []Result) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, result := range results {
+		m.commands[repository]++
+		if result.Err != nil {
+			m.failures[repository]++
+		}
+		h, ok := m.durations[repository]
+		if !ok {
+			h = &histogram{}
+			m.durations[repository] = h
+		}
+		h.observe(result.Duration.Seconds())
+	}
+}
+
+//write writes the metrics in the Prometheus text exposition format
+func (m *metricsRegistry) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP gitea_webhook_deliveries_total Webhook deliveries received.")
+	fmt.Fprintln(w, "# TYPE gitea_webhook_deliveries_total counter")
+	keys := make([][2]string, 0, len(m.deliveries))
+	for key := range m.deliveries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "gitea_webhook_deliveries_total{event=\"%s\",repository=\"%s\"} %d\n", escapeLabel(key[0]), escapeLabel(key[1]), m.deliveries[key])
+	}
+
+	writeCounter(w, "gitea_webhook_commands_total", "Commands executed.", m.commands)
+	writeCounter(w, "gitea_webhook_command_failures_total", "Commands that failed, timed out or could not be started.", m.failures)
+
+	fmt.Fprintln(w, "# HELP gitea_webhook_command_duration_seconds Duration of the executed commands.")
+	fmt.Fprintln(w, "# TYPE gitea_webhook_command_duration_seconds histogram")
+	for _, repository := range sortedKeys(m.durations) {
+		h := m.durations[repository]
+		label := escapeLabel(repository)
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "gitea_webhook_command_duration_seconds_bucket{repository=\"%s\",le=\"%g\"} %d\n", label, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "gitea_webhook_command_duration_seconds_bucket{repository=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "gitea_webhook_command_duration_seconds_sum{repository=\"%s\"} %g\n", label, h.sum)
+		fmt.Fprintf(w, "gitea_webhook_command_duration_seconds_count{repository=\"%s\"} %d\n", label, h.count)
+	}
+
+	if queue != nil {
+		depth, running := queue.depth(), queue.runningJobs()
+		total := 0
+		classes := map[string]bool{defaultJobClass: true}
+		for _, class := range currentConfig().JobClasses {
+			classes[class.Name] = true
+		}
+		for class, count := range depth {
+			total += count
+			classes[class] = true
+		}
+		for class := range running {
+			classes[class] = true
+		}
+		names := make([]string, 0, len(classes))
+		for class := range classes {
+			names = append(names, class)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintln(w, "# HELP gitea_webhook_queue_depth Jobs waiting in the queue.")
+		fmt.Fprintln(w, "# TYPE gitea_webhook_queue_depth gauge")
+		fmt.Fprintf(w, "gitea_webhook_queue_depth %d\n", total)
+		fmt.Fprintln(w, "# HELP gitea_webhook_queue_capacity Jobs the queue can hold.")
+		fmt.Fprintln(w, "# TYPE gitea_webhook_queue_capacity gauge")
+		fmt.Fprintf(w, "gitea_webhook_queue_capacity %d\n", queue.size)
+		fmt.Fprintln(w, "# HELP gitea_webhook_class_queued Jobs waiting in the queue by job class.")
+		fmt.Fprintln(w, "# TYPE gitea_webhook_class_queued gauge")
+		for _, class := range names {
+			fmt.Fprintf(w, "gitea_webhook_class_queued{class=\"%s\"} %d\n", escapeLabel(class), depth[class])
+		}
+		fmt.Fprintln(w, "# HELP gitea_webhook_class_running Running jobs by job class.")
+		fmt.Fprintln(w, "# TYPE gitea_webhook_class_running gauge")
+		for _, class := range names {
+			fmt.Fprintf(w, "gitea_webhook_class_running{class=\"%s\"} %d\n", escapeLabel(class), running[class])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP gitea_webhook_uptime_seconds Seconds since the daemon started.")
+	fmt.Fprintln(w, "# TYPE gitea_webhook_uptime_seconds gauge")
+	fmt.Fprintf(w, "gitea_webhook_uptime_seconds %g\n", time.Since(state.started).Seconds())
+}
+
+//writeCounter writes a counter labeled by repository
+func writeCounter(w io.Writer, name string, help string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{repository=\"%s\"} %d\n", name, escapeLabel(key), values[key])
+	}
+}
+
+//sortedKeys returns the repositories of the duration histograms in order
+func sortedKeys(durations map[string]*histogram) []string {
+	keys := make([]string, 0, len(durations))
+	for key := range durations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//escapeLabel escapes a label value for the text exposition format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.write(w)
+}
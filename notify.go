@@ -0,0 +1,244 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//notifyTimeout is the time sending a notification may take
+const notifyTimeout = 10 * time.Second
+
+//maxNotifiedOutput is the number of bytes of the output of a failed command included in a notification
+const maxNotifiedOutput = 1000
+
+//ConfigNotification is a destination for messages about failed and recovered jobs of a repository
+type ConfigNotification struct {
+	//Type is "slack", "matrix" or "email"
+	Type string
+	//URL is the incoming webhook URL for Slack, and the homeserver URL for Matrix
+	URL string
+	//Room and Token are the room ID and the access token for Matrix
+	Room  string
+	Token string
+	//SMTP is the host:port of the mail server, Username and Password are used for authentication if set
+	SMTP     string
+	Username string
+	Password string
+	From     string
+	To       []string
+	//On is "failure" (default) to notify failures and recoveries, or "always" to notify every run
+	On string
+}
+
+//jobOutcomes remembers whether the last job of a repository failed, to notify recoveries
+type jobOutcomes struct {
+	mutex  sync.Mutex
+	failed map[string]bool
+}
+
+var outcomes = &jobOutcomes{failed: make(map[string]bool)}
+
+//record stores the outcome of a job and returns the previous one
+func (o *jobOutcomes) record(j *job, failed bool) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	key := j.repo.Name + "\x00" + j.delivery.Repo.FullName
+	previous := o.failed[key]
+	o.failed[key] = failed
+	return previous
+}
+
+//notify sends the notifications of the repository about the results of the job
+func (j *job) notify(results []Result) {
+	if len(results) == 0 {
+		return
+	}
+
+	var failed *Result
+	for i := range results {
+		if results[i].Err != nil {
+			failed = &results[i]
+			break
+		}
+	}
+	recovered := outcomes.record(j, failed != nil) && failed == nil
+	if len(j.repo.Notify) == 0 {
+		return
+	}
+
+	subject, message := j.notification(failed, recovered)
+	for _, target := range j.repo.Notify {
+		if failed == nil && !recovered && target.On != "always" {
+			continue
+		}
+		if isDryRun(j.repo) {
+			j.delivery.logf("dry run: would send %s notification: %s\n", target.Type, subject)
+			continue
+		}
+
+		err := sendNotification(target, subject, message)
+		if err != nil {
+			j.delivery.errorf("failed to send %s notification for %s: %s\n", target.Type, j.delivery.Repo.FullName, err)
+		}
+	}
+}
+
+//notification returns the subject and the text of the message about the results of the job
+func (j *job) notification(failed *Result, recovered bool) (string, string) {
+	d := j.delivery
+	subject := d.Event + " of " + d.Repo.FullName
+	switch {
+	case failed != nil:
+		subject += " failed"
+	case recovered:
+		subject += " recovered"
+	default:
+		subject += " succeeded"
+	}
+
+	var text strings.Builder
+	text.WriteString(subject + "\n")
+	if d.Ref != "" {
+		text.WriteString("Ref: " + d.Ref + "\n")
+	}
+	if d.Pusher != nil {
+		text.WriteString("Pushed by: " + d.Pusher.UserName + "\n")
+	} else if d.Sender != nil {
+		text.WriteString("Sent by: " + d.Sender.UserName + "\n")
+	}
+	if failed != nil {
+		text.WriteString("Command: " + failed.Command + "\n")
+		text.WriteString("Exit code: " + strconv.Itoa(failed.ExitCode) + "\n")
+		output := failed.Output
+		if len(output) > maxNotifiedOutput {
+			output = output[len(output)-maxNotifiedOutput:]
+		}
+		if len(bytes.TrimSpace(output)) > 0 {
+			text.WriteString("Output:\n" + strings.TrimRight(string(output), "\n") + "\n")
+		}
+	}
+	return subject, text.String()
+}
+
+//sendNotification sends a message to a notification target
+func sendNotification(target ConfigNotification, subject string, message string) error {
+	switch target.Type {
+	case "slack":
+		return postNotification(http.MethodPost, target.URL, "", map[string]string{"text": message})
+	case "matrix":
+		//the transaction ID makes retries of the same request idempotent
+		txn := strconv.FormatInt(time.Now().UnixNano(), 10)
+		endpoint := strings.TrimSuffix(target.URL, "/") + "/_matrix/client/r0/rooms/" + url.PathEscape(target.Room) + "/send/m.room.message/" + txn
+		return postNotification(http.MethodPut, endpoint, target.Token, map[string]string{"msgtype": "m.text", "body": message})
+	case "email":
+		return sendMail(target, subject, message)
+	}
+	return fmt.Errorf("unknown notification type %s", target.Type)
+}
+
+//postNotification sends a JSON message to a chat service
+func postNotification(method string, endpoint string, token string, message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", endpoint, response.Status)
+	}
+	return nil
+}
+
+//sendMail sends the message through the SMTP server of the target
+func sendMail(target ConfigNotification, subject string, message string) error {
+	host, _, err := net.SplitHostPort(target.SMTP)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if target.Username != "" {
+		auth = smtp.PlainAuth("", target.Username, target.Password, host)
+	}
+
+	var mail strings.Builder
+	mail.WriteString("From: " + target.From + "\r\n")
+	mail.WriteString("To: " + strings.Join(target.To, ", ") + "\r\n")
+	mail.WriteString("Subject: " + subject + "\r\n")
+	mail.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	mail.WriteString(strings.Replace(message, "\n", "\r\n", -1))
+
+	//smtp.SendMail has no timeout, a hanging mail server would block the worker
+	conn, err := net.DialTimeout("tcp", target.SMTP, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		err = client.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(target.From)
+	if err != nil {
+		return err
+	}
+	for _, to := range target.To {
+		err = client.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(mail.String()))
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,81 @@
+package webhook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//shells are the programs that interpret their arguments as a script, payload data passed to them
+//could run anything
+var shells = map[string]bool{
+	"sh": true, "bash": true, "dash": true, "zsh": true, "ksh": true, "mksh": true, "ash": true,
+	"fish": true, "csh": true, "tcsh": true, "busybox": true, "cmd": true, "powershell": true, "pwsh": true,
+}
+
+//isShell reports whether a program is a shell, by its name
+func isShell(program string) bool {
+	name := strings.ToLower(filepath.Base(program))
+	return shells[strings.TrimSuffix(name, ".exe")]
+}
+
+//allowedProgram applies the execution policy to the program of a command: it has to be in one of
+//the commanddirs, where relative programs are looked up instead of the PATH, and it cannot be a
+//shell unless the repository has allowshell
+func allowedProgram(config Config, repo ConfigRepository, program string) (string, error) {
+	if len(config.CommandDirs) > 0 {
+		resolved, err := inCommandDirs(config.CommandDirs, program)
+		if err != nil {
+			return "", err
+		}
+		program = resolved
+	}
+	if isShell(program) && !repo.AllowShell {
+		return "", fmt.Errorf("%s is a shell and would run payload data as a script, set allowshell on %s to run it anyway", program, repo.Name)
+	}
+	return program, nil
+}
+
+//inCommandDirs returns the program within the first of the directories that has it
+func inCommandDirs(dirs []string, program string) (string, error) {
+	if filepath.IsAbs(program) {
+		program = filepath.Clean(program)
+		for _, dir := range dirs {
+			if strings.HasPrefix(program, filepath.Clean(dir)+string(filepath.Separator)) {
+				return program, nil
+			}
+		}
+		return "", fmt.Errorf("%s is not in the commanddirs %s", program, strings.Join(dirs, ", "))
+	}
+
+	for _, dir := range dirs {
+		candidate := filepath.Join(dir, program)
+		if !strings.HasPrefix(candidate, filepath.Clean(dir)+string(filepath.Separator)) {
+			continue
+		}
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not in the commanddirs %s", program, strings.Join(dirs, ", "))
+}
+
+//checkCommandPolicy reports the commands of a repository (or schedule) that the execution policy
+//refuses, templated commands are only checked when they run
+func checkCommandPolicy(problem func(format string, v ...interface{}), config Config, repo ConfigRepository, kind string) {
+	for _, list := range commandLists(repo) {
+		for _, cmd := range list {
+			if cmd.Command == "" || isTemplate(cmd.Command) {
+				continue
+			}
+			//relative programs may be installed after the config was written
+			if !filepath.IsAbs(cmd.Command) && !isShell(cmd.Command) {
+				continue
+			}
+			if _, err := allowedProgram(config, repo, cmd.Command); err != nil {
+				problem("command of %s %s: %s", kind, repo.Name, err)
+			}
+		}
+	}
+}
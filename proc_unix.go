@@ -0,0 +1,86 @@
+//go:build !windows
+
+package webhook
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//processGroup is the process group a command leads, so its children can be killed with it
+type processGroup struct {
+	command *exec.Cmd
+}
+
+//newProcessGroup makes the command the leader of a new process group when it is started
+func newProcessGroup(command *exec.Cmd) *processGroup {
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return &processGroup{command: command}
+}
+
+//started is called once the command was started, the process group exists already
+func (g *processGroup) started() {}
+
+//kill kills the process group of a started command, including children that outlived it
+func (g *processGroup) kill() {
+	err := syscall.Kill(-g.command.Process.Pid, syscall.SIGKILL)
+	if err != nil && err != syscall.ESRCH {
+		warnf("failed to kill process group of %s: %s\n", g.command.Path, err)
+	}
+}
+
+//setRunAs makes the command run as a user, given as a user name or as uid[:gid]. The
+//supplementary groups are those of the user in the first form and dropped in the second.
+func setRunAs(command *exec.Cmd, runAs string) error {
+	credential, err := lookupCredential(runAs)
+	if err != nil {
+		return err
+	}
+	command.SysProcAttr.Credential = credential
+	return nil
+}
+
+//lookupCredential resolves the user (and group) a command runs as
+func lookupCredential(runAs string) (*syscall.Credential, error) {
+	ids := strings.SplitN(runAs, ":", 2)
+	if uid, err := strconv.ParseUint(ids[0], 10, 32); err == nil {
+		gid := uid
+		if len(ids) == 2 {
+			gid, err = strconv.ParseUint(ids[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid gid in runas %s", runAs)
+			}
+		}
+		return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}, nil
+	}
+
+	u, err := user.Lookup(runAs)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}
+
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		id, err := strconv.ParseUint(group, 10, 32)
+		if err == nil {
+			credential.Groups = append(credential.Groups, uint32(id))
+		}
+	}
+	return credential, nil
+}
@@ -0,0 +1,68 @@
+//go:build !windows
+
+package webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//processAlive reports whether a process exists and is not a zombie waiting for a parent to reap it
+func processAlive(pid int) bool {
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return false
+	}
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		//without procfs the signal reaching the process is all there is to know
+		return runtime.GOOS != "linux" || !os.IsNotExist(err)
+	}
+	//the state follows the command name in parentheses
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
+
+func TestTimeoutKillsForkedChildren(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "fork.sh")
+	pidFile := filepath.Join(dir, "child.pid")
+	//the payload is the argument of the script, the file the child writes its process ID to
+	err := ioutil.WriteFile(script, []byte("#!/bin/sh\nsleep 60 &\necho $! > \"$1\"\nwait\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := ConfigRepository{Name: "org/app", Timeout: 1}
+	d := &Delivery{ID: "test", Event: "push", Repo: &api.Repository{FullName: "org/app"}}
+	result := runCommand(context.Background(), Config{}, repo, ConfigCommand{Command: script}, d, []byte(pidFile), os.Environ(), nil)
+	if result.ExitCode != exitCodeTimeout {
+		t.Fatalf("exit code %d, want %d: %v", result.ExitCode, exitCodeTimeout, result.Err)
+	}
+
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("the script did not start its child: %s", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the child was killed with the process group, it may take a moment to be reaped
+	for deadline := time.Now().Add(5 * time.Second); processAlive(pid); {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("child %d of the script survived the timeout", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
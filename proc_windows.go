@@ -0,0 +1,79 @@
+//go:build windows
+
+package webhook
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+//processGroup is the job object a command runs in, Windows has no process groups that can be killed
+//as a whole, but a job object takes the children of the command along
+type processGroup struct {
+	command *exec.Cmd
+	job     windows.Handle
+	killed  bool
+}
+
+//newProcessGroup prepares a command to be assigned to a job object when it is started
+func newProcessGroup(command *exec.Cmd) *processGroup {
+	command.SysProcAttr = &syscall.SysProcAttr{CreationFlags: windows.CREATE_NEW_PROCESS_GROUP}
+	return &processGroup{command: command}
+}
+
+//started assigns the started command to a new job object, all processes of the job are killed
+//when it is closed. Without a job object only the command itself can be killed.
+func (g *processGroup) started() {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		warnf("failed to create job object for %s: %s\n", g.command.Path, err)
+		return
+	}
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	_, err = windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	if err == nil {
+		var process windows.Handle
+		process, err = windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(g.command.Process.Pid))
+		if err == nil {
+			err = windows.AssignProcessToJobObject(job, process)
+			windows.CloseHandle(process)
+		}
+	}
+	if err != nil {
+		warnf("failed to assign %s to a job object: %s\n", g.command.Path, err)
+		windows.CloseHandle(job)
+		return
+	}
+	g.job = job
+}
+
+//kill kills the processes of the job object of a started command, including children that outlived it
+func (g *processGroup) kill() {
+	if g.killed {
+		return
+	}
+	g.killed = true
+	if g.job == 0 {
+		err := g.command.Process.Kill()
+		if err != nil && !errors.Is(err, os.ErrProcessDone) {
+			warnf("failed to kill %s: %s\n", g.command.Path, err)
+		}
+		return
+	}
+	err := windows.TerminateJobObject(g.job, uint32(exitCodeCancelled))
+	if err != nil {
+		warnf("failed to kill job object of %s: %s\n", g.command.Path, err)
+	}
+	windows.CloseHandle(g.job)
+}
+
+//setRunAs is not supported on Windows, the commands run as the user of the service
+func setRunAs(command *exec.Cmd, runAs string) error {
+	return errors.New("runas is not supported on Windows")
+}
@@ -0,0 +1,299 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//provider is a webhook format that can be received, detected by its event header.
+//Its payloads are normalized into a delivery so matching and execution work the same for every provider.
+type provider struct {
+	name         string
+	eventHeaders []string
+	//normalize maps the event names of the provider to the ones used in the config
+	normalize func(event string) string
+	parsers   map[string]func(config Config, data []byte) (*Delivery, error)
+}
+
+//providers lists the supported webhook formats in the order they are detected
+var providers = []*provider{
+	{
+		name:         "gitea",
+		eventHeaders: []string{"X-Gitea-Event"},
+		normalize:    normalizeEvent,
+		parsers:      events,
+	},
+	//Gitea sends the Gogs headers as well, only Gogs itself sends nothing but them
+	{
+		name:         "gogs",
+		eventHeaders: []string{"X-Gogs-Event"},
+		normalize:    func(event string) string { return event },
+		parsers: map[string]func(config Config, data []byte) (*Delivery, error){
+			"push":          parseGogsPush,
+			"create":        parseGogsRef,
+			"delete":        parseGogsRef,
+			"fork":          gogsUsers(parseFork),
+			"issues":        gogsUsers(parseIssues),
+			"issue_comment": gogsUsers(parseIssueComment),
+			"pull_request":  parseGogsPullRequest,
+			"release":       gogsUsers(parseRelease),
+		},
+	},
+	{
+		name:         "github",
+		eventHeaders: []string{"X-GitHub-Event"},
+		normalize:    func(event string) string { return event },
+		parsers: map[string]func(config Config, data []byte) (*Delivery, error){
+			"push":          parseGitHubPush,
+			"create":        parseCreate,
+			"delete":        parseDelete,
+			"fork":          parseFork,
+			"issues":        parseIssues,
+			"issue_comment": parseIssueComment,
+			"pull_request":  parsePullRequest,
+			"release":       parseRelease,
+			"repository":    parseRepository,
+		},
+	},
+	{
+		name:         "gitlab",
+		eventHeaders: []string{"X-Gitlab-Event"},
+		normalize:    normalizeGitLabEvent,
+		parsers: map[string]func(config Config, data []byte) (*Delivery, error){
+			"push":         parseGitLabPush,
+			"pull_request": parseGitLabMergeRequest,
+		},
+	},
+}
+
+//detectProvider returns the provider of a request and its normalized event
+func detectProvider(header http.Header) (*provider, string) {
+	for _, p := range providers {
+		for _, name := range p.eventHeaders {
+			if event := header.Get(name); event != "" {
+				return p, p.normalize(event)
+			}
+		}
+	}
+	return nil, ""
+}
+
+//isProviderHeader reports whether a header is one of the webhook headers forwarded with a delivery.
+//The GitLab token is the secret of the original hook and is never forwarded.
+func isProviderHeader(canonical string) bool {
+	if canonical == "X-Gitlab-Token" {
+		return false
+	}
+	for _, prefix := range []string{"X-Gitea-", "X-Gogs-", "X-Github-", "X-Gitlab-"} {
+		if strings.HasPrefix(canonical, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+//supports reports whether deliveries of the event can be parsed
+func (p *provider) supports(event string) bool {
+	_, ok := p.parsers[event]
+	return ok
+}
+
+//parseDelivery unmarshals the payload of an event
+func (p *provider) parseDelivery(config Config, event string, data []byte) (*Delivery, error) {
+	parse, ok := p.parsers[event]
+	if !ok {
+		return nil, errors.New("unsupported event " + event)
+	}
+
+	d, err := parse(config, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Repo == nil {
+		return nil, errors.New("payload has no repository")
+	}
+	d.Event = event
+	d.Provider = p.name
+	d.raw = data
+	return d, nil
+}
+
+//parseGitHubPush parses a GitHub push, which only differs from Gitea in the pusher and the compare URL
+func parseGitHubPush(config Config, data []byte) (*Delivery, error) {
+	d, err := parsePush(config, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var hook struct {
+		Compare string `json:"compare"`
+		Pusher  struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		} `json:"pusher"`
+	}
+	err = unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+	if d.CompareURL == "" {
+		d.CompareURL = hook.Compare
+	}
+	if hook.Pusher.Name != "" {
+		d.Pusher = &api.User{UserName: hook.Pusher.Name, Email: hook.Pusher.Email}
+	}
+	return d, nil
+}
+
+//normalizeGitLabEvent maps the event names of GitLab to the ones of Gitea
+func normalizeGitLabEvent(event string) string {
+	switch event {
+	case "Push Hook", "Tag Push Hook":
+		return "push"
+	case "Merge Request Hook":
+		return "pull_request"
+	}
+	return event
+}
+
+//gitLabProject is the project of a GitLab payload
+type gitLabProject struct {
+	Name              string `json:"name"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	Namespace         string `json:"namespace"`
+	WebURL            string `json:"web_url"`
+	HTTPURL           string `json:"git_http_url"`
+	SSHURL            string `json:"git_ssh_url"`
+}
+
+//repository converts the project to the repository of a delivery
+func (p *gitLabProject) repository() *api.Repository {
+	if p == nil {
+		return nil
+	}
+	owner := p.Namespace
+	if i := strings.LastIndex(p.PathWithNamespace, "/"); i >= 0 {
+		owner = p.PathWithNamespace[:i]
+	}
+	return &api.Repository{
+		Name:     p.Name,
+		FullName: p.PathWithNamespace,
+		Owner:    &api.User{UserName: owner},
+		HTMLURL:  p.WebURL,
+		CloneURL: p.HTTPURL,
+		SSHURL:   p.SSHURL,
+	}
+}
+
+func parseGitLabPush(config Config, data []byte) (*Delivery, error) {
+	var hook struct {
+		Ref          string         `json:"ref"`
+		Before       string         `json:"before"`
+		After        string         `json:"after"`
+		UserName     string         `json:"user_name"`
+		UserUsername string         `json:"user_username"`
+		UserEmail    string         `json:"user_email"`
+		Project      *gitLabProject `json:"project"`
+		Commits      []struct {
+			ID       string           `json:"id"`
+			Message  string           `json:"message"`
+			URL      string           `json:"url"`
+			Author   *api.PayloadUser `json:"author"`
+			Added    []string         `json:"added"`
+			Removed  []string         `json:"removed"`
+			Modified []string         `json:"modified"`
+		} `json:"commits"`
+		TotalCommits int `json:"total_commits_count"`
+	}
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &api.User{UserName: hook.UserUsername, FullName: hook.UserName, Email: hook.UserEmail}
+	d := &Delivery{
+		Repo:         hook.Project.repository(),
+		Sender:       user,
+		Pusher:       user,
+		Ref:          hook.Ref,
+		Before:       hook.Before,
+		After:        hook.After,
+		TotalCommits: hook.TotalCommits,
+	}
+	for _, c := range hook.Commits {
+		commit := &api.PayloadCommit{ID: c.ID, Message: c.Message, URL: c.URL, Author: c.Author, Added: c.Added, Removed: c.Removed, Modified: c.Modified}
+		d.Commits = append(d.Commits, commit)
+		if c.ID == hook.After {
+			d.HeadCommit = commit
+		}
+	}
+	d.Env = []string{
+		"GITEA_COMMIT_COUNT=" + strconv.Itoa(len(d.Commits)),
+		"GITEA_TOTAL_COMMITS=" + strconv.Itoa(d.TotalCommits),
+	}
+	return d, nil
+}
+
+//gitLabActions maps the merge request actions of GitLab to the pull request actions of Gitea
+var gitLabActions = map[string]string{
+	"open":   "opened",
+	"close":  "closed",
+	"reopen": "reopened",
+	"update": "synchronized",
+	"merge":  "merged",
+}
+
+func parseGitLabMergeRequest(config Config, data []byte) (*Delivery, error) {
+	var hook struct {
+		User *struct {
+			Name     string `json:"name"`
+			Username string `json:"username"`
+		} `json:"user"`
+		Project          *gitLabProject `json:"project"`
+		ObjectAttributes *struct {
+			IID          int64  `json:"iid"`
+			Title        string `json:"title"`
+			URL          string `json:"url"`
+			Action       string `json:"action"`
+			SourceBranch string `json:"source_branch"`
+			TargetBranch string `json:"target_branch"`
+			LastCommit   struct {
+				ID string `json:"id"`
+			} `json:"last_commit"`
+		} `json:"object_attributes"`
+	}
+	err := unmarshalPayload(config, data, &hook)
+	if err != nil {
+		return nil, err
+	}
+	if hook.ObjectAttributes == nil {
+		return nil, errors.New("payload has no merge request")
+	}
+
+	mr := hook.ObjectAttributes
+	action, ok := gitLabActions[mr.Action]
+	if !ok {
+		action = mr.Action
+	}
+	d := &Delivery{
+		Action: action,
+		Repo:   hook.Project.repository(),
+		Ref:    fullRef(mr.SourceBranch, "branch"),
+		PullRequest: &api.PullRequest{
+			Index:   mr.IID,
+			Title:   mr.Title,
+			HTMLURL: mr.URL,
+			Head:    &api.PRBranchInfo{Ref: mr.SourceBranch, Sha: mr.LastCommit.ID},
+			Base:    &api.PRBranchInfo{Ref: mr.TargetBranch},
+		},
+	}
+	if hook.User != nil {
+		d.Sender = &api.User{UserName: hook.User.Username, FullName: hook.User.Name}
+	}
+	return d, nil
+}
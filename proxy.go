@@ -0,0 +1,76 @@
+package webhook
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//basePath returns the basepath of a config without the trailing slash, "" when the daemon is
+//served at the root
+func (config Config) basePath() string {
+	return strings.TrimRight(config.BasePath, "/")
+}
+
+//stripBasePath returns the request with the basepath of the config removed from its path, so the
+//handlers and the paths of the repositories see the same paths as without one. Requests outside of
+//the basepath are answered with 404 Not Found.
+func stripBasePath(config Config, w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	base := config.basePath()
+	if base == "" {
+		return r, true
+	}
+	rest := strings.TrimPrefix(r.URL.Path, base)
+	if len(rest) == len(r.URL.Path) || rest != "" && rest[0] != '/' {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+
+	stripped := new(http.Request)
+	*stripped = *r
+	stripped.URL = new(url.URL)
+	*stripped.URL = *r.URL
+	stripped.URL.Path = rest
+	stripped.URL.RawPath = ""
+	return stripped, true
+}
+
+//fromTrustedProxy reports whether a request was received from a trusted proxy, whose X-Forwarded
+//headers describe the original request
+func fromTrustedProxy(config Config, r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		//UNIX domain socket
+		return true
+	}
+	proxies, _ := parseNetworks(config.TrustedProxies)
+	return containsIP(proxies, ip)
+}
+
+//externalURL returns the URL the client reached the daemon at, with the basepath and without a
+//trailing slash, like https://example.com/hooks. Behind trusted proxies the scheme and host are
+//taken from X-Forwarded-Proto and X-Forwarded-Host.
+func externalURL(config Config, r *http.Request) string {
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if fromTrustedProxy(config, r) {
+		//the first proxy is the one the client talked to
+		if proto := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwarded := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Host"), ",")[0]); forwarded != "" {
+			host = forwarded
+		}
+	}
+	return scheme + "://" + host + config.basePath()
+}
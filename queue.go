@@ -0,0 +1,223 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+//defaultWorkers and defaultQueueSize are used when workers and queuesize are not configured
+const (
+	defaultWorkers   = 1
+	defaultQueueSize = 100
+)
+
+//workQueue runs jobs in the background with a fixed number of workers. The waiting jobs are run by
+//the priority of their class and in the order they were queued, unless their class has as many jobs
+//running as its concurrency allows.
+type workQueue struct {
+	mutex sync.Mutex
+	//changed is signalled when jobs are queued or finish and when the queue is closed
+	changed *sync.Cond
+	closed  bool
+	waiting []*job
+	size    int
+	//running counts the running jobs by class
+	running map[string]int
+	workers sync.WaitGroup
+	//ctx is cancelled to kill the running commands
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var queue *workQueue
+
+//startQueue starts the workers of a new queue holding up to size waiting jobs
+func startQueue(workers int, size int) *workQueue {
+	q := &workQueue{size: size, running: make(map[string]int)}
+	q.changed = sync.NewCond(&q.mutex)
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go q.work()
+	}
+	log.Printf("started %d workers with a queue of %d jobs\n", workers, size)
+	return q
+}
+
+//next waits for the next job that may run and counts it as running, it returns nil once the queue
+//is closed and empty
+func (q *workQueue) next() *job {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		best := -1
+		var bestClass ConfigJobClass
+		for i, j := range q.waiting {
+			class := j.config.jobClass(j.repo)
+			if class.Concurrency > 0 && q.running[class.Name] >= class.Concurrency {
+				continue
+			}
+			if best < 0 || class.Priority > bestClass.Priority {
+				best, bestClass = i, class
+			}
+		}
+		if best >= 0 {
+			j := q.waiting[best]
+			q.waiting = append(q.waiting[:best], q.waiting[best+1:]...)
+			q.running[bestClass.Name]++
+			//room for the jobs pushed while the queue was full
+			q.changed.Broadcast()
+			return j
+		}
+		if q.closed && len(q.waiting) == 0 {
+			return nil
+		}
+		q.changed.Wait()
+	}
+}
+
+//done counts a job of next as finished
+func (q *workQueue) done(j *job) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	class := j.config.jobClass(j.repo)
+	q.running[class.Name]--
+	if q.running[class.Name] <= 0 {
+		delete(q.running, class.Name)
+	}
+	q.changed.Broadcast()
+}
+
+//work runs queued jobs until the queue is closed
+func (q *workQueue) work() {
+	defer q.workers.Done()
+	for j := q.next(); j != nil; j = q.next() {
+		ctx, ok := deploys.acquire(q.ctx, j)
+		if !ok {
+			journal.remove(j)
+			q.done(j)
+			continue
+		}
+		journal.start(j)
+		runJob(ctx, j)
+		deploys.release(j)
+		//jobs killed by a shutdown are resumed on the next start
+		if q.ctx.Err() == nil || j.repo.OnRestart != "resume" {
+			journal.remove(j)
+		}
+		q.done(j)
+	}
+}
+
+//runJob runs a job, a panic fails the job instead of killing the worker and the daemon with it
+func runJob(ctx context.Context, j *job) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			j.delivery.errorf("panic while running the job for %s: %v\n%s", j.delivery.Repo.FullName, recovered, debug.Stack())
+			state.recordResults(j.info, j.repo.Name, []Result{{Command: "job", ExitCode: exitCodeStartError, Started: time.Now(), Err: fmt.Errorf("panic: %v", recovered)}})
+		}
+	}()
+	j.run(ctx)
+}
+
+//enqueue queues a job admitted by deploys unless the queue is full
+func (q *workQueue) enqueue(j *job) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		j.delivery.logf("shutting down, dropping %s for %s\n", j.delivery.Event, j.delivery.Repo.FullName)
+		deploys.drop(j)
+		return false
+	}
+	if len(q.waiting) >= q.size {
+		j.delivery.warnf("queue full, dropping %s for %s\n", j.delivery.Event, j.delivery.Repo.FullName)
+		deploys.drop(j)
+		return false
+	}
+	q.waiting = append(q.waiting, j)
+	journal.add(j)
+	q.changed.Broadcast()
+	return true
+}
+
+//push queues a deferred job if deploys admits it, waiting for room in the queue if needed
+func (q *workQueue) push(j *job) {
+	if !deploys.admit(j) {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for !q.closed && len(q.waiting) >= q.size {
+		q.changed.Wait()
+	}
+	if q.closed {
+		j.delivery.logf("shutting down, dropping %s for %s\n", j.delivery.Event, j.delivery.Repo.FullName)
+		deploys.drop(j)
+		return
+	}
+	q.waiting = append(q.waiting, j)
+	journal.add(j)
+	q.changed.Broadcast()
+}
+
+//notReady returns why no jobs can be queued, or an empty string
+func (q *workQueue) notReady() string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return "shutting down"
+	}
+	if len(q.waiting) >= q.size {
+		return "queue full"
+	}
+	return ""
+}
+
+//depth returns the number of waiting jobs by class
+func (q *workQueue) depth() map[string]int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	depth := make(map[string]int)
+	for _, j := range q.waiting {
+		depth[j.config.jobClass(j.repo).Name]++
+	}
+	return depth
+}
+
+//runningJobs returns the number of running jobs by class
+func (q *workQueue) runningJobs() map[string]int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	running := make(map[string]int, len(q.running))
+	for class, count := range q.running {
+		running[class] = count
+	}
+	return running
+}
+
+//cancelRunning kills the running commands and skips the remaining ones of all queued jobs
+func (q *workQueue) cancelRunning() {
+	q.cancel()
+}
+
+//stop waits for the queued and running jobs to finish, no jobs may be queued afterwards
+func (q *workQueue) stop() {
+	q.mutex.Lock()
+	q.closed = true
+	q.changed.Broadcast()
+	q.mutex.Unlock()
+
+	q.workers.Wait()
+}
@@ -0,0 +1,41 @@
+package webhook
+
+import (
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+//repoLimiters keeps a token bucket for every repository that has a rate limit configured
+type repoLimiters struct {
+	mutex    sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+var limiters = &repoLimiters{limiters: make(map[string]*rate.Limiter)}
+
+//allow reports whether another delivery for the repository fits in its rate limit
+func (l *repoLimiters) allow(repo ConfigRepository, fullName string) bool {
+	//the limit is configured in deliveries per minute
+	limit := rate.Limit(repo.RateLimit / 60)
+	burst := repo.RateBurst
+	if burst < 1 {
+		burst = 1
+	}
+
+	key := repo.tenant + "\x00" + repo.Name + "\x00" + fullName
+
+	l.mutex.Lock()
+	limiter, ok := l.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(limit, burst)
+		l.limiters[key] = limiter
+	} else if limiter.Limit() != limit || limiter.Burst() != burst {
+		//the config was reloaded with different settings
+		limiter.SetLimit(limit)
+		limiter.SetBurst(burst)
+	}
+	l.mutex.Unlock()
+
+	return limiter.Allow()
+}
@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//unmarshalPayload decodes a payload into the typed representation of its event. A field whose type
+//changed in Gitea (or drifted from the SDK) is left empty with a warning instead of failing the
+//delivery, unless strict is set; malformed JSON always fails.
+func unmarshalPayload(config Config, data []byte, v interface{}) error {
+	err := json.Unmarshal(data, v)
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok && !config.Strict {
+		//the decoder continues after a type mismatch, everything else is decoded
+		warnf("payload field %s is a JSON %s where %s was expected, ignoring it\n", typeErr.Field, typeErr.Value, typeErr.Type)
+		return nil
+	}
+	return err
+}
+
+//Raw returns a field of the payload of the delivery as it was sent, by its dot separated path like
+//"head_commit.id" or "commits.0.message", for the fields that have no typed counterpart. Strings
+//are returned as they are, numbers, booleans, objects and arrays as JSON and null as "".
+func (d *Delivery) Raw(path string) (string, error) {
+	if len(d.raw) == 0 {
+		return "", fmt.Errorf("delivery %s has no payload", d.ID)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(d.raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			switch current := value.(type) {
+			case map[string]interface{}:
+				field, ok := current[key]
+				if !ok {
+					return "", fmt.Errorf("payload has no %s", path)
+				}
+				value = field
+			case []interface{}:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(current) {
+					return "", fmt.Errorf("payload has no %s", path)
+				}
+				value = current[i]
+			default:
+				return "", fmt.Errorf("payload has no %s", path)
+			}
+		}
+	}
+
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	}
+	data, err := json.Marshal(value)
+	return string(data), err
+}
@@ -0,0 +1,229 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//hookPlan is the webhook a Gitea repository needs for the repositories of the config handling it
+type hookPlan struct {
+	fullName string
+	url      string
+	secret   string
+	events   []string
+}
+
+//giteaHookEvents returns the events of the Gitea webhook of a repository, Gitea has names of its own
+//for the events that are one event here
+func giteaHookEvents(repo ConfigRepository) []string {
+	var configured []string
+	configured = append(configured, repo.events()...)
+	for event := range repo.EventCommands {
+		configured = append(configured, event)
+	}
+
+	var events []string
+	for _, event := range configured {
+		switch event {
+		case "tag", "branch_create", "branch_delete", "tag_create", "tag_delete":
+			events = append(events, refEvents[event]...)
+		case "pull_request_review":
+			events = append(events, "pull_request_review_approved", "pull_request_review_rejected", "pull_request_review_comment")
+		default:
+			events = append(events, event)
+		}
+	}
+	return uniqueSorted(events)
+}
+
+//uniqueSorted returns the distinct values in order
+func uniqueSorted(values []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+//literalRepoName returns the owner/name a repository of the config handles, if its name is not a
+//pattern for several repositories
+func literalRepoName(name string) (string, bool) {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "^"), "$")
+	if strings.ContainsAny(name, "*+?()[]{}|$^") {
+		return "", false
+	}
+	name = strings.Replace(name, `\`, "", -1)
+	if strings.Count(name, "/") != 1 || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return "", false
+	}
+	return name, true
+}
+
+//hookPlans returns the webhooks the repositories of a config need, the repositories sharing a Gitea
+//repository and a path share a webhook
+func hookPlans(config Config, out io.Writer) ([]*hookPlan, error) {
+	base := strings.TrimRight(config.HookURL, "/")
+	var plans []*hookPlan
+	byKey := make(map[string]*hookPlan)
+	for _, repo := range config.Repositories {
+		fullName, ok := literalRepoName(repo.Name)
+		if !ok {
+			fmt.Fprintf(out, "skipping %s: the name is a pattern, not a single repository\n", repo.Name)
+			continue
+		}
+		urlPath := repo.Path
+		if repo.RepoFromPath {
+			urlPath = "/" + fullName
+		}
+		if urlPath == "" {
+			urlPath = "/"
+		}
+
+		key := fullName + "\x00" + urlPath
+		plan, ok := byKey[key]
+		if !ok {
+			plan = &hookPlan{fullName: fullName, url: base + urlPath, secret: repo.Secret}
+			byKey[key] = plan
+			plans = append(plans, plan)
+		} else if plan.secret != repo.Secret {
+			return nil, fmt.Errorf("the repositories of %s sent to %s have different secrets, a webhook has only one", fullName, plan.url)
+		}
+		plan.events = uniqueSorted(append(plan.events, giteaHookEvents(repo)...))
+	}
+	return plans, nil
+}
+
+//hookClient returns the Gitea client of a config for registering webhooks
+func hookClient(config Config) (*api.Client, error) {
+	if config.GiteaURL == "" || config.GiteaToken == "" || config.HookURL == "" {
+		return nil, errors.New("registering webhooks requires giteaurl, giteatoken and hookurl")
+	}
+	client := api.NewClient(config.GiteaURL, config.GiteaToken)
+	client.SetHTTPClient(&http.Client{Timeout: giteaTimeout})
+	return client, nil
+}
+
+//findHook returns the webhook of a Gitea repository sending deliveries to a URL
+func findHook(hooks []*api.Hook, url string) *api.Hook {
+	for _, hook := range hooks {
+		if strings.TrimRight(hook.Config["url"], "/") == strings.TrimRight(url, "/") {
+			return hook
+		}
+	}
+	return nil
+}
+
+//RegisterHooks creates the webhooks of the repositories of a config in Gitea, or updates their
+//secret and events if they exist, and writes what it did to out. Repositories whose name is a
+//pattern are skipped.
+func RegisterHooks(config Config, out io.Writer) error {
+	client, err := hookClient(config)
+	if err != nil {
+		return err
+	}
+	plans, err := hookPlans(config, out)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, plan := range plans {
+		owner, name := splitFullName(&api.Repository{FullName: plan.fullName})
+		hooks, err := client.ListRepoHooks(owner, name)
+		if err != nil {
+			fmt.Fprintf(out, "%s: failed to list the webhooks: %s\n", plan.fullName, err)
+			failed++
+			continue
+		}
+
+		hookConfig := map[string]string{"url": plan.url, "content_type": "json", "secret": plan.secret}
+		if hook := findHook(hooks, plan.url); hook != nil {
+			active := true
+			err = client.EditRepoHook(owner, name, hook.ID, api.EditHookOption{Config: hookConfig, Events: plan.events, Active: &active})
+			if err != nil {
+				fmt.Fprintf(out, "%s: failed to update webhook %d: %s\n", plan.fullName, hook.ID, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(out, "%s: updated webhook %d for %s (%s)\n", plan.fullName, hook.ID, plan.url, strings.Join(plan.events, ", "))
+			continue
+		}
+
+		hook, err := client.CreateRepoHook(owner, name, api.CreateHookOption{Type: "gitea", Config: hookConfig, Events: plan.events, Active: true})
+		if err != nil {
+			fmt.Fprintf(out, "%s: failed to create the webhook: %s\n", plan.fullName, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(out, "%s: created webhook %d for %s (%s)\n", plan.fullName, hook.ID, plan.url, strings.Join(plan.events, ", "))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d webhooks could not be registered", failed, len(plans))
+	}
+	return nil
+}
+
+//VerifyHooks checks that the webhooks of the repositories of a config exist in Gitea with the
+//events of the config and sending JSON, and writes the result for every webhook to out. The secret
+//cannot be checked, Gitea does not return it.
+func VerifyHooks(config Config, out io.Writer) error {
+	client, err := hookClient(config)
+	if err != nil {
+		return err
+	}
+	plans, err := hookPlans(config, out)
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	for _, plan := range plans {
+		owner, name := splitFullName(&api.Repository{FullName: plan.fullName})
+		hooks, err := client.ListRepoHooks(owner, name)
+		if err != nil {
+			fmt.Fprintf(out, "%s: failed to list the webhooks: %s\n", plan.fullName, err)
+			problems++
+			continue
+		}
+
+		hook := findHook(hooks, plan.url)
+		if hook == nil {
+			fmt.Fprintf(out, "%s: no webhook for %s\n", plan.fullName, plan.url)
+			problems++
+			continue
+		}
+		var mismatches []string
+		if !hook.Active {
+			mismatches = append(mismatches, "it is inactive")
+		}
+		if contentType := hook.Config["content_type"]; contentType != "" && contentType != "json" {
+			mismatches = append(mismatches, "the content type is "+contentType+" instead of json")
+		}
+		if events := uniqueSorted(hook.Events); strings.Join(events, ",") != strings.Join(plan.events, ",") {
+			mismatches = append(mismatches, fmt.Sprintf("the events are %s instead of %s", strings.Join(events, ", "), strings.Join(plan.events, ", ")))
+		}
+		if len(mismatches) > 0 {
+			fmt.Fprintf(out, "%s: webhook %d for %s does not match: %s\n", plan.fullName, hook.ID, plan.url, strings.Join(mismatches, "; "))
+			problems++
+			continue
+		}
+		fmt.Fprintf(out, "%s: webhook %d for %s ok\n", plan.fullName, hook.ID, plan.url)
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d of %d webhooks are missing or do not match, run -register to fix them", problems, len(plans))
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package webhook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//runLog writes the output of the commands of a job to files in a directory of its own,
+//runlogdir/<repository>/<delivery>/<index>.log
+type runLog struct {
+	mutex sync.Mutex
+	dir   string
+	next  int
+}
+
+//unsafePathChars matches what may not appear in the names of run log directories,
+//repository names and delivery IDs come from the payload and the headers
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+//safePathElement turns a value into a single file name
+func safePathElement(value string) string {
+	value = unsafePathChars.ReplaceAllString(value, "_")
+	if value == "" || value == "." || value == ".." {
+		return "_"
+	}
+	return value
+}
+
+//newRunLog creates the directory of the run logs of a job, or returns nil if runlogdir is not set
+func newRunLog(config Config, d *Delivery) (*runLog, error) {
+	if config.RunLogDir == "" {
+		return nil, nil
+	}
+
+	var repoDir = config.RunLogDir
+	for _, element := range strings.Split(d.Repo.FullName, "/") {
+		repoDir = filepath.Join(repoDir, safePathElement(element))
+	}
+	err := os.MkdirAll(repoDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	pruneRunLogs(config, repoDir)
+
+	name := d.ID
+	if name == "" {
+		name = time.Now().Format("20060102-150405")
+	}
+	name = safePathElement(name)
+
+	//replays and other repository entries for the same delivery get a directory of their own
+	dir := filepath.Join(repoDir, name)
+	for i := 2; ; i++ {
+		err = os.Mkdir(dir, 0755)
+		if err == nil {
+			return &runLog{dir: dir}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		dir = filepath.Join(repoDir, name+"-"+strconv.Itoa(i))
+	}
+}
+
+//create opens the log file of the next command
+func (l *runLog) create() (*os.File, error) {
+	l.mutex.Lock()
+	l.next++
+	path := filepath.Join(l.dir, fmt.Sprintf("%d.log", l.next))
+	l.mutex.Unlock()
+
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+}
+
+//pruneRunLogs removes the run directories of a repository that are older than runlogmaxage
+//days or beyond the newest runlogkeep ones
+func pruneRunLogs(config Config, repoDir string) {
+	if config.RunLogMaxAge <= 0 && config.RunLogKeep <= 0 {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(repoDir)
+	if err != nil {
+		return
+	}
+	var runs []os.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() {
+			runs = append(runs, entry)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].ModTime().After(runs[j].ModTime())
+	})
+
+	cutoff := time.Now().Add(-time.Duration(config.RunLogMaxAge) * 24 * time.Hour)
+	for i, run := range runs {
+		//make room for the run that is about to start
+		tooMany := config.RunLogKeep > 0 && i >= config.RunLogKeep-1
+		tooOld := config.RunLogMaxAge > 0 && run.ModTime().Before(cutoff)
+		if tooMany || tooOld {
+			err = os.RemoveAll(filepath.Join(repoDir, run.Name()))
+			if err != nil {
+				warnf("failed to remove old run logs %s: %s\n", run.Name(), err)
+			}
+		}
+	}
+}
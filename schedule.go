@@ -0,0 +1,229 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//scheduleWindow is a time window in which commands may run, like "Mon-Fri 09:00-17:00 Europe/Berlin"
+type scheduleWindow struct {
+	days     [7]bool
+	start    time.Duration
+	end      time.Duration
+	location *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+//parseScheduleWindow parses a window of the form "<days> <HH:MM>-<HH:MM> [timezone]",
+//where days is "*" or a comma separated list of days and day ranges like "Mon-Fri,Sun"
+func parseScheduleWindow(spec string) (scheduleWindow, error) {
+	var window scheduleWindow
+
+	fields := strings.Fields(spec)
+	if len(fields) < 2 || len(fields) > 3 {
+		return window, fmt.Errorf("invalid schedule \"%s\", expected \"<days> <HH:MM>-<HH:MM> [timezone]\"", spec)
+	}
+
+	if fields[0] == "*" {
+		for i := range window.days {
+			window.days[i] = true
+		}
+	} else {
+		for _, part := range strings.Split(fields[0], ",") {
+			bounds := strings.SplitN(part, "-", 2)
+			first, ok := weekdays[strings.ToLower(bounds[0])]
+			last := first
+			if ok && len(bounds) == 2 {
+				last, ok = weekdays[strings.ToLower(bounds[1])]
+			}
+			if !ok {
+				return window, fmt.Errorf("invalid days \"%s\" in schedule \"%s\"", part, spec)
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				window.days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+	}
+
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return window, fmt.Errorf("invalid time range \"%s\" in schedule \"%s\"", fields[1], spec)
+	}
+	var err error
+	if window.start, err = parseClock(times[0]); err == nil {
+		window.end, err = parseClock(times[1])
+	}
+	if err != nil {
+		return window, fmt.Errorf("invalid time range \"%s\" in schedule \"%s\"", fields[1], spec)
+	}
+
+	window.location = time.Local
+	if len(fields) == 3 {
+		window.location, err = time.LoadLocation(fields[2])
+		if err != nil {
+			return window, err
+		}
+	}
+
+	return window, nil
+}
+
+//parseClock parses HH:MM into the time since midnight
+func parseClock(clock string) (time.Duration, error) {
+	parts := strings.SplitN(clock, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %s", clock)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("invalid time %s", clock)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 {
+		return 0, fmt.Errorf("invalid time %s", clock)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+//opening returns the start and end of the window on the day of t, windows ending
+//before they start extend into the next day
+func (w scheduleWindow) opening(t time.Time) (time.Time, time.Time) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, w.location)
+	start := midnight.Add(w.start)
+	end := midnight.Add(w.end)
+	if w.end <= w.start {
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end
+}
+
+//contains reports whether t lies in the window
+func (w scheduleWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	//check the window of today and the one of yesterday that may extend past midnight
+	for _, day := range []time.Time{t, t.AddDate(0, 0, -1)} {
+		start, end := w.opening(day)
+		if w.days[day.Weekday()] && !t.Before(start) && t.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+//next returns the next time after t the window opens
+func (w scheduleWindow) next(t time.Time) time.Time {
+	t = t.In(w.location)
+	for i := 0; i <= 7; i++ {
+		day := t.AddDate(0, 0, i)
+		start, _ := w.opening(day)
+		if w.days[day.Weekday()] && start.After(t) {
+			return start
+		}
+	}
+	return time.Time{}
+}
+
+//parseSchedule parses all windows of a repository schedule
+func parseSchedule(specs []string) ([]scheduleWindow, error) {
+	windows := make([]scheduleWindow, 0, len(specs))
+	for _, spec := range specs {
+		window, err := parseScheduleWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+//nextOpening returns when commands may run next, which is t itself if t lies in a window
+func nextOpening(windows []scheduleWindow, t time.Time) time.Time {
+	var next time.Time
+	for _, window := range windows {
+		if window.contains(t) {
+			return t
+		}
+		opening := window.next(t)
+		if !opening.IsZero() && (next.IsZero() || opening.Before(next)) {
+			next = opening
+		}
+	}
+	return next
+}
+
+//scheduler queues jobs that arrived outside the schedule of their repository
+type scheduler struct {
+	mutex  sync.Mutex
+	queues map[string][]*job
+}
+
+var schedules = &scheduler{queues: make(map[string][]*job)}
+
+//hold reports whether the job is outside the schedule of its repository, in which case it
+//is either queued until the next window opens or skipped depending on the schedulemode
+func (s *scheduler) hold(j *job) bool {
+	if len(j.repo.Schedule) == 0 {
+		return false
+	}
+
+	fullName := j.delivery.Repo.FullName
+	windows, err := parseSchedule(j.repo.Schedule)
+	if err != nil {
+		log.Printf("skipping %s: %s\n", fullName, err)
+		return true
+	}
+
+	now := time.Now()
+	next := nextOpening(windows, now)
+	if next.Equal(now) {
+		return false
+	}
+	if next.IsZero() {
+		log.Printf("skipping %s: its schedule never opens\n", fullName)
+		return true
+	}
+
+	if j.repo.ScheduleMode == "skip" {
+		j.delivery.logf("skipped %s for %s outside its schedule, next window opens at %s\n", j.delivery.Event, fullName, next.Format(time.RFC3339))
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	//jobs of a repository run in the order they arrived once the window opens
+	key := j.key()
+	if len(s.queues[key]) == 0 {
+		time.AfterFunc(next.Sub(now), func() {
+			s.run(key)
+		})
+	}
+	s.queues[key] = append(s.queues[key], j)
+
+	j.delivery.logf("deferred %s for %s outside its schedule until %s (%d queued)\n", j.delivery.Event, fullName, next.Format(time.RFC3339), len(s.queues[key]))
+	return true
+}
+
+//run executes the queued jobs for key
+func (s *scheduler) run(key string) {
+	s.mutex.Lock()
+	jobs := s.queues[key]
+	delete(s.queues, key)
+	s.mutex.Unlock()
+
+	for _, j := range jobs {
+		j.delivery.logf("schedule window opened, queueing deferred %s for %s\n", j.delivery.Event, j.delivery.Repo.FullName)
+		queue.push(j)
+	}
+}
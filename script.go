@@ -0,0 +1,238 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkjson"
+	"go.starlark.net/syntax"
+)
+
+//scriptMaxSteps bounds the work of a script, a delivery should not hang on a runaway loop
+const scriptMaxSteps = 1000000
+
+//scriptResult is what the script of a repository decided about a delivery
+type scriptResult struct {
+	//delivery has the template variables set by the script
+	delivery *Delivery
+	//skip is the reason the script gave for not running anything
+	skip string
+	//commandSet is the name of the commandsets entry to run instead of the commands
+	commandSet string
+}
+
+//scriptSource returns the Starlark script of the repository and its name for error messages. The
+//scriptfile is read every time, so it can be changed without a reload.
+func (repo ConfigRepository) scriptSource() (string, string, error) {
+	if repo.ScriptFile == "" {
+		return "script of " + repo.Name, repo.Script, nil
+	}
+	data, err := ioutil.ReadFile(repo.ScriptFile)
+	return repo.ScriptFile, string(data), err
+}
+
+//scriptOptions allow if and for statements outside of functions, scripts are short
+var scriptOptions = &syntax.FileOptions{TopLevelControl: true, GlobalReassign: true}
+
+//scriptPredeclared are the names the script can use besides the Starlark built-ins
+var scriptPredeclared = map[string]bool{"event": true, "payload": true, "vars": true, "skip": true, "use": true, "json": true}
+
+//runScript runs the script of the repository for a delivery. The script sees the delivery as the
+//dict event and the decoded payload as payload, and can set template variables in the dict vars,
+//call skip(reason) to veto the delivery and use(name) to run one of the commandsets.
+func (repo ConfigRepository) runScript(d *Delivery) (*scriptResult, error) {
+	result := &scriptResult{delivery: d}
+	if repo.Script == "" && repo.ScriptFile == "" {
+		return result, nil
+	}
+	name, source, err := repo.scriptSource()
+	if err != nil {
+		return nil, err
+	}
+
+	payload := starlark.Value(starlark.None)
+	if len(d.raw) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(d.raw))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		payload = toStarlark(value)
+	}
+
+	vars := starlark.NewDict(len(d.Vars))
+	for key, value := range d.Vars {
+		vars.SetKey(starlark.String(key), starlark.String(value))
+	}
+	predeclared := starlark.StringDict{
+		"event":   toStarlark(d.scriptEvent()),
+		"payload": payload,
+		"vars":    vars,
+		"json":    starlarkjson.Module,
+		"skip": starlark.NewBuiltin("skip", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			reason := "skipped by script"
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "reason?", &reason); err != nil {
+				return nil, err
+			}
+			result.skip = reason
+			return starlark.None, nil
+		}),
+		"use": starlark.NewBuiltin("use", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var set string
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &set); err != nil {
+				return nil, err
+			}
+			if _, ok := repo.CommandSets[set]; !ok {
+				return nil, fmt.Errorf("repository %s has no commandset %s", repo.Name, set)
+			}
+			result.commandSet = set
+			return starlark.None, nil
+		}),
+	}
+
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(thread *starlark.Thread, msg string) {
+			d.logf("%s: %s\n", name, msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(scriptMaxSteps)
+	if _, err := starlark.ExecFileOptions(scriptOptions, thread, name, source, predeclared); err != nil {
+		if evalErr, ok := err.(*starlark.EvalError); ok {
+			return nil, fmt.Errorf("%s", evalErr.Backtrace())
+		}
+		return nil, err
+	}
+
+	if vars.Len() > 0 {
+		//the delivery is shared with the other repositories, the variables belong to this one only
+		scripted := *d
+		scripted.Vars = make(map[string]string)
+		for _, item := range vars.Items() {
+			key, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("%s: vars key %s is not a string", name, item[0])
+			}
+			value, ok := starlark.AsString(item[1])
+			if !ok {
+				value = item[1].String()
+			}
+			scripted.Vars[key] = value
+		}
+		result.delivery = &scripted
+	}
+	return result, nil
+}
+
+//scriptEvent returns the fields of a delivery the script gets as event
+func (d *Delivery) scriptEvent() map[string]interface{} {
+	event := map[string]interface{}{
+		"id":       d.ID,
+		"event":    d.Event,
+		"action":   d.Action,
+		"provider": d.Provider,
+		"repo":     d.Repo.FullName,
+		"ref":      d.Ref,
+		"branch":   d.Branch(),
+		"tag":      d.Tag(),
+		"slug":     d.Slug(),
+		"before":   d.Before,
+		"after":    d.After,
+		"sender":   "",
+	}
+	if d.Sender != nil {
+		event["sender"] = d.Sender.UserName
+	}
+	var messages, files []interface{}
+	for _, commit := range d.Commits {
+		messages = append(messages, commit.Message)
+		for _, list := range [][]string{commit.Added, commit.Removed, commit.Modified} {
+			for _, file := range list {
+				files = append(files, file)
+			}
+		}
+	}
+	event["messages"] = messages
+	event["files"] = files
+	if len(d.Match) > 0 {
+		var match []interface{}
+		for _, group := range d.Match {
+			match = append(match, group)
+		}
+		event["match"] = match
+	}
+	return event
+}
+
+//toStarlark converts a decoded JSON value to the equivalent Starlark value
+func toStarlark(value interface{}) starlark.Value {
+	switch value := value.(type) {
+	case nil:
+		return starlark.None
+	case bool:
+		return starlark.Bool(value)
+	case string:
+		return starlark.String(value)
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return starlark.MakeInt64(i)
+		}
+		f, _ := value.Float64()
+		return starlark.Float(f)
+	case []interface{}:
+		list := make([]starlark.Value, len(value))
+		for i, item := range value {
+			list[i] = toStarlark(item)
+		}
+		return starlark.NewList(list)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		dict := starlark.NewDict(len(value))
+		for _, key := range keys {
+			dict.SetKey(starlark.String(key), toStarlark(value[key]))
+		}
+		return dict
+	}
+	return starlark.String(fmt.Sprint(value))
+}
+
+//checkScript reports the problems of the script and commandsets of a repository, the script is only
+//compiled since running it needs a delivery
+func checkScript(problem func(format string, v ...interface{}), repo ConfigRepository, name string) {
+	for set, commands := range repo.CommandSets {
+		if len(commands) == 0 {
+			problem("commandsets %s of repository %s is empty", set, name)
+		}
+	}
+	if repo.Script == "" && repo.ScriptFile == "" {
+		if len(repo.CommandSets) > 0 {
+			problem("commandsets of repository %s are only used by a script", name)
+		}
+		return
+	}
+	if repo.Script != "" && repo.ScriptFile != "" {
+		problem("repository %s has both script and scriptfile", name)
+		return
+	}
+	filename, source, err := repo.scriptSource()
+	if err != nil {
+		problem("scriptfile of repository %s: %s", name, err)
+		return
+	}
+	isPredeclared := func(identifier string) bool {
+		return scriptPredeclared[identifier]
+	}
+	if _, _, err := starlark.SourceProgramOptions(scriptOptions, filename, source, isPredeclared); err != nil {
+		problem("invalid script of repository %s: %s", name, strings.TrimSpace(err.Error()))
+	}
+}
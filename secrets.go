@@ -0,0 +1,102 @@
+package webhook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+//configReference matches ${NAME} and ${file:/path} in the values of the config, $${ stands for a literal ${
+var configReference = regexp.MustCompile(`\$\$\{|\$\{(file:[^}]+|[A-Za-z_][A-Za-z0-9_]*)\}`)
+
+//expandReferences replaces the environment variables and files referenced by a value of the config
+func expandReferences(value string) (string, error) {
+	var err error
+	expanded := configReference.ReplaceAllStringFunc(value, func(reference string) string {
+		if reference == "$${" {
+			return "${"
+		}
+		name := reference[2 : len(reference)-1]
+		if strings.HasPrefix(name, "file:") {
+			content, readErr := readSecretFile(strings.TrimPrefix(name, "file:"))
+			if readErr != nil && err == nil {
+				err = readErr
+			}
+			return content
+		}
+		variable, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return variable
+	})
+	return expanded, err
+}
+
+//expandConfigValue expands the references in all strings of a decoded config
+func expandConfigValue(value interface{}) (interface{}, error) {
+	var err error
+	switch value := value.(type) {
+	case string:
+		return expandReferences(value)
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key], err = expandConfigValue(item)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i], err = expandConfigValue(item)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case []map[string]interface{}:
+		//arrays of tables in TOML
+		for _, item := range value {
+			_, err = expandConfigValue(item)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
+}
+
+//readSecretFile reads a secret mounted as a file, like the secrets of Docker and Kubernetes,
+//without the trailing newline editors add
+func readSecretFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+//resolveSecrets sets the secrets of the repositories that are read from a file or an environment variable
+func resolveSecrets(config Config) (Config, error) {
+	repositories := make([]ConfigRepository, len(config.Repositories))
+	for i, repo := range config.Repositories {
+		switch {
+		case repo.SecretFile != "":
+			secret, err := readSecretFile(repo.SecretFile)
+			if err != nil {
+				return config, fmt.Errorf("secretfile of repository %s: %s", repo.Name, err)
+			}
+			repo.Secret = secret
+		case repo.SecretEnv != "":
+			secret, ok := os.LookupEnv(repo.SecretEnv)
+			if !ok {
+				return config, fmt.Errorf("secretenv of repository %s: environment variable %s is not set", repo.Name, repo.SecretEnv)
+			}
+			repo.Secret = secret
+		}
+		repositories[i] = repo
+	}
+	config.Repositories = repositories
+	return config, nil
+}
@@ -0,0 +1,234 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//sendTimeout is the timeout of a delivery sent with Send, long enough for synchronous deliveries
+const sendTimeout = 5 * time.Minute
+
+//SendOptions describe the test delivery Send builds
+type SendOptions struct {
+	//Event is the Gitea event, push by default
+	Event string
+	//Repo is the owner/name of the repository of the payload
+	Repo string
+	//Ref is the full ref, refs/heads/main by default. Pull requests use it as the head branch,
+	//create, delete and release deliveries as the branch or tag.
+	Ref string
+	//Action is the action of issue, pull request, comment and release deliveries
+	Action string
+	//Body is the body of the comment of issue_comment deliveries, or of the issue
+	Body string
+	//Sender is the user name of the sender and pusher
+	Sender string
+	//GiteaURL is the base of the URLs in the payload
+	GiteaURL string
+	//Secret signs the payload, nothing is signed without one
+	Secret string
+}
+
+//randomSHA returns a random commit ID
+func randomSHA() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+//SamplePayload returns a payload of an event like Gitea sends it, with made up values for what the
+//options do not set
+func SamplePayload(options SendOptions) ([]byte, error) {
+	owner, name := splitFullName(&api.Repository{FullName: options.Repo})
+	if owner == "" || name == "" {
+		return nil, fmt.Errorf("repository %s is not of the form owner/name", options.Repo)
+	}
+	base := strings.TrimRight(options.GiteaURL, "/")
+	if base == "" {
+		base = "https://gitea.example.com"
+	}
+	sender := options.Sender
+	if sender == "" {
+		sender = owner
+	}
+	ref := options.Ref
+	if ref == "" {
+		ref = "refs/heads/main"
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	user := &api.User{ID: 1, UserName: sender, FullName: sender, Email: sender + "@example.com", AvatarURL: base + "/avatars/1"}
+	repo := &api.Repository{
+		ID:            1,
+		Owner:         &api.User{ID: 2, UserName: owner, FullName: owner, Email: owner + "@example.com", AvatarURL: base + "/avatars/2"},
+		Name:          name,
+		FullName:      owner + "/" + name,
+		HTMLURL:       base + "/" + owner + "/" + name,
+		SSHURL:        "git@" + strings.TrimPrefix(strings.TrimPrefix(base, "https://"), "http://") + ":" + owner + "/" + name + ".git",
+		CloneURL:      base + "/" + owner + "/" + name + ".git",
+		DefaultBranch: "main",
+		Created:       now.Add(-24 * time.Hour),
+		Updated:       now,
+	}
+	shortRef := strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	refType := "branch"
+	if strings.HasPrefix(ref, "refs/tags/") {
+		refType = "tag"
+	}
+
+	var payload interface{}
+	switch event := options.Event; event {
+	case "", "push":
+		before, after := randomSHA(), randomSHA()
+		commit := &api.PayloadCommit{
+			ID:        after,
+			Message:   "Test commit\n",
+			URL:       repo.HTMLURL + "/commit/" + after,
+			Author:    &api.PayloadUser{Name: user.FullName, Email: user.Email, UserName: user.UserName},
+			Committer: &api.PayloadUser{Name: user.FullName, Email: user.Email, UserName: user.UserName},
+			Timestamp: now,
+			Modified:  []string{"README.md"},
+		}
+		payload = &api.PushPayload{
+			Ref:        ref,
+			Before:     before,
+			After:      after,
+			CompareURL: repo.HTMLURL + "/compare/" + before + "..." + after,
+			Commits:    []*api.PayloadCommit{commit},
+			HeadCommit: commit,
+			Repo:       repo,
+			Pusher:     user,
+			Sender:     user,
+		}
+	case "create":
+		payload = &api.CreatePayload{Sha: randomSHA(), Ref: shortRef, RefType: refType, Repo: repo, Sender: user}
+	case "delete":
+		payload = &api.DeletePayload{Ref: shortRef, RefType: refType, PusherType: "user", Repo: repo, Sender: user}
+	case "issues", "issue_comment":
+		body := options.Body
+		if body == "" {
+			body = "Test body"
+		}
+		issue := &api.Issue{ID: 1, URL: repo.HTMLURL + "/issues/1", Index: 1, Poster: user, Title: "Test issue", Body: body, State: api.StateType("open"), Created: now, Updated: now}
+		if event == "issues" {
+			payload = &api.IssuePayload{Action: api.HookIssueAction(orDefault(options.Action, "opened")), Index: 1, Issue: issue, Repository: repo, Sender: user}
+			break
+		}
+		issue.Body = "Test issue"
+		comment := &api.Comment{ID: 1, HTMLURL: issue.URL + "#issuecomment-1", IssueURL: issue.URL, Poster: user, Body: body, Created: now, Updated: now}
+		payload = &api.IssueCommentPayload{Action: api.HookIssueCommentAction(orDefault(options.Action, "created")), Issue: issue, Comment: comment, Repository: repo, Sender: user}
+	case "pull_request":
+		pr := &api.PullRequest{
+			ID:       1,
+			URL:      repo.HTMLURL + "/pulls/1",
+			Index:    1,
+			Poster:   user,
+			Title:    "Test pull request",
+			Body:     options.Body,
+			State:    api.StateType("open"),
+			HTMLURL:  repo.HTMLURL + "/pulls/1",
+			DiffURL:  repo.HTMLURL + "/pulls/1.diff",
+			PatchURL: repo.HTMLURL + "/pulls/1.patch",
+			Base:     &api.PRBranchInfo{Name: repo.DefaultBranch, Ref: repo.DefaultBranch, Sha: randomSHA(), RepoID: repo.ID, Repository: repo},
+			Head:     &api.PRBranchInfo{Name: shortRef, Ref: shortRef, Sha: randomSHA(), RepoID: repo.ID, Repository: repo},
+			Created:  &now,
+			Updated:  &now,
+		}
+		payload = &api.PullRequestPayload{Action: api.HookIssueAction(orDefault(options.Action, "opened")), Index: 1, PullRequest: pr, Repository: repo, Sender: user}
+	case "release":
+		release := &api.Release{
+			ID:          1,
+			TagName:     shortRef,
+			Target:      repo.DefaultBranch,
+			Title:       shortRef,
+			Note:        options.Body,
+			URL:         base + "/api/v1/repos/" + repo.FullName + "/releases/1",
+			TarURL:      repo.HTMLURL + "/archive/" + shortRef + ".tar.gz",
+			ZipURL:      repo.HTMLURL + "/archive/" + shortRef + ".zip",
+			CreatedAt:   now,
+			PublishedAt: now,
+			Publisher:   user,
+		}
+		payload = &api.ReleasePayload{Action: api.HookReleaseAction(orDefault(options.Action, "published")), Release: release, Repository: repo, Sender: user}
+	default:
+		return nil, fmt.Errorf("cannot build a payload for event %s, use push, create, delete, issues, issue_comment, pull_request or release", event)
+	}
+	return json.MarshalIndent(payload, "", "  ")
+}
+
+//orDefault returns value, or fallback if it is empty
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+//DeliverySecret returns the secret of the first repository of a config that handles deliveries of
+//a Gitea repository sent to a URL path
+func DeliverySecret(config Config, fullName string, urlPath string) string {
+	for _, repo := range config.Repositories {
+		if !repo.servesPath(config, urlPath) {
+			continue
+		}
+		if match, err := regexp.MatchString(repo.Name, fullName); err == nil && match {
+			return repo.Secret
+		}
+	}
+	return ""
+}
+
+//Send posts a signed test delivery built by SamplePayload to the webhook URL of a daemon, like Gitea
+//would, and writes the response to out
+func Send(hookURL string, options SendOptions, out io.Writer) error {
+	if _, err := url.ParseRequestURI(hookURL); err != nil {
+		return fmt.Errorf("invalid webhook URL %s", hookURL)
+	}
+	body, err := SamplePayload(options)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, hookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Gitea-Event", orDefault(options.Event, "push"))
+	request.Header.Set("X-Gitea-Delivery", "send-"+hex.EncodeToString(id))
+	if options.Secret != "" {
+		request.Header.Set("X-Gitea-Signature", signPayload(options.Secret, body))
+	}
+
+	client := &http.Client{Timeout: sendTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	answer, _ := ioutil.ReadAll(response.Body)
+
+	fmt.Fprintf(out, "%s %s\n", response.Proto, response.Status)
+	if len(answer) > 0 {
+		fmt.Fprintf(out, "%s\n", bytes.TrimRight(answer, "\n"))
+	}
+	if response.StatusCode/100 != 2 {
+		return errors.New("the delivery was not accepted: " + response.Status)
+	}
+	return nil
+}
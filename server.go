@@ -0,0 +1,317 @@
+package webhook
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//Server handles the webhook deliveries of a config. It is an http.Handler so other programs can embed
+//it, Run serves it like the go-gitea-webhook daemon. The active config, the job queue and the delivery
+//history belong to the process, so a process runs a single Server.
+type Server struct {
+	mux *http.ServeMux
+	//stop receives the signals that shut Run down, and the requests of Stop
+	stop chan os.Signal
+}
+
+//queueStarted makes sure the workers are only started once, and jobsRestored that the job state file
+//is only read once
+var queueStarted, jobsRestored sync.Once
+
+//eventHooks are the functions registered with OnEvent
+var eventHooks struct {
+	sync.RWMutex
+	hooks []func(d *Delivery)
+}
+
+//New validates a config, applies its defaults, makes it the active config and starts the workers of
+//the queue. The number of workers and the size of the queue are fixed by the first config. Start
+//restores the interrupted jobs and starts the schedules.
+func New(c Config) (*Server, error) {
+	c, err := prepareConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	configMutex.Lock()
+	config = c
+	configMutex.Unlock()
+
+	queueStarted.Do(func() {
+		queue = startQueue(c.Workers, c.QueueSize)
+	})
+
+	//the fields of the log lines need formatting, also when logging to the writer of the embedding program
+	if _, ok := log.Writer().(*logWriter); !ok {
+		log.SetOutput(&logWriter{out: log.Writer(), format: "text", minLevel: levelRank(configLogLevel(c))})
+	}
+
+	s := &Server{mux: http.NewServeMux(), stop: make(chan os.Signal, 1)}
+	s.mux.HandleFunc("/", hookHandler)
+	s.mux.HandleFunc("/trigger/", triggerHandler)
+	if c.AdminAPI {
+		s.mux.HandleFunc("/admin/", adminHandler)
+	}
+	if c.Metrics {
+		s.mux.HandleFunc("/metrics", metricsHandler)
+	}
+	if c.Health {
+		s.mux.HandleFunc("/healthz", healthHandler)
+		s.mux.HandleFunc("/readyz", readyHandler)
+	}
+	return s, nil
+}
+
+//NewFromFile returns the server of a config file, which is read again on SIGHUP, on a reload from
+//the admin API and on changes with watchconfig
+func NewFromFile(path string) (*Server, error) {
+	c, err := ReadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	configFile = path
+	return New(c)
+}
+
+//ServeHTTP handles a webhook delivery, or a request to the admin API, the metrics or the health checks
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, ok := stripBasePath(currentConfig(), w, r)
+	if !ok {
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+//Start handles the jobs the job state file recorded as unfinished and starts the schedules. Run calls
+//it once it holds the lock file and logs to the logfile, programs embedding the Server call it
+//themselves after New.
+func (s *Server) Start() {
+	jobsRestored.Do(func() {
+		restoreJobs(currentConfig())
+	})
+	startCron()
+}
+
+//OnEvent registers a function that is called with every delivery that was received and parsed, before
+//it is matched against the repositories. The delivery is shared and must not be modified.
+func (s *Server) OnEvent(hook func(d *Delivery)) {
+	eventHooks.Lock()
+	eventHooks.hooks = append(eventHooks.hooks, hook)
+	eventHooks.Unlock()
+}
+
+//fireEventHooks calls the functions registered with OnEvent
+func fireEventHooks(d *Delivery) {
+	eventHooks.RLock()
+	defer eventHooks.RUnlock()
+	for _, hook := range eventHooks.hooks {
+		hook(d)
+	}
+}
+
+//Run logs to the logfile, serves on the address of the config until SIGINT, SIGTERM or Stop and then
+//lets the queued jobs finish and runs the shutdown commands
+func (s *Server) Run() error {
+	config := currentConfig()
+
+	//open log file
+	writer, err := openLogfile(config)
+	if err != nil {
+		return err
+	}
+
+	//close logfile on exit
+	defer func() {
+		writer.Close()
+	}()
+
+	//setting logging output
+	setupLogging(config, writer)
+
+	//refuse to run next to another instance using the same lock file
+	if config.LockFile != "" {
+		lock, err := acquireLock(config.LockFile, config.LockWait)
+		if err != nil {
+			return err
+		}
+		defer releaseLock(lock)
+	}
+
+	//only the instance holding the lock may take over the jobs of the last run
+	s.Start()
+
+	//Windows has no SIGHUP, the admin API and watchconfig reload the config there
+	if configFile != "" {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGHUP)
+
+		go func() {
+			for range sigc {
+				reloadConfig()
+			}
+		}()
+	}
+
+	//every listener has a server of its own, systemd may already have opened the socket of the first one
+	var servers []*listenerServer
+	for i, l := range config.listeners() {
+		ls, err := s.listenerServer(config, l, i == 0)
+		if err != nil {
+			for _, opened := range servers {
+				opened.listener.Close()
+			}
+			return err
+		}
+		servers = append(servers, ls)
+	}
+
+	//shut down gracefully on SIGINT/SIGTERM, or when the Windows service is stopped
+	stopc := s.stop
+	signal.Notify(stopc, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	drained := make(chan struct{})
+
+	go func() {
+		sig := <-stopc
+		log.Printf("received %s, shutting down\n", sig)
+		sdNotify("STOPPING=1")
+
+		//stop accepting deliveries and wait for the in-flight ones to finish
+		for _, ls := range servers {
+			err := ls.server.Shutdown(context.Background())
+			if err != nil {
+				log.Println(err)
+			}
+		}
+
+		//let the queued jobs finish before running the shutdown commands, a second signal
+		//or the end of the drain period kills them
+		go func() {
+			var expired <-chan time.Time
+			if drain := currentConfig().DrainTimeout; drain > 0 {
+				timer := time.NewTimer(time.Duration(drain) * time.Second)
+				defer timer.Stop()
+				expired = timer.C
+			}
+			select {
+			case sig := <-stopc:
+				log.Printf("received %s again, cancelling running commands\n", sig)
+			case <-expired:
+				log.Println("drain period over, cancelling running commands")
+			case <-drained:
+				return
+			}
+			queue.cancelRunning()
+		}()
+		log.Println("waiting for queued and running commands to finish")
+		queue.stop()
+		close(drained)
+		tracer.flush()
+		database.flush()
+
+		runShutdownCommands(currentConfig())
+		close(stopped)
+	}()
+
+	if config.WatchConfig && configFile != "" {
+		err = watchConfig(configFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.StartupQuietPeriod > 0 {
+		startupQuiet.start(time.Duration(config.StartupQuietPeriod) * time.Second)
+	}
+
+	sdNotify("READY=1")
+
+	//starting servers, a failing one stops the daemon
+	errc := make(chan error, len(servers))
+	for _, ls := range servers {
+		go func(ls *listenerServer) {
+			errc <- ls.serve()
+		}(ls)
+	}
+	for range servers {
+		err = <-errc
+		if err != http.ErrServerClosed {
+			return err
+		}
+	}
+
+	<-stopped
+	log.Println("shutdown complete")
+	return nil
+}
+
+//Stop shuts Run down like SIGTERM: the server stops accepting deliveries, lets the queued jobs finish
+//and runs the shutdown commands before Run returns. Calling it again cancels the running commands.
+func (s *Server) Stop() {
+	select {
+	case s.stop <- syscall.SIGTERM:
+	default:
+	}
+}
+
+//listenerServer is the HTTP server of a listener
+type listenerServer struct {
+	server   *http.Server
+	listener net.Listener
+	config   Config
+	useTLS   bool
+}
+
+//listenerServer opens the socket of a listener and returns its server
+func (s *Server) listenerServer(config Config, l ConfigListener, first bool) (*listenerServer, error) {
+	lc := l.apply(config)
+	address := listenAddress(lc)
+
+	var listener net.Listener
+	var err error
+	if first {
+		listener, err = systemdListener()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if listener != nil {
+		log.Println("Listening on " + listener.Addr().String() + " passed by systemd")
+	} else {
+		listener, err = listen(lc, address)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Listening on " + address)
+	}
+
+	//without listeners the server serves everything like when embedded
+	var handler http.Handler = s
+	if len(config.Listeners) > 0 {
+		handler = l.handler(config)
+	}
+	ls := &listenerServer{server: &http.Server{Addr: address, Handler: handler}, listener: listener, config: lc}
+	ls.useTLS = lc.TLSCert != "" || lc.TLSKey != ""
+	if ls.useTLS {
+		ls.server.TLSConfig, err = tlsConfig(lc)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return ls, nil
+}
+
+//serve serves on the socket of the listener until the server is shut down
+func (ls *listenerServer) serve() error {
+	if ls.useTLS {
+		return ls.server.ServeTLS(ls.listener, ls.config.TLSCert, ls.config.TLSKey)
+	}
+	return ls.server.Serve(ls.listener)
+}
@@ -0,0 +1,46 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+//signPayload returns the hex encoded HMAC-SHA256 of a body, as sent by Gitea in X-Gitea-Signature
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//requestSignature returns the signature header of a delivery, Gogs and GitHub use their own header names
+func requestSignature(header http.Header) string {
+	signature := header.Get("X-Gitea-Signature")
+	if signature == "" {
+		signature = header.Get("X-Gogs-Signature")
+	}
+	if signature == "" {
+		signature = header.Get("X-Hub-Signature-256")
+	}
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(signature), "sha256="))
+}
+
+//verifySecret checks a delivery against the secret of a repository. The HMAC signature of the
+//raw body is checked when one was sent, otherwise the secret in the payload of Gogs and old Gitea.
+//GitLab does not sign deliveries but sends the secret as is in X-Gitlab-Token.
+func verifySecret(secret string, d *Delivery, body []byte) bool {
+	if token := d.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	if signature := requestSignature(d.Header); signature != "" {
+		expected := signPayload(secret, body)
+		return subtle.ConstantTimeCompare([]byte(signature), []byte(expected)) == 1
+	}
+	if d.Secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(d.Secret), []byte(secret)) == 1
+}
@@ -0,0 +1,128 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//repoStatus is the result of the last delivery of a repository as written to the status file
+type repoStatus struct {
+	ExitCode  int       `json:"exit_code"`
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event"`
+	Ref       string    `json:"ref"`
+	Delivery  string    `json:"delivery"`
+}
+
+//statusWriter keeps the status files up to date for external monitoring
+type statusWriter struct {
+	mutex    sync.Mutex
+	statuses map[string]repoStatus
+}
+
+var statusFile = &statusWriter{}
+
+//update records the results of a job, the exit code is the one of the first failed command
+func (s *statusWriter) update(config Config, j *job, results []Result) error {
+	status := repoStatus{
+		Timestamp: time.Now(),
+		Event:     j.delivery.Event,
+		Ref:       j.delivery.Ref,
+		Delivery:  j.delivery.ID,
+	}
+	for _, result := range results {
+		if result.ExitCode != 0 {
+			status.ExitCode = result.ExitCode
+			break
+		}
+	}
+
+	fullName := j.delivery.Repo.FullName
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	//a path containing {repo} gets a file per repository
+	if strings.Contains(config.StatusFile, "{repo}") {
+		path := strings.Replace(config.StatusFile, "{repo}", strings.Replace(fullName, "/", "_", -1), -1)
+		if config.StatusFormat == "text" {
+			return writeFileAtomic(path, []byte(formatStatus(status)+"\n"))
+		}
+		return writeJSONFileAtomic(path, status)
+	}
+
+	if s.statuses == nil {
+		s.statuses = make(map[string]repoStatus)
+
+		//keep the statuses of repositories written before a restart
+		data, err := ioutil.ReadFile(config.StatusFile)
+		if err == nil && config.StatusFormat == "json" {
+			json.Unmarshal(data, &s.statuses)
+		}
+	}
+	s.statuses[fullName] = status
+
+	if config.StatusFormat == "text" {
+		names := make([]string, 0, len(s.statuses))
+		for name := range s.statuses {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var lines []string
+		for _, name := range names {
+			lines = append(lines, name+" "+formatStatus(s.statuses[name]))
+		}
+		return writeFileAtomic(config.StatusFile, []byte(strings.Join(lines, "\n")+"\n"))
+	}
+	return writeJSONFileAtomic(config.StatusFile, s.statuses)
+}
+
+//formatStatus returns the text form of a status
+func formatStatus(status repoStatus) string {
+	return fmt.Sprintf("%d %s %s", status.ExitCode, status.Timestamp.Format(time.RFC3339), status.Ref)
+}
+
+//writeJSONFileAtomic writes v as indented JSON with writeFileAtomic
+func writeJSONFileAtomic(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+//writeFileAtomic replaces the file through a temporary file, so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	return writeFileAtomicMode(path, data, 0644)
+}
+
+//writeFileAtomicMode is writeFileAtomic with the permissions of the new file
+func writeFileAtomicMode(path string, data []byte, mode os.FileMode) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(mode)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
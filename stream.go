@@ -0,0 +1,157 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//streamEvent is an event of the live output of the commands of a delivery
+type streamEvent struct {
+	//Type is "start" and "exit" around every command, and "output" for what it wrote
+	Type       string  `json:"-"`
+	Repository string  `json:"repository"`
+	Command    string  `json:"command"`
+	Stream     string  `json:"stream,omitempty"`
+	Data       string  `json:"data,omitempty"`
+	ExitCode   *int    `json:"exit_code,omitempty"`
+	Duration   float64 `json:"duration,omitempty"`
+}
+
+//streamBuffer is the number of events a slow client may lag behind before events are dropped
+const streamBuffer = 256
+
+//streamKeepAlive is how often an idle stream is written to, so proxies keep it open and a
+//disconnected client is noticed
+const streamKeepAlive = 15 * time.Second
+
+//outputStreams passes the output of running commands to the clients watching their delivery
+type outputStreams struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[chan streamEvent]bool
+}
+
+var streams = &outputStreams{subscribers: make(map[string]map[chan streamEvent]bool)}
+
+//subscribe returns a channel with the events of the commands of a delivery
+func (s *outputStreams) subscribe(id string) chan streamEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	events := make(chan streamEvent, streamBuffer)
+	if s.subscribers[id] == nil {
+		s.subscribers[id] = make(map[chan streamEvent]bool)
+	}
+	s.subscribers[id][events] = true
+	return events
+}
+
+//unsubscribe stops sending events to a channel returned by subscribe
+func (s *outputStreams) unsubscribe(id string, events chan streamEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.subscribers[id], events)
+	if len(s.subscribers[id]) == 0 {
+		delete(s.subscribers, id)
+	}
+}
+
+//publish sends an event to the clients watching a delivery, a running command never waits for a
+//slow client, the events it cannot take are dropped
+func (s *outputStreams) publish(id string, event streamEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for events := range s.subscribers[id] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+//streamWriter publishes what a command writes to stdout or stderr
+type streamWriter struct {
+	id     string
+	event  streamEvent
+	stream *outputStreams
+}
+
+//writer returns the writer of the output of a command to a stream ("stdout" or "stderr")
+func (s *outputStreams) writer(d *Delivery, repository string, command string, stream string) io.Writer {
+	return &streamWriter{id: d.ID, event: streamEvent{Type: "output", Repository: repository, Command: command, Stream: stream}, stream: s}
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	event := w.event
+	//the buffer is reused by the copy of the pipe
+	event.Data = string(p)
+	w.stream.publish(w.id, event)
+	return len(p), nil
+}
+
+//adminStream streams the output of the commands of a delivery as server-sent events while they run,
+//until all jobs of the delivery are done or the client goes away
+func adminStream(w http.ResponseWriter, r *http.Request) {
+	id := pathID(r, 1)
+	entry := state.findDelivery(id)
+	if entry == nil {
+		writeJSONError(w, http.StatusNotFound, "delivery not in the history")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	//the ID may be the SHA of the payload
+	id = entry.info.ID
+
+	events := streams.subscribe(id)
+	defer streams.unsubscribe(id, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		if summary, done := state.jobsDone(entry.info); done {
+			writeStreamEvent(w, "done", summary)
+			flusher.Flush()
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-events:
+			writeStreamEvent(w, event.Type, event)
+		}
+		flusher.Flush()
+	}
+}
+
+//writeStreamEvent writes a server-sent event with v as JSON data
+func writeStreamEvent(w io.Writer, event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+//jobsDone reports whether all jobs queued for a delivery are done, with a copy of its info
+func (s *runtimeState) jobsDone(info *DeliveryInfo) (DeliveryInfo, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	summary := *info
+	summary.Results = nil
+	return summary, info.finished >= info.Queued
+}
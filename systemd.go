@@ -0,0 +1,65 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+//listenFdsStart is the first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+//systemdListener returns the listening socket passed by systemd socket activation, or nil if the
+//daemon was not started by a socket unit
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+
+	//the sockets are meant for this process only, not for the commands it runs
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if fds > 1 {
+		log.Printf("systemd passed %d sockets, only the first one is used\n", fds)
+	}
+	file := os.NewFile(uintptr(listenFdsStart), "systemd socket")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket passed by systemd: %s", err)
+	}
+	return listener, nil
+}
+
+//sdNotify sends a state like READY=1 to systemd, it does nothing unless the service has Type=notify
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	//a leading @ stands for the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		warnf("failed to notify systemd: %s\n", err)
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		warnf("failed to notify systemd: %s\n", err)
+	}
+}
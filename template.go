@@ -0,0 +1,132 @@
+package webhook
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"text/template"
+)
+
+//isTemplate reports whether a command contains template placeholders
+func isTemplate(command string) bool {
+	return strings.Contains(command, "{{")
+}
+
+//commandArgs returns the program and the arguments of a command. Commands with placeholders are
+//executed as templates with the delivery as dot, every word of the command becoming one argument
+//so substituted values are never split. Plain commands get the raw payload as their only argument.
+func commandArgs(cmd ConfigCommand, d *Delivery, data []byte) ([]string, error) {
+	if len(cmd.args) > 0 {
+		return cmd.args, nil
+	}
+	if !isTemplate(cmd.Command) {
+		return []string{cmd.Command, string(data)}, nil
+	}
+
+	var args []string
+	for _, word := range splitTemplate(cmd.Command) {
+		arg, err := expandTemplate(word, d)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	if args[0] == "" {
+		return nil, errors.New("command template expands to an empty program")
+	}
+
+	if cmd.Payload {
+		args = append(args, string(data))
+	}
+	return args, nil
+}
+
+//splitTemplate splits a command into words at whitespace outside of placeholders
+func splitTemplate(command string) []string {
+	var words []string
+	var word strings.Builder
+	depth := 0
+	for i := 0; i < len(command); i++ {
+		switch {
+		case strings.HasPrefix(command[i:], "{{"):
+			depth++
+			word.WriteString("{{")
+			i++
+			continue
+		case strings.HasPrefix(command[i:], "}}") && depth > 0:
+			depth--
+			word.WriteString("}}")
+			i++
+			continue
+		case depth == 0 && (command[i] == ' ' || command[i] == '\t' || command[i] == '\n'):
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+			continue
+		}
+		word.WriteByte(command[i])
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+//expandTemplate executes a single template with the delivery as dot
+func expandTemplate(text string, d *Delivery) (string, error) {
+	tmpl, err := template.New("command").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, d)
+	if err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+//Branch returns the name of the branch of the delivery, or an empty string for tags
+func (d *Delivery) Branch() string {
+	if strings.HasPrefix(d.Ref, "refs/heads/") {
+		return strings.TrimPrefix(d.Ref, "refs/heads/")
+	}
+	return ""
+}
+
+//Slug returns the name of the branch or tag of the delivery as a DNS label, lower case with
+//everything but letters and digits replaced by dashes and at most 63 characters, for the host names
+//and namespaces of preview environments
+func (d *Delivery) Slug() string {
+	name := d.Branch()
+	if name == "" {
+		name = d.Tag()
+	}
+	var slug strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(name) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			slug.WriteRune(c)
+			dash = false
+		} else if !dash && slug.Len() > 0 {
+			slug.WriteByte('-')
+			dash = true
+		}
+	}
+	result := slug.String()
+	if len(result) > 63 {
+		result = result[:63]
+	}
+	return strings.TrimRight(result, "-")
+}
+
+//Tag returns the name of the tag of the delivery, or an empty string for branches
+func (d *Delivery) Tag() string {
+	if strings.HasPrefix(d.Ref, "refs/tags/") {
+		return strings.TrimPrefix(d.Ref, "refs/tags/")
+	}
+	return ""
+}
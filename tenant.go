@@ -0,0 +1,265 @@
+package webhook
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ConfigTenant is a team sharing the daemon with others, its repositories only handle the deliveries
+//sent below its URL path and cannot run commands outside its command directory
+type ConfigTenant struct {
+	Name string
+	//Path is the URL path prefix of the deliveries of the tenant, /<name> by default. The path of a
+	//repository of the tenant is relative to it.
+	Path string
+	//Secret and TriggerToken are used by the repositories of the tenant that do not have their own
+	Secret       string
+	TriggerToken string
+	Repositories []ConfigRepository
+	//CommandDir is the directory the commands of the tenant have to be in, relative commands are
+	//looked up in it instead of the PATH
+	CommandDir string
+	//LogFile receives the output of the commands of the tenant instead of the commandoutput
+	//destinations of the config
+	LogFile string
+}
+
+//prefix returns the URL path prefix of the tenant
+func (t ConfigTenant) prefix() string {
+	if t.Path == "" {
+		return path.Clean("/" + t.Name)
+	}
+	return path.Clean(t.Path)
+}
+
+//expandTenants moves the repositories of the tenants to the repositories of the config, below the
+//path of their tenant and with its secret and trigger token unless they have their own
+func expandTenants(config Config) Config {
+	if len(config.Tenants) == 0 {
+		return config
+	}
+
+	repositories := append([]ConfigRepository{}, config.Repositories...)
+	tenants := make([]ConfigTenant, len(config.Tenants))
+	for i, tenant := range config.Tenants {
+		for _, repo := range tenant.Repositories {
+			repo.tenant = tenant.Name
+			repo.Path = path.Join(tenant.prefix(), repo.Path)
+			if repo.Secret == "" && repo.SecretFile == "" && repo.SecretEnv == "" {
+				repo.Secret = tenant.Secret
+			}
+			if repo.TriggerToken == "" {
+				repo.TriggerToken = tenant.TriggerToken
+			}
+			repositories = append(repositories, repo)
+		}
+		tenant.Repositories = nil
+		tenants[i] = tenant
+	}
+	config.Repositories = repositories
+	config.Tenants = tenants
+	return config
+}
+
+//foldTenants moves the repositories of the tenants back to their tenants like in the config file,
+//the paths relative to the tenant and without the secret and trigger token of the tenant
+func foldTenants(config Config) Config {
+	if len(config.Tenants) == 0 {
+		return config
+	}
+
+	var repositories []ConfigRepository
+	tenants := append([]ConfigTenant{}, config.Tenants...)
+	for _, repo := range config.Repositories {
+		tenant := config.tenant(repo)
+		if tenant == nil {
+			repositories = append(repositories, repo)
+			continue
+		}
+		repo.Path = strings.TrimPrefix(strings.TrimPrefix(repo.Path, tenant.prefix()), "/")
+		if repo.Path != "" {
+			repo.Path = "/" + repo.Path
+		}
+		if repo.Secret == tenant.Secret && repo.SecretFile == "" && repo.SecretEnv == "" {
+			repo.Secret = ""
+		}
+		if repo.TriggerToken == tenant.TriggerToken {
+			repo.TriggerToken = ""
+		}
+		repo.tenant = ""
+		for i := range tenants {
+			if tenants[i].Name == tenant.Name {
+				tenants[i].Repositories = append(tenants[i].Repositories, repo)
+			}
+		}
+	}
+	config.Repositories = repositories
+	config.Tenants = tenants
+	return config
+}
+
+//tenant returns the tenant of a repository, nil for repositories of the config itself
+func (config Config) tenant(repo ConfigRepository) *ConfigTenant {
+	if repo.tenant == "" {
+		return nil
+	}
+	for i := range config.Tenants {
+		if config.Tenants[i].Name == repo.tenant {
+			return &config.Tenants[i]
+		}
+	}
+	return nil
+}
+
+//tenantCommand returns the program of a command of a tenant within its command directory, or an
+//error if the program is outside of it. The paths of git-sync actions of tenants are checked the same.
+func tenantCommand(tenant *ConfigTenant, program string) (string, error) {
+	if tenant == nil || tenant.CommandDir == "" {
+		return program, nil
+	}
+	dir := filepath.Clean(tenant.CommandDir)
+	if !filepath.IsAbs(program) {
+		program = filepath.Join(dir, program)
+	}
+	program = filepath.Clean(program)
+	if !strings.HasPrefix(program, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the commanddir %s of tenant %s", program, dir, tenant.Name)
+	}
+	return program, nil
+}
+
+//checkTenants reports the problems of the tenants of a config, the repositories of the tenants are
+//validated like the other repositories once they are expanded
+func checkTenants(problem func(format string, v ...interface{}), config Config) {
+	names := make(map[string]bool)
+	var prefixes []string
+	for i, tenant := range config.Tenants {
+		name := tenant.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+			problem("tenant %s has no name", name)
+		} else if names[name] {
+			problem("tenant %s is configured more than once", name)
+		}
+		names[name] = true
+
+		prefix := tenant.prefix()
+		if !strings.HasPrefix(prefix, "/") || prefix == "/" {
+			problem("path %s of tenant %s is not below /", tenant.Path, name)
+		}
+		for _, other := range prefixes {
+			if pathBelow(prefix, other) || pathBelow(other, prefix) {
+				problem("path %s of tenant %s overlaps with the path %s of another tenant", prefix, name, other)
+			}
+		}
+		prefixes = append(prefixes, prefix)
+
+		if tenant.CommandDir != "" && !filepath.IsAbs(tenant.CommandDir) {
+			problem("commanddir %s of tenant %s is not an absolute path", tenant.CommandDir, name)
+		}
+		if tenant.LogFile != "" {
+			if info, err := os.Stat(filepath.Dir(tenant.LogFile)); err != nil || !info.IsDir() {
+				problem("directory of logfile %s of tenant %s does not exist", tenant.LogFile, name)
+			}
+		}
+	}
+
+	for i, repo := range config.Repositories {
+		name := repo.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		tenant := config.tenant(repo)
+		if tenant == nil {
+			for _, prefix := range prefixes {
+				if repo.Path != "" && pathBelow(path.Clean(repo.Path), prefix) {
+					problem("path %s of repository %s is below the path of a tenant", repo.Path, name)
+				}
+			}
+			continue
+		}
+
+		if repo.RepoFromPath {
+			problem("repository %s of tenant %s cannot use repofrompath, it is served below the path of the tenant", name, tenant.Name)
+		}
+		//without a secret anyone knowing the path could run the commands of the tenant
+		if repo.Secret == "" {
+			problem("repository %s of tenant %s has no secret", name, tenant.Name)
+		}
+		for _, commands := range commandLists(repo) {
+			for _, cmd := range commands {
+				if cmd.Command == "" || isTemplate(cmd.Command) {
+					continue
+				}
+				if _, err := tenantCommand(tenant, cmd.Command); err != nil {
+					problem("command of repository %s: %s", name, err)
+				}
+			}
+		}
+		//docker and the registered executors are not confined to the command directory
+		if action := repo.Action; action != nil && tenant.CommandDir != "" {
+			if action.Type != "git-sync" {
+				problem("repository %s of tenant %s with a commanddir cannot use the %s action", name, tenant.Name, action.Type)
+			} else if !isTemplate(action.Path) {
+				if _, err := tenantCommand(tenant, action.Path); err != nil {
+					problem("git-sync path of repository %s: %s", name, err)
+				}
+			}
+		}
+	}
+}
+
+//commandLists returns all lists of commands of a repository: the commands, onsuccess, onfailure,
+//eventcommands and commandsets
+func commandLists(repo ConfigRepository) [][]ConfigCommand {
+	lists := [][]ConfigCommand{repo.Commands, repo.OnSuccess, repo.OnFailure}
+	for _, commands := range repo.EventCommands {
+		lists = append(lists, commands)
+	}
+	for _, commands := range repo.CommandSets {
+		lists = append(lists, commands)
+	}
+	return lists
+}
+
+//pathBelow reports whether a clean URL path is prefix or below it
+func pathBelow(urlPath string, prefix string) bool {
+	return urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/")
+}
+
+//tenantLogFiles are the open log files of the tenants
+type tenantLogFiles struct {
+	mutex sync.Mutex
+	files map[string]*os.File
+}
+
+var tenantLogs = &tenantLogFiles{files: make(map[string]*os.File)}
+
+//write appends the outcome and the output of a command to the log file of a tenant
+func (l *tenantLogFiles) write(tenant *ConfigTenant, source string, result Result) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	file, ok := l.files[tenant.LogFile]
+	if !ok {
+		var err error
+		file, err = os.OpenFile(tenant.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			errorf("failed to open logfile %s of tenant %s: %s\n", tenant.LogFile, tenant.Name, err)
+			return
+		}
+		l.files[tenant.LogFile] = file
+	}
+
+	status := fmt.Sprintf("exit code %d", result.ExitCode)
+	if result.Err != nil {
+		status = result.Err.Error()
+	}
+	fmt.Fprintf(file, "%s [%s] %s: %s\n", time.Now().Format(time.RFC3339), source, result.Command, status)
+	writePrefixedLines(file, fmt.Sprintf("[%s] %s: ", source, result.Command), result.Output)
+}
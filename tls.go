@@ -0,0 +1,31 @@
+package webhook
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+//tlsConfig returns the TLS config of the server, requiring client certificates signed by
+//the CA bundle in tlsclientca when set
+func tlsConfig(config Config) (*tls.Config, error) {
+	if config.TLSCert == "" || config.TLSKey == "" {
+		return nil, errors.New("tlscert and tlskey are both required for TLS")
+	}
+
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.TLSClientCA != "" {
+		bundle, err := ioutil.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, errors.New("no certificates found in " + config.TLSClientCA)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
@@ -0,0 +1,328 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ConfigTracing is where the spans of the processing of deliveries are exported to, over OTLP/HTTP
+//with JSON encoding
+type ConfigTracing struct {
+	//Endpoint is the URL of the OTLP/HTTP receiver, like http://collector:4318, spans are posted to
+	///v1/traces below it unless the URL has a path
+	Endpoint string
+	//Headers are sent with every export, like the API key of a tracing service
+	Headers map[string]string
+	//ServiceName is the service.name of the spans, go-gitea-webhook by default
+	ServiceName string
+}
+
+//defaultServiceName is the service.name of the spans when not configured
+const defaultServiceName = "go-gitea-webhook"
+
+//the span kinds and status codes of OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+//traceBatchSize and traceInterval are how many spans are exported at once and how often
+const (
+	traceBatchSize = 512
+	traceInterval  = 5 * time.Second
+)
+
+//spanContext identifies a span across goroutines and processes
+type spanContext struct {
+	traceID string
+	spanID  string
+}
+
+//valid reports whether a span context identifies a span
+func (sc spanContext) valid() bool {
+	return sc.traceID != "" && sc.spanID != ""
+}
+
+//traceParent returns the span context as W3C traceparent header
+func (sc spanContext) traceParent() string {
+	return "00-" + sc.traceID + "-" + sc.spanID + "-01"
+}
+
+//parseTraceParent returns the span context of a W3C traceparent header, or an invalid one
+func parseTraceParent(header string) spanContext {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return spanContext{}
+	}
+	for _, part := range parts[1:3] {
+		if _, err := hex.DecodeString(part); err != nil || strings.Trim(part, "0") == "" {
+			return spanContext{}
+		}
+	}
+	return spanContext{traceID: strings.ToLower(parts[1]), spanID: strings.ToLower(parts[2])}
+}
+
+//span is an operation of the processing of a delivery, a nil span records nothing so callers do
+//not have to check whether tracing is enabled
+type span struct {
+	context spanContext
+	parent  string
+	name    string
+	kind    int
+	start   time.Time
+	attrs   map[string]interface{}
+	status  int
+	message string
+}
+
+//startSpan starts a span, a child of parent if it is valid or the root of a new trace otherwise.
+//It returns nil when tracing is not configured.
+func startSpan(config Config, parent spanContext, name string, kind int) *span {
+	if config.Tracing == nil || config.Tracing.Endpoint == "" {
+		return nil
+	}
+
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]interface{})}
+	s.context.spanID = randomHex(8)
+	if parent.valid() {
+		s.context.traceID = parent.traceID
+		s.parent = parent.spanID
+	} else {
+		s.context.traceID = randomHex(16)
+	}
+	return s
+}
+
+//randomHex returns n random bytes as hex
+func randomHex(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+//spanContext returns the context of the span, or an invalid one for a nil span
+func (s *span) spanContext() spanContext {
+	if s == nil {
+		return spanContext{}
+	}
+	return s.context
+}
+
+//set adds an attribute to the span, a string, an int or a bool
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = value
+}
+
+//fail marks the span as failed
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.status = spanStatusError
+	s.message = err.Error()
+}
+
+//end ends the span and queues it for export
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	if s.status == 0 {
+		s.status = spanStatusOK
+	}
+	tracer.add(s, time.Now())
+}
+
+//spanKey is the key of the span of a job in the context of its commands
+type spanKey struct{}
+
+//contextWithSpan returns a context carrying a span, its children are started from it
+func contextWithSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s.context)
+}
+
+//spanFromContext returns the context of the span carried by ctx, or an invalid one
+func spanFromContext(ctx context.Context) spanContext {
+	sc, _ := ctx.Value(spanKey{}).(spanContext)
+	return sc
+}
+
+//otlpSpan is a span as exported in the JSON encoding of OTLP
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+//otlpAttributes returns the attributes in the order of their keys
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	var list []otlpAttribute
+	for key, value := range attrs {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			//64-bit integers are strings in the JSON encoding of protobuf
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		list = append(list, otlpAttribute{Key: key, Value: v})
+	}
+	sort.Slice(list, func(i, k int) bool {
+		return list[i].Key < list[k].Key
+	})
+	return list
+}
+
+//spanExporter sends the ended spans to the OTLP receiver in batches in the background
+type spanExporter struct {
+	mutex   sync.Mutex
+	spans   []otlpSpan
+	started sync.Once
+	//exporting keeps the periodic export and the one on shutdown apart
+	exporting sync.Mutex
+}
+
+var tracer = &spanExporter{}
+
+//add queues an ended span, spans beyond a few batches are dropped while the receiver is down
+func (e *spanExporter) add(s *span, end time.Time) {
+	exported := otlpSpan{
+		TraceID:      s.context.traceID,
+		SpanID:       s.context.spanID,
+		ParentSpanID: s.parent,
+		Name:         s.name,
+		Kind:         s.kind,
+		Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+		End:          strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:   otlpAttributes(s.attrs),
+	}
+	exported.Status.Code = s.status
+	exported.Status.Message = s.message
+
+	e.started.Do(func() {
+		go func() {
+			for range time.Tick(traceInterval) {
+				e.flush()
+			}
+		}()
+	})
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if len(e.spans) < 4*traceBatchSize {
+		e.spans = append(e.spans, exported)
+	}
+}
+
+//flush exports the queued spans to the receiver of the active config
+func (e *spanExporter) flush() {
+	config := currentConfig()
+	if config.Tracing == nil || config.Tracing.Endpoint == "" {
+		return
+	}
+
+	e.exporting.Lock()
+	defer e.exporting.Unlock()
+	for {
+		e.mutex.Lock()
+		batch := e.spans
+		if len(batch) > traceBatchSize {
+			batch = batch[:traceBatchSize]
+		}
+		e.spans = e.spans[len(batch):]
+		e.mutex.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+
+		err := exportSpans(*config.Tracing, batch)
+		if err != nil {
+			warnf("failed to export %d spans: %s\n", len(batch), err)
+			return
+		}
+	}
+}
+
+//exportSpans posts spans to an OTLP/HTTP receiver
+func exportSpans(tracing ConfigTracing, spans []otlpSpan) error {
+	serviceName := tracing.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": serviceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": defaultServiceName},
+				"spans": spans,
+			}},
+		}},
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimRight(tracing.Endpoint, "/")
+	if strings.Count(endpoint, "/") <= 2 {
+		endpoint += "/v1/traces"
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range tracing.Headers {
+		req.Header.Set(name, value)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", endpoint, resp.Status)
+	}
+	return nil
+}
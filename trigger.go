@@ -0,0 +1,153 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	api "code.gitea.io/sdk/gitea"
+)
+
+//triggerRequest is the optional body of a manual trigger
+type triggerRequest struct {
+	//Ref is the full ref or the name of a branch, SHA the commit the commands are run for
+	Ref string `json:"ref"`
+	SHA string `json:"sha"`
+}
+
+//triggerHandler runs the commands of the repositories whose triggertoken is sent as bearer token to
+///trigger/<owner>/<repo> for a synthesized push to the repository
+func triggerHandler(w http.ResponseWriter, r *http.Request) {
+	config := currentConfig()
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			errorf("panic while handling a trigger: %v\n%s", recovered, debug.Stack())
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+		}
+	}()
+
+	if !checkAccess(accessConfig(config, r), w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	fullName := strings.Trim(strings.TrimPrefix(r.URL.Path, "/trigger/"), "/")
+	if fullName == "" {
+		writeJSONError(w, http.StatusNotFound, "no repository")
+		return
+	}
+
+	//only the repositories the token belongs to are triggered, every other repository of the config
+	//is invisible to the request
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	triggerConfig := config
+	triggerConfig.Repositories = nil
+	for _, repo := range config.Repositories {
+		if repo.TriggerToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(repo.TriggerToken)) != 1 {
+			continue
+		}
+		if match, err := regexp.MatchString(repo.Name, fullName); err == nil && match {
+			//the trigger endpoint replaces the path of the repository
+			repo.Path = ""
+			repo.RepoFromPath = false
+			triggerConfig.Repositories = append(triggerConfig.Repositories, repo)
+		}
+	}
+	if len(triggerConfig.Repositories) == 0 {
+		warnf("unauthorized trigger of %s from %s\n", fullName, clientIP(config, r))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="go-gitea-webhook trigger"`)
+		writeJSONError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, config.MaxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	var request triggerRequest
+	if len(strings.TrimSpace(string(data))) > 0 {
+		err = json.Unmarshal(data, &request)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "malformed body: "+err.Error())
+			return
+		}
+	}
+	if request.Ref != "" && !strings.HasPrefix(request.Ref, "refs/") {
+		request.Ref = "refs/heads/" + request.Ref
+	}
+
+	d := newTriggerDelivery(fullName, request)
+	info := &DeliveryInfo{
+		ID:         d.ID,
+		Event:      d.Event,
+		Repository: d.Repo.FullName,
+		Ref:        d.Ref,
+		Received:   time.Now(),
+	}
+	defer func() {
+		state.recordDelivery(info, nil, nil, config.HistorySize)
+	}()
+
+	d.logf("received trigger of %s for %s from %s\n", d.Repo.FullName, d.Ref, clientIP(config, r))
+	metrics.observeDelivery(d.Event, d.Repo.FullName)
+
+	if state.isPaused() {
+		d.logf("command execution is paused, skipping %s\n", d.Repo.FullName)
+		info.Skipped = "paused"
+		respond(w, http.StatusOK, info, "command execution is paused")
+		return
+	}
+
+	env := append(os.Environ(), "GITEA_ENVIRONMENT="+resolveEnvironment(config, d.Ref))
+	env = append(env, d.environment()...)
+
+	matches, matched, skipped := NewMatcher(triggerConfig).Match(d, "/")
+	if skipped != "" {
+		info.Skipped = skipped
+	}
+	//the token was checked already
+	authorized := func(repo ConfigRepository) bool {
+		return true
+	}
+	dispatch(w, config, d, info, matches, matched, nil, env, waitRequested(config, r), authorized, func() {})
+}
+
+//newTriggerDelivery returns the push a manual trigger of a repository stands for
+func newTriggerDelivery(fullName string, request triggerRequest) *Delivery {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	repo := &api.Repository{Name: fullName, FullName: fullName}
+	if i := strings.LastIndex(fullName, "/"); i >= 0 {
+		repo.Name = fullName[i+1:]
+		repo.Owner = &api.User{UserName: fullName[:i]}
+	}
+	return &Delivery{
+		ID:       "trigger-" + hex.EncodeToString(id),
+		Event:    "push",
+		Provider: "trigger",
+		Repo:     repo,
+		Ref:      request.Ref,
+		After:    request.SHA,
+	}
+}
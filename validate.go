@@ -0,0 +1,375 @@
+package webhook
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//configErrors lists all the problems found in a config
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return fmt.Sprintf("%d problems:\n  %s", len(e), strings.Join(e, "\n  "))
+}
+
+//validateConfig catches mistakes in the config that would otherwise only show up when a delivery
+//arrives, all problems are reported at once
+func validateConfig(config Config) error {
+	var problems configErrors
+	problem := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+
+	if len(config.Listeners) > 0 {
+		if config.Address != "" || config.Port != 0 || config.TLSCert != "" || config.TLSKey != "" {
+			problem("address, port, tlscert and tlskey cannot be combined with listeners")
+		}
+	}
+	addresses := make(map[string]bool)
+	for _, l := range config.listeners() {
+		lc := l.apply(config)
+		address := listenAddress(lc)
+		if strings.HasPrefix(lc.Address, "unix:") {
+			if mode, err := strconv.ParseUint(lc.SocketMode, 8, 32); lc.SocketMode != "" && (err != nil || mode > 0777) {
+				problem("socketmode %s of %s is not an octal file mode", lc.SocketMode, address)
+			}
+		} else if lc.Port < 1 || lc.Port > 65535 {
+			problem("port %d is not between 1 and 65535", lc.Port)
+		}
+		if addresses[address] {
+			problem("listener %s is configured twice", address)
+		}
+		addresses[address] = true
+		for _, part := range l.Serve {
+			oneOf(problem, "serve of listener "+address, part, listenerParts...)
+		}
+		if (l.TLSCert == "") != (l.TLSKey == "") {
+			problem("tlscert and tlskey of listener %s have to be set together", address)
+		}
+		if _, err := parseNetworks(l.AllowedIPs); err != nil {
+			problem("invalid allowedips of listener %s: %s", address, err)
+		}
+		if l.BasicAuthUser == "" && l.BasicAuthPassword != "" {
+			problem("basicauthpassword of listener %s requires a basicauthuser", address)
+		}
+	}
+	oneOf(problem, "logtarget", config.LogTarget, "", "file", "stdout", "stderr")
+	if logTarget(config) != "file" {
+		if config.LogMaxSize > 0 || config.LogMaxBackups > 0 || config.LogMaxAge > 0 {
+			problem("logmaxsize, logmaxbackups and logmaxage require logging to a logfile")
+		}
+	} else if config.Logfile != "" {
+		if info, err := os.Stat(filepath.Dir(config.Logfile)); err != nil || !info.IsDir() {
+			problem("directory of logfile %s does not exist", config.Logfile)
+		}
+	}
+	oneOf(problem, "logformat", config.LogFormat, "", "text", "json", "logfmt")
+	oneOf(problem, "loglevel", config.LogLevel, append([]string{""}, logLevels...)...)
+	if config.LogMaxSize < 0 || config.LogMaxBackups < 0 || config.LogMaxAge < 0 {
+		problem("logmaxsize, logmaxbackups and logmaxage cannot be negative")
+	}
+	oneOf(problem, "skipcommits", config.SkipCommits, "", "head", "all", "none")
+	oneOf(problem, "statusformat", config.StatusFormat, "", "json", "text")
+	for _, destination := range config.CommandOutput {
+		oneOf(problem, "commandoutput", destination, "log", "stdout", "stderr")
+	}
+	if config.MaxBodySize < 0 {
+		problem("maxbodysize cannot be negative")
+	}
+	if config.DedupSize < 0 {
+		problem("dedupsize cannot be negative")
+	}
+	if config.WaitTimeout < 0 || config.ResponseOutputSize < 0 {
+		problem("waittimeout and responseoutputsize cannot be negative")
+	}
+	if config.RunLogKeep < 0 || config.RunLogMaxAge < 0 {
+		problem("runlogkeep and runlogmaxage cannot be negative")
+	}
+	if _, err := parseNetworks(config.AllowedIPs); err != nil {
+		problem("invalid allowedips: %s", err)
+	}
+	if _, err := parseNetworks(config.TrustedProxies); err != nil {
+		problem("invalid trustedproxies: %s", err)
+	}
+	if config.BasicAuthUser == "" && config.BasicAuthPassword != "" {
+		problem("basicauthpassword requires a basicauthuser")
+	}
+	if config.AdminAPI && config.AdminToken == "" {
+		problem("adminapi requires an admintoken")
+	}
+	for _, dir := range config.CommandDirs {
+		if !filepath.IsAbs(dir) {
+			problem("commanddir %s is not an absolute path", dir)
+		}
+	}
+	for _, mapping := range config.RefEnvMap {
+		if _, err := regexp.Compile(mapping.Pattern); err != nil {
+			problem("invalid refenvmap pattern %s: %s", mapping.Pattern, err)
+		}
+	}
+
+	for _, repo := range config.Repositories {
+		if repo.SecretFile != "" && repo.SecretEnv != "" {
+			problem("secretfile and secretenv of repository %s cannot be combined", repo.Name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, repo := range config.Repositories {
+		name := repo.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+			problem("repository %s has no name", name)
+		}
+		if _, err := regexp.Compile(repo.Name); err != nil {
+			problem("invalid name of repository %s: %s", name, err)
+		}
+
+		//the same pattern is fine as long as it handles different deliveries
+		key := fmt.Sprintf("%q", [][]string{{repo.Name, path.Clean("/" + repo.Path), strconv.FormatBool(repo.RepoFromPath)}, repo.Refs, repo.events(),
+			repo.PathsInclude, repo.PathsExclude, repo.Actions, repo.BaseBranches, repo.Labels, {repo.CommentPattern}})
+		if seen[key] {
+			problem("repository %s is configured more than once with the same filters", name)
+		}
+		seen[key] = true
+
+		if len(repo.Commands) == 0 && len(repo.EventCommands) == 0 && len(repo.CommandSets) == 0 && len(repo.Forward) == 0 && len(repo.Publish) == 0 && repo.Action == nil {
+			problem("repository %s has no commands, eventcommands, commandsets, forward or action", name)
+		}
+		for _, pattern := range repo.Refs {
+			if _, err := regexp.Compile(pattern); err != nil {
+				problem("invalid refs pattern %s of repository %s: %s", pattern, name, err)
+			}
+		}
+		filters := append(append(append(append(append([]string{}, repo.PushersAllow...), repo.PushersDeny...), repo.AuthorsAllow...), repo.AuthorsDeny...), repo.BaseBranches...)
+		filters = append(filters, repo.CommentersAllow...)
+		for _, pattern := range []string{repo.SkipCommitMessagePattern, repo.CommentPattern} {
+			if pattern != "" {
+				filters = append(filters, pattern)
+			}
+		}
+		for _, pattern := range filters {
+			if _, err := regexp.Compile(pattern); err != nil {
+				problem("invalid pattern %s of repository %s: %s", pattern, name, err)
+			}
+		}
+		for _, glob := range append(append([]string{}, repo.PathsInclude...), repo.PathsExclude...) {
+			if _, err := globRegexp(glob); err != nil {
+				problem("invalid glob %s of repository %s: %s", glob, name, err)
+			}
+		}
+		for _, event := range repo.Events {
+			if !isEventName(event) {
+				problem("unsupported event %s in events of repository %s", event, name)
+			}
+		}
+		for event, commands := range repo.EventCommands {
+			if !isEventName(event) {
+				problem("unsupported event %s in eventcommands of repository %s", event, name)
+			}
+			if len(commands) == 0 {
+				problem("eventcommands %s of repository %s is empty", event, name)
+			}
+		}
+		for _, commands := range [][]ConfigCommand{repo.Commands, repo.OnSuccess, repo.OnFailure} {
+			for _, cmd := range commands {
+				if strings.TrimSpace(cmd.Command) == "" {
+					problem("repository %s has an empty command", name)
+				}
+			}
+		}
+		oneOf(problem, "policy of repository "+name, repo.Policy, "", "continue", "stop")
+		if repo.Retries < 0 || repo.RetryBackoff < 0 {
+			problem("retries and retrybackoff of repository %s cannot be negative", name)
+		}
+		if repo.Debounce < 0 {
+			problem("debounce of repository %s is negative", name)
+		}
+		if repo.CommentOutputSize < 0 {
+			problem("commentoutputsize of repository %s is negative", name)
+		}
+		for _, fullName := range repo.TriggersRepos {
+			if strings.Count(fullName, "/") != 1 || strings.HasPrefix(fullName, "/") || strings.HasSuffix(fullName, "/") {
+				problem("triggersrepos %s of repository %s is not owner/name", fullName, name)
+			}
+		}
+		oneOf(problem, "concurrency of repository "+name, repo.Concurrency, "", "queue", "skip", "cancel", "parallel")
+		oneOf(problem, "schedulemode of repository "+name, repo.ScheduleMode, "", "queue", "skip")
+		oneOf(problem, "onrestart of repository "+name, repo.OnRestart, "", "interrupt", "resume")
+		oneOf(problem, "skipcommits of repository "+name, repo.SkipCommits, "", "head", "all", "none")
+		if _, err := parseSchedule(repo.Schedule); err != nil {
+			problem("invalid schedule of repository %s: %s", name, err)
+		}
+		if repo.Path != "" {
+			if !strings.HasPrefix(repo.Path, "/") {
+				problem("path %s of repository %s does not start with /", repo.Path, name)
+			}
+			for _, reserved := range []string{"/admin", "/metrics", "/healthz", "/readyz", "/trigger"} {
+				if p := path.Clean(repo.Path); p == reserved || strings.HasPrefix(p, reserved+"/") {
+					problem("path %s of repository %s is used by %s", repo.Path, name, reserved)
+				}
+			}
+			if repo.RepoFromPath && repo.tenant == "" {
+				problem("path of repository %s cannot be used together with repofrompath", name)
+			}
+		}
+		if repo.RunAs != "" && repo.SudoUser != "" {
+			problem("repository %s has both runas and sudouser set", name)
+		}
+		checkCommandPolicy(problem, config, repo, "repository")
+		checkEnv(problem, repo, name)
+		checkScript(problem, repo, name)
+		checkLimits(problem, repo.Limits, "repository "+name)
+		for _, commands := range commandLists(repo) {
+			for _, cmd := range commands {
+				checkLimits(problem, cmd.Limits, "command "+cmd.Command)
+			}
+		}
+		if repo.Action != nil {
+			switch repo.Action.Type {
+			case "git-sync":
+				if repo.Action.Path == "" {
+					problem("action of repository %s has no path", name)
+				}
+			case "docker":
+				if repo.Action.Image == "" {
+					problem("docker action of repository %s has no image", name)
+				}
+			default:
+				if _, ok := executorFor(repo.Action.Type); !ok {
+					problem("unknown action type %s of repository %s", repo.Action.Type, name)
+				}
+			}
+		}
+		for _, target := range repo.Notify {
+			oneOf(problem, "notify type of repository "+name, target.Type, "slack", "matrix", "email")
+			oneOf(problem, "notify on of repository "+name, target.On, "", "failure", "always")
+			switch target.Type {
+			case "slack", "matrix":
+				if !strings.HasPrefix(target.URL, "http://") && !strings.HasPrefix(target.URL, "https://") {
+					problem("notify url %s of repository %s is not an http(s) url", target.URL, name)
+				}
+				if target.Type == "matrix" && (target.Room == "" || target.Token == "") {
+					problem("matrix notification of repository %s requires a room and a token", name)
+				}
+			case "email":
+				if target.SMTP == "" || target.From == "" || len(target.To) == 0 {
+					problem("email notification of repository %s requires smtp, from and to", name)
+				}
+			}
+		}
+		for _, target := range repo.Forward {
+			if !strings.HasPrefix(target.URL, "http://") && !strings.HasPrefix(target.URL, "https://") {
+				problem("forward url %s of repository %s is not an http(s) url", target.URL, name)
+			}
+			if target.Retries < 0 || target.Backoff < 0 {
+				problem("retries and backoff of forward %s of repository %s cannot be negative", target.URL, name)
+			}
+		}
+		for _, target := range repo.Publish {
+			schemes := map[string][]string{"nats": {"nats", "tls"}, "redis": {"redis", "rediss"}, "amqp": {"amqp", "amqps"}}
+			oneOf(problem, "publish type of repository "+name, target.Type, "nats", "redis", "amqp")
+			if u, err := url.Parse(target.URL); err != nil || u.Hostname() == "" {
+				problem("publish url %s of repository %s is invalid", target.URL, name)
+			} else if allowed, ok := schemes[target.Type]; ok && u.Scheme != allowed[0] && u.Scheme != allowed[1] {
+				problem("publish url %s of repository %s is not a %s:// or %s:// url", target.URL, name, allowed[0], allowed[1])
+			}
+			if target.Subject == "" && target.Type != "amqp" {
+				problem("%s publish of repository %s has no subject", target.Type, name)
+			}
+			if target.Timeout < 0 || target.Retries < 0 || target.Backoff < 0 {
+				problem("timeout, retries and backoff of publish %s of repository %s cannot be negative", target.URL, name)
+			}
+		}
+	}
+
+	scheduleNames := make(map[string]bool)
+	for i, schedule := range config.Schedules {
+		name := schedule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+			problem("schedule %s has no name", name)
+		} else if scheduleNames[name] {
+			problem("schedule %s is configured more than once", name)
+		}
+		scheduleNames[name] = true
+
+		if _, err := parseCron(schedule.Cron); err != nil {
+			problem("invalid cron of schedule %s: %s", name, err)
+		}
+		if _, err := schedule.location(); err != nil {
+			problem("invalid timezone of schedule %s: %s", name, err)
+		}
+		if len(schedule.Commands) == 0 && schedule.Action == nil {
+			problem("schedule %s has no commands or action", name)
+		}
+		for _, commands := range [][]ConfigCommand{schedule.Commands, schedule.OnSuccess, schedule.OnFailure} {
+			for _, cmd := range commands {
+				if strings.TrimSpace(cmd.Command) == "" {
+					problem("schedule %s has an empty command", name)
+				}
+			}
+		}
+		if schedule.Action != nil && schedule.Action.Type != "git-sync" && schedule.Action.Type != "docker" {
+			if _, ok := executorFor(schedule.Action.Type); !ok {
+				problem("unknown action type %s of schedule %s", schedule.Action.Type, name)
+			}
+		}
+		oneOf(problem, "policy of schedule "+name, schedule.Policy, "", "continue", "stop")
+		oneOf(problem, "concurrency of schedule "+name, schedule.Concurrency, "", "queue", "skip", "cancel", "parallel")
+		if schedule.Retries < 0 || schedule.RetryBackoff < 0 {
+			problem("retries and retrybackoff of schedule %s cannot be negative", name)
+		}
+		if schedule.RunAs != "" && schedule.SudoUser != "" {
+			problem("schedule %s has both runas and sudouser set", name)
+		}
+		checkCommandPolicy(problem, config, schedule.repository(), "schedule")
+		for _, target := range schedule.Notify {
+			oneOf(problem, "notify type of schedule "+name, target.Type, "slack", "matrix", "email")
+			oneOf(problem, "notify on of schedule "+name, target.On, "", "failure", "always")
+		}
+	}
+	checkChains(problem, config.Repositories)
+	checkTenants(problem, config)
+	checkJobClasses(problem, config)
+	checkDatabase(problem, config)
+	checkLimits(problem, config.Limits, "the config")
+	if config.HookURL != "" {
+		if u, err := url.Parse(config.HookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("hookurl %s is not an http or https URL", config.HookURL)
+		}
+	}
+	if config.BasePath != "" && (!strings.HasPrefix(config.BasePath, "/") || strings.ContainsAny(config.BasePath, "?#")) {
+		problem("basepath %s is not a URL path starting with /", config.BasePath)
+	}
+	if config.Tracing != nil {
+		if u, err := url.Parse(config.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("endpoint %s of tracing is not an http or https URL", config.Tracing.Endpoint)
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+//oneOf reports a problem if value is not one of the allowed values of a setting
+func oneOf(problem func(format string, v ...interface{}), setting string, value string, allowed ...string) {
+	var expected []string
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+		if a != "" {
+			expected = append(expected, a)
+		}
+	}
+	problem("invalid %s %s, expected one of %s", setting, value, strings.Join(expected, ", "))
+}
@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"net/http"
+	"time"
+)
+
+//defaultWaitTimeout is the time in seconds the response to a synchronous delivery waits for its jobs
+//when not configured
+const defaultWaitTimeout = 30
+
+//waitInterval is how often a synchronous delivery checks whether its jobs are done
+const waitInterval = 100 * time.Millisecond
+
+//waitRequested reports whether the response to a delivery waits for its jobs, for all deliveries
+//with synchronous or for a single request with ?wait
+func waitRequested(config Config, r *http.Request) bool {
+	_, wait := r.URL.Query()["wait"]
+	return config.Synchronous || wait
+}
+
+//respondWhenDone answers a delivery once its queued jobs are done, with their results, or with the
+//results so far when they take longer than the waittimeout
+func respondWhenDone(w http.ResponseWriter, config Config, info *DeliveryInfo) {
+	timeout := time.Duration(config.WaitTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultWaitTimeout * time.Second
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(waitInterval)
+	defer ticker.Stop()
+
+	for {
+		if summary, done := state.jobsDone(info); done {
+			switch {
+			case summary.Failed > 0:
+				respondResults(w, http.StatusInternalServerError, info, "commands failed", config.ResponseOutputSize)
+			default:
+				respondResults(w, http.StatusOK, info, "commands executed", config.ResponseOutputSize)
+			}
+			return
+		}
+		select {
+		case <-deadline.C:
+			respondResults(w, http.StatusAccepted, info, "commands still running", config.ResponseOutputSize)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//respondResults answers a delivery with its JSON summary including the results of the commands,
+//with the last size bytes of their output
+func respondResults(w http.ResponseWriter, status int, info *DeliveryInfo, message string, size int) {
+	state.mutex.Lock()
+	summary := *info
+	summary.Results = append([]CommandRecord(nil), info.Results...)
+	state.mutex.Unlock()
+
+	for i, record := range summary.Results {
+		if len(record.Output) > size {
+			record.Output = record.Output[len(record.Output)-size:]
+		}
+		summary.Results[i] = record
+	}
+
+	writeJSON(w, status, struct {
+		Message string `json:"message"`
+		DeliveryInfo
+	}{message, summary})
+}
@@ -0,0 +1,79 @@
+package webhook
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+//watchDebounce is the time to wait for more changes before reloading, editors write files in several steps
+const watchDebounce = 500 * time.Millisecond
+
+//watchConfig reloads the config file whenever its content or the content of an included file changes.
+//The directories are watched instead of the files, so replacing a file (editors, Kubernetes config maps)
+//and adding a file to an include directory is noticed too.
+func watchConfig(path string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	for i, dir := range configDirectories(path, currentConfig()) {
+		err = watcher.Add(dir)
+		if err != nil && i == 0 {
+			watcher.Close()
+			return err
+		}
+		if err != nil {
+			warnf("not watching include directory %s: %s\n", dir, err)
+		}
+	}
+
+	last := readConfigFiles(path)
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				debounce = time.After(watchDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				warnf("watching config file: %s\n", err)
+			case <-debounce:
+				data := readConfigFiles(path)
+				if data == nil || bytes.Equal(data, last) {
+					continue
+				}
+				last = data
+				log.Printf("config file %s changed\n", path)
+				reloadConfig()
+			}
+		}
+	}()
+
+	log.Printf("watching %s for changes\n", path)
+	return nil
+}
+
+//readConfigFiles returns the names and the contents of the config file and its included files, or nil
+//if the config file cannot be read
+func readConfigFiles(path string) []byte {
+	var out bytes.Buffer
+	for i, file := range configFiles(path) {
+		data, err := ioutil.ReadFile(file)
+		if err != nil && i == 0 {
+			return nil
+		}
+		out.WriteString(file + "\x00")
+		out.Write(data)
+		out.WriteString("\x00")
+	}
+	return out.Bytes()
+}